@@ -0,0 +1,174 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/maple-ai/fleet-api/db"
+	"github.com/maple-ai/syrup"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func adminGetGeofences(w http.ResponseWriter, r *http.Request) {
+	var fences []db.Geofence
+	if err := db.Cols.Geofences.Find(db.M{}).Sort("city", "name").All(&fences); err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, fences)
+}
+
+func adminSaveGeofence(w http.ResponseWriter, r *http.Request) {
+	var fence db.Geofence
+	if err := syrup.Bind(w, r, &fence); err != nil {
+		return
+	}
+
+	errs := []string{}
+	switch {
+	case len(fence.Name) == 0:
+		errs = append(errs, "Name cannot be empty")
+	case !fence.GarageID.Valid() && len(fence.City) == 0:
+		errs = append(errs, "Geofence must apply to a garage or a city")
+	case len(fence.Polygon) < 3:
+		errs = append(errs, "Geofence needs at least 3 points")
+	}
+
+	for _, point := range fence.Polygon {
+		if point[0] < -90 || point[0] > 90 || point[1] < -180 || point[1] > 180 {
+			errs = append(errs, "Points must be [lat, lng]")
+			break
+		}
+	}
+
+	if len(errs) > 0 {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"errors": errs,
+		})
+		return
+	}
+
+	if r.Method == "POST" {
+		fence.ID = bson.NewObjectId()
+		fence.Created = time.Now()
+		fence.CreatedBy = context.Get(r, "userID").(bson.ObjectId)
+
+		if err := db.Cols.Geofences.Insert(&fence); err != nil {
+			panic(err)
+		}
+
+		syrup.WriteJSON(w, http.StatusCreated, fence)
+		return
+	}
+
+	fence.ID = bson.ObjectIdHex(mux.Vars(r)["geofence_id"])
+	set := db.M{
+		"name":    fence.Name,
+		"city":    fence.City,
+		"polygon": fence.Polygon,
+	}
+	update := db.M{"$set": set}
+	if fence.GarageID.Valid() {
+		set["garage_id"] = fence.GarageID
+	} else {
+		update["$unset"] = db.M{"garage_id": 1}
+	}
+
+	if err := db.Cols.Geofences.UpdateId(fence.ID, update); err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, fence)
+}
+
+func adminDeleteGeofence(w http.ResponseWriter, r *http.Request) {
+	if err := db.Cols.Geofences.RemoveId(bson.ObjectIdHex(mux.Vars(r)["geofence_id"])); err != nil {
+		panic(err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminGetAlerts lists GPS alerts, open ones unless ?status= is given. Filter with ?type=a,b and ?bike_id=
+func adminGetAlerts(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	types := alertTypes()
+	if filter := query.Get("type"); len(filter) > 0 {
+		types = strings.Split(filter, ",")
+	}
+
+	q := db.M{
+		"type":   db.M{"$in": types},
+		"status": "open",
+	}
+	if status := query.Get("status"); len(status) > 0 {
+		q["status"] = db.M{"$in": strings.Split(status, ",")}
+	}
+	if bikeID := query.Get("bike_id"); bson.IsObjectIdHex(bikeID) {
+		q["bike_id"] = bson.ObjectIdHex(bikeID)
+	}
+
+	var alerts []db.Event
+	if err := db.Cols.Events.Find(q).Sort("-occurred_at").Limit(500).All(&alerts); err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, alerts)
+}
+
+// adminAcknowledgeAlert closes an open alert. Another alert of the type can then be raised for the bike.
+func adminAcknowledgeAlert(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Notes string `json:"notes"`
+	}
+	if err := syrup.Bind(w, r, &body); err != nil {
+		return
+	}
+
+	change := db.EventStatusChange{
+		Status:    "acknowledged",
+		Notes:     body.Notes,
+		ChangedBy: context.Get(r, "userID").(bson.ObjectId),
+		ChangedAt: time.Now(),
+	}
+
+	var alert db.Event
+	if _, err := db.Cols.Events.Find(db.M{
+		"_id":    bson.ObjectIdHex(mux.Vars(r)["alert_id"]),
+		"type":   db.M{"$in": alertTypes()},
+		"status": "open",
+	}).Apply(mgo.Change{
+		Update: db.M{
+			"$set": db.M{
+				"status":          change.Status,
+				"acknowledged_by": change.ChangedBy,
+				"acknowledged_at": change.ChangedAt,
+			},
+			"$push": db.M{"status_history": change},
+		},
+		ReturnNew: true,
+	}, &alert); err == mgo.ErrNotFound {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Alert is not open",
+		})
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, alert)
+}
+
+func alertTypes() []string {
+	types := []string{}
+	for alertType := range db.AlertTypes {
+		types = append(types, alertType)
+	}
+
+	return types
+}
@@ -1,30 +1,82 @@
 package api
 
 import (
-	"bufio"
+	"fmt"
 	"io"
 	"net/http"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/maple-ai/syrup"
 	"github.com/gorilla/context"
 	"github.com/gorilla/mux"
+	qrcode "github.com/skip2/go-qrcode"
 	mgo "gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 	"github.com/maple-ai/fleet-api/db"
 )
 
 func adminGetBike(w http.ResponseWriter, r *http.Request) {
-	syrup.WriteJSON(w, http.StatusOK, context.Get(r, "bike"))
+	bike := context.Get(r, "bike").(db.Bike)
+
+	// lapsed documents explain why a bike can't be booked
+	issues, err := db.GetComplianceIssues(bike.ID)
+	if err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, struct {
+		db.Bike
+		ComplianceIssues []string `json:"compliance_issues"`
+	}{bike, issues})
+}
+
+// adminGetBikeQRCode renders the bike's signed handover QR code as PNG (default) or SVG
+func adminGetBikeQRCode(w http.ResponseWriter, r *http.Request) {
+	bike := context.Get(r, "bike").(db.Bike)
+
+	code, err := qrcode.New(bike.QRPayload(), qrcode.Medium)
+	if err != nil {
+		panic(err)
+	}
+
+	if r.URL.Query().Get("format") == "svg" {
+		bitmap := code.Bitmap()
+		size := len(bitmap)
+
+		w.Header().Set("content-type", "image/svg+xml")
+		fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size)
+		fmt.Fprintf(w, `<rect width="%d" height="%d" fill="#fff"/>`, size, size)
+		for y, row := range bitmap {
+			for x, black := range row {
+				if black {
+					fmt.Fprintf(w, `<rect x="%d" y="%d" width="1" height="1"/>`, x, y)
+				}
+			}
+		}
+		io.WriteString(w, "</svg>")
+		return
+	}
+
+	png, err := code.PNG(512)
+	if err != nil {
+		panic(err)
+	}
+
+	w.Header().Set("content-type", "image/png")
+	w.Header().Set("content-disposition", "inline; filename=\""+bike.Registration+".png\"")
+	w.Write(png)
 }
 
 func adminGetBikes(w http.ResponseWriter, r *http.Request) {
 	var bikes []db.Bike
 
-	q := db.M{"archived": false}
-	if available := r.URL.Query().Get("available"); len(available) > 0 {
-		q["available"] = true
+	q := db.M{"status": db.M{"$nin": db.RetiredBikeStatuses}}
+	if status := r.URL.Query().Get("status"); len(status) > 0 {
+		q["status"] = db.M{"$in": strings.Split(status, ",")}
+	} else if available := r.URL.Query().Get("available"); len(available) > 0 {
+		q["status"] = db.BikeStatusInService
 	}
 
 	if err := db.Cols.Bikes.Find(q).Sort("bike_number").All(&bikes); err != nil {
@@ -115,6 +167,14 @@ func adminSaveBike(w http.ResponseWriter, r *http.Request) {
 		bike.Created = time.Now()
 		bike.CreatedBy = context.Get(r, "userID").(bson.ObjectId)
 
+		// new bikes start in service
+		bike.Status = db.BikeStatusInService
+		bike.StatusReason = "Added to fleet"
+		bike.StatusChanged = bike.Created
+		bike.StatusBy = bike.CreatedBy
+		bike.Available = true
+		bike.Archived = false
+
 		if err := db.Cols.Bikes.Insert(&bike); err != nil {
 			panic(err)
 		}
@@ -123,7 +183,29 @@ func adminSaveBike(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	bikeID := context.Get(r, "bike").(db.Bike).ID
+	// status and mileage are changed through their own APIs
+	existing := context.Get(r, "bike").(db.Bike)
+	if bike.GarageID != existing.GarageID {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Bikes must be moved between garages with a transfer",
+		})
+		return
+	}
+
+	bike.Status = existing.Status
+	bike.StatusReason = existing.StatusReason
+	bike.StatusChanged = existing.StatusChanged
+	bike.StatusBy = existing.StatusBy
+	bike.Available = existing.Available
+	bike.Archived = existing.Archived
+	bike.ArchivedReason = existing.ArchivedReason
+	bike.ArchivedBy = existing.ArchivedBy
+	bike.Odometer = existing.Odometer
+	bike.OdometerUpdated = existing.OdometerUpdated
+	bike.Created = existing.Created
+	bike.CreatedBy = existing.CreatedBy
+
+	bikeID := existing.ID
 	bike.ID = bikeID
 	if err := db.Cols.Bikes.UpdateId(bikeID, db.M{"$set": &bike}); err != nil {
 		panic(err)
@@ -132,15 +214,17 @@ func adminSaveBike(w http.ResponseWriter, r *http.Request) {
 	syrup.WriteJSON(w, http.StatusOK, bike)
 }
 
+// adminDeleteBike archives (POST) a bike as sold or written off, or restores (DELETE) it to service
 func adminDeleteBike(w http.ResponseWriter, r *http.Request) {
-	var reason struct {
+	var body struct {
 		Reason string `json:"reason"`
+		Status string `json:"status"`
 	}
-	if err := syrup.Bind(w, r, &reason); err != nil {
+	if err := syrup.Bind(w, r, &body); err != nil {
 		return
 	}
 
-	if len(reason.Reason) == 0 {
+	if len(body.Reason) == 0 {
 		syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
 			"error": "Please provide a reason for archiving this bike",
 		})
@@ -148,27 +232,114 @@ func adminDeleteBike(w http.ResponseWriter, r *http.Request) {
 	}
 
 	bike := context.Get(r, "bike").(db.Bike)
-	if bike.Archived {
+
+	status := db.BikeStatusInService
+	if r.Method == "POST" {
+		if bike.Retired() {
+			syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+				"error": "Bike is already archived",
+			})
+			return
+		}
+
+		status = db.BikeStatusWrittenOff
+		if body.Status == db.BikeStatusSold {
+			status = db.BikeStatusSold
+		}
+	} else if !bike.Retired() {
 		syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
-			"error": "Bike is already archived",
+			"error": "Bike is not archived",
 		})
 		return
 	}
 
-	if err := db.Cols.Bikes.UpdateId(bike.ID, db.M{
-		"$set": db.M{
-			"archived":        true,
-			"archived_reason": reason.Reason,
-			"archived_by":     context.Get(r, "userID").(bson.ObjectId),
-			"available":       false,
-		},
-	}); err != nil {
+	if _, err := db.SetBikeStatus(bike, status, body.Reason, context.Get(r, "userID").(bson.ObjectId)); err != nil {
 		panic(err)
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+func adminSetBikeStatus(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}
+	if err := syrup.Bind(w, r, &body); err != nil {
+		return
+	}
+
+	change, err := db.SetBikeStatus(context.Get(r, "bike").(db.Bike), body.Status, body.Reason, context.Get(r, "userID").(bson.ObjectId))
+	if err != nil {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, change)
+}
+
+// adminGetBikeTimeline merges status changes, maintenance and shifts into a single history, newest first
+func adminGetBikeTimeline(w http.ResponseWriter, r *http.Request) {
+	bike := context.Get(r, "bike").(db.Bike)
+
+	type timelineItem struct {
+		Time time.Time   `json:"time"`
+		Type string      `json:"type"`
+		Item interface{} `json:"item"`
+	}
+	timeline := []timelineItem{}
+
+	var changes []db.BikeStatusChange
+	if err := db.Cols.BikeStatus.Find(db.M{"bike_id": bike.ID}).All(&changes); err != nil {
+		panic(err)
+	}
+	for _, change := range changes {
+		itemType := "status"
+		if db.IsRetiredBikeStatus(change.To) {
+			itemType = "archive"
+		} else if db.IsRetiredBikeStatus(change.From) {
+			itemType = "restore"
+		}
+
+		timeline = append(timeline, timelineItem{change.ChangedAt, itemType, change})
+	}
+
+	var maintenance []db.BikeMaintenance
+	if err := db.Cols.BikeMaintenance.Find(db.M{"bike_id": bike.ID}).All(&maintenance); err != nil {
+		panic(err)
+	}
+	for _, log := range maintenance {
+		timeline = append(timeline, timelineItem{log.CheckedAt, "maintenance", log})
+	}
+
+	var incidents []db.Event
+	if err := db.Cols.Events.Find(db.M{"bike_id": bike.ID, "type": "incident"}).All(&incidents); err != nil {
+		panic(err)
+	}
+	for _, incident := range incidents {
+		timeline = append(timeline, timelineItem{incident.OccurredAt, "incident", incident})
+	}
+
+	var shifts []db.Shift
+	if err := db.Cols.Shifts.Find(db.M{
+		"scooter_id": bike.ID,
+		"status":     db.M{"$in": []string{"running", "complete"}},
+	}).All(&shifts); err != nil {
+		panic(err)
+	}
+	for _, shift := range shifts {
+		timeline = append(timeline, timelineItem{shift.CheckIn, "shift", shift})
+	}
+
+	sort.Slice(timeline, func(i, j int) bool {
+		return timeline[i].Time.After(timeline[j].Time)
+	})
+
+	syrup.WriteJSON(w, http.StatusOK, timeline)
+}
+
 func adminGetBikeOperatorNotes(w http.ResponseWriter, r *http.Request) {
 	bike := context.Get(r, "bike").(db.Bike)
 
@@ -228,6 +399,24 @@ func adminSetShiftOperatorNotes(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// odometer readings are only set at check-in/out
+	var existing db.BikeHistory
+	if err := db.Cols.BikeHistory.Find(db.M{"shift_id": shift.ID}).One(&existing); err != nil && err != mgo.ErrNotFound {
+		panic(err)
+	}
+
+	body.OdometerStart = existing.OdometerStart
+	body.OdometerEnd = existing.OdometerEnd
+	body.Distance = existing.Distance
+	body.GPSDistance = existing.GPSDistance
+	body.DistanceMismatch = existing.DistanceMismatch
+	body.FuelLevelStart = existing.FuelLevelStart
+	if body.FuelLevel == nil {
+		body.FuelLevel = existing.FuelLevel
+	}
+	body.FuelUsed = existing.FuelUsed
+	body.FuelAnomaly = existing.FuelAnomaly
+
 	body.ShiftID = shift.ID
 	body.BikeID = shift.ScooterID
 	// body.ID = bson.NewObjectId()
@@ -241,9 +430,42 @@ func adminSetShiftOperatorNotes(w http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 
+	// fuel level may have been corrected
+	if shift.Status == "complete" {
+		if err := db.ComputeShiftFuel(shift); err != nil {
+			panic(err)
+		}
+	}
+
 	syrup.WriteJSON(w, http.StatusCreated, body)
 }
 
+// adminGetBikeMileage returns the bike's odometer readings and per-shift distances
+func adminGetBikeMileage(w http.ResponseWriter, r *http.Request) {
+	bike := context.Get(r, "bike").(db.Bike)
+
+	var readings []db.OdometerReading
+	if err := db.Cols.Mileage.Find(db.M{
+		"bike_id": bike.ID,
+	}).Sort("-recorded_at").All(&readings); err != nil {
+		panic(err)
+	}
+
+	var shifts []db.BikeHistory
+	if err := db.Cols.BikeHistory.Find(db.M{
+		"bike_id":      bike.ID,
+		"odometer_end": db.M{"$gt": 0},
+	}).Sort("-odometer_end").All(&shifts); err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"odometer": bike.Odometer,
+		"readings": readings,
+		"shifts":   shifts,
+	})
+}
+
 func adminGetBikeMaintenance(w http.ResponseWriter, r *http.Request) {
 	bike := context.Get(r, "bike").(db.Bike)
 
@@ -263,109 +485,267 @@ func adminSetBikeMaintenance(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.BikeID = context.Get(r, "bike").(db.Bike).ID
+	bike := context.Get(r, "bike").(db.Bike)
+	log.BikeID = bike.ID
 	log.CheckedBy = context.Get(r, "userID").(bson.ObjectId)
 
+	if log.PlanID.Valid() && log.Odometer == 0 {
+		log.Odometer = bike.Odometer
+	}
+
+	// parts are taken from stock again on update
+	var existing db.BikeMaintenance
+	if r.Method == "PUT" {
+		existing = findMaintenanceLog(r)
+		if err := db.ReturnParts(existing.Parts); err != nil {
+			panic(err)
+		}
+	}
+
+	parts, low, err := db.TakeParts(bike.GarageID, log.Parts)
+	if err != nil {
+		if _, _, err := db.TakeParts(bike.GarageID, existing.Parts); err != nil {
+			panic(err)
+		}
+
+		writePartsError(w, err)
+		return
+	}
+
+	log.Parts = parts
+	log.PartsCost = db.PartsCost(parts)
+
 	status := http.StatusCreated
 	if r.Method == "PUT" {
+		// attachments are changed through their own APIs
+		log.Attachments = existing.Attachments
+		log.HasAttachment = existing.HasAttachment
+
 		status = http.StatusOK
-		log.ID = bson.ObjectIdHex(mux.Vars(r)["maintenance_log_id"])
+		log.ID = existing.ID
 		if err := db.Cols.BikeMaintenance.UpdateId(log.ID, &log); err != nil {
 			panic(err)
 		}
-	} else if err := db.Cols.BikeMaintenance.Insert(&log); err != nil {
-		panic(err)
+	} else {
+		log.Attachments = []db.MaintenanceAttachment{}
+		log.HasAttachment = false
+
+		if err := db.Cols.BikeMaintenance.Insert(&log); err != nil {
+			panic(err)
+		}
 	}
 
+	notifyLowStock(bike.GarageID, low)
+
 	syrup.WriteJSON(w, status, log)
 }
 
 func adminDeleteBikeMaintenance(w http.ResponseWriter, r *http.Request) {
-	logID := bson.ObjectIdHex(mux.Vars(r)["maintenance_log_id"])
+	log := findMaintenanceLog(r)
+
+	removeMaintenanceAttachments(log.Attachments)
+
+	if err := db.ReturnParts(log.Parts); err != nil {
+		panic(err)
+	}
 
-	if err := db.Cols.BikeMaintenance.RemoveId(logID); err != nil {
+	if err := db.Cols.BikeMaintenance.RemoveId(log.ID); err != nil {
 		panic(err)
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func adminSetMaintenanceAttachment(w http.ResponseWriter, r *http.Request) {
-	logID := bson.ObjectIdHex(mux.Vars(r)["maintenance_log_id"])
+// adminGetMaintenanceAttachments lists the files attached to a maintenance log
+func adminGetMaintenanceAttachments(w http.ResponseWriter, r *http.Request) {
+	log := findMaintenanceLog(r)
 
-	r.ParseMultipartForm(51200)
-	f := r.MultipartForm.File["file"][0]
-	file, _ := f.Open()
+	syrup.WriteJSON(w, http.StatusOK, log.Attachments)
+}
 
-	gridFile, err := db.DB.GridFS("maintenance").Create(logID.Hex())
-	if err != nil {
-		panic(err)
+// adminSetMaintenanceAttachment attaches every uploaded "file" to the log, thumbnailing images
+func adminSetMaintenanceAttachment(w http.ResponseWriter, r *http.Request) {
+	log := findMaintenanceLog(r)
+
+	if err := r.ParseMultipartForm(51200); err != nil || len(r.MultipartForm.File["file"]) == 0 {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "No file uploaded",
+		})
+		return
 	}
+	files := r.MultipartForm.File["file"]
+
+	errs := []string{}
+	contentTypes := make([]string, len(files))
+	for i, f := range files {
+		contentType, err := sniffUpload(f)
+		if err != nil {
+			panic(err)
+		}
 
-	contentDisposition := f.Header.Get("content-disposition")
-	fileName := "unknown"
-	if len(contentDisposition) > 0 {
-		split := strings.Split(contentDisposition, "filename=\"")
-		if len(split) > 1 {
-			fileName = strings.Replace(split[1], "\"", "", -1)
+		switch {
+		case !maintenanceAttachmentTypes[contentType]:
+			errs = append(errs, f.Filename+": only images and PDFs can be attached")
+		case f.Size > maintenanceAttachmentMaxSize:
+			errs = append(errs, f.Filename+": files must be under 10MB")
 		}
+
+		contentTypes[i] = contentType
+	}
+
+	if len(errs) > 0 {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"errors": errs,
+		})
+		return
 	}
-	gridFile.SetContentType(f.Header.Get("content-type"))
-	gridFile.SetMeta(map[string]string{
-		"name": fileName,
-	})
 
-	reader := bufio.NewReader(file)
-	defer file.Close()
-	defer gridFile.Close()
+	gridFS := db.DB.GridFS("maintenance")
+	userID := context.Get(r, "userID").(bson.ObjectId)
 
-	buf := make([]byte, 1024)
-	for {
-		n, err := reader.Read(buf)
-		if err != nil && err != io.EOF {
+	attachments := []db.MaintenanceAttachment{}
+	for i, f := range files {
+		fileID, size, err := writeGridFileAs(gridFS, log.ID.Hex(), f, contentTypes[i])
+		if err != nil {
 			panic(err)
 		}
 
-		if n == 0 || err == io.EOF {
-			// EOF
-			break
+		attachment := db.MaintenanceAttachment{
+			ID:          fileID,
+			Filename:    f.Filename,
+			ContentType: contentTypes[i],
+			Size:        size,
+			UploadedBy:  userID,
+			UploadedAt:  time.Now(),
 		}
 
-		if _, err := gridFile.Write(buf[:n]); err != nil {
-			panic(err)
+		// attachments are still useful if the image can't be decoded
+		if strings.HasPrefix(contentTypes[i], "image/") {
+			if thumbnailID, err := writeGridThumbnail(gridFS, log.ID.Hex()+"-thumbnail", f, maintenanceThumbnailSize); err == nil {
+				attachment.ThumbnailID = thumbnailID
+			}
 		}
+
+		attachments = append(attachments, attachment)
+	}
+
+	if err := db.Cols.BikeMaintenance.UpdateId(log.ID, db.M{
+		"$push": db.M{"attachments": db.M{"$each": attachments}},
+		"$set":  db.M{"has_attachment": true},
+	}); err != nil {
+		panic(err)
 	}
 
-	w.WriteHeader(204)
+	syrup.WriteJSON(w, http.StatusCreated, attachments)
 }
 
+// adminGetMaintenanceAttachment downloads an attachment, or the latest one when no attachment ID is given
 func adminGetMaintenanceAttachment(w http.ResponseWriter, r *http.Request) {
-	logID := bson.ObjectIdHex(mux.Vars(r)["maintenance_log_id"])
-
-	file, err := db.DB.GridFS("maintenance").Open(logID.Hex())
-	if err != nil && err != mgo.ErrNotFound {
-		panic(err)
-	} else if err == mgo.ErrNotFound {
+	attachment := findMaintenanceAttachment(findMaintenanceLog(r), mux.Vars(r)["attachment_id"])
+	if attachment == nil {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
-	w.Header().Set("content-type", file.ContentType())
+	serveGridFile(w, db.DB.GridFS("maintenance"), attachment.ID)
+}
 
-	var meta map[string]string
-	if err := file.GetMeta(&meta); err == nil {
-		w.Header().Set("content-disposition", "attachment; filename=\""+meta["name"]+"\"")
+func adminGetMaintenanceThumbnail(w http.ResponseWriter, r *http.Request) {
+	attachment := findMaintenanceAttachment(findMaintenanceLog(r), mux.Vars(r)["attachment_id"])
+	if attachment == nil || !attachment.ThumbnailID.Valid() {
+		w.WriteHeader(http.StatusNotFound)
+		return
 	}
 
-	io.Copy(w, file)
+	serveGridFile(w, db.DB.GridFS("maintenance"), attachment.ThumbnailID)
 }
 
+// adminDeleteMaintenanceAttachment removes one attachment, or all of them when no attachment ID is given
 func adminDeleteMaintenanceAttachment(w http.ResponseWriter, r *http.Request) {
-	logID := bson.ObjectIdHex(mux.Vars(r)["maintenance_log_id"])
+	log := findMaintenanceLog(r)
+
+	remaining := []db.MaintenanceAttachment{}
+	removed := []db.MaintenanceAttachment{}
+	for _, attachment := range log.Attachments {
+		if attachmentID := mux.Vars(r)["attachment_id"]; len(attachmentID) == 0 || attachment.ID.Hex() == attachmentID {
+			removed = append(removed, attachment)
+		} else {
+			remaining = append(remaining, attachment)
+		}
+	}
+
+	if len(removed) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 
-	if err := db.DB.GridFS("maintenance").Remove(logID.Hex()); err != nil {
+	removeMaintenanceAttachments(removed)
+
+	if err := db.Cols.BikeMaintenance.UpdateId(log.ID, db.M{"$set": db.M{
+		"attachments":    remaining,
+		"has_attachment": len(remaining) > 0,
+	}}); err != nil {
 		panic(err)
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+const (
+	maintenanceAttachmentMaxSize = 10 << 20
+	maintenanceThumbnailSize     = 240
+)
+
+var maintenanceAttachmentTypes = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/gif":       true,
+	"application/pdf": true,
+}
+
+// findMaintenanceLog loads the route's maintenance log for the bike in context
+func findMaintenanceLog(r *http.Request) db.BikeMaintenance {
+	var log db.BikeMaintenance
+	if err := db.Cols.BikeMaintenance.Find(db.M{
+		"_id":     bson.ObjectIdHex(mux.Vars(r)["maintenance_log_id"]),
+		"bike_id": context.Get(r, "bike").(db.Bike).ID,
+	}).One(&log); err != nil {
+		panic(err)
+	}
+
+	return log
+}
+
+// findMaintenanceAttachment returns the attachment by ID (newest if empty), nil if missing
+func findMaintenanceAttachment(log db.BikeMaintenance, attachmentID string) *db.MaintenanceAttachment {
+	if len(log.Attachments) == 0 {
+		return nil
+	}
+
+	if len(attachmentID) == 0 {
+		return &log.Attachments[len(log.Attachments)-1]
+	}
+
+	for i := range log.Attachments {
+		if log.Attachments[i].ID.Hex() == attachmentID {
+			return &log.Attachments[i]
+		}
+	}
+
+	return nil
+}
+
+func removeMaintenanceAttachments(attachments []db.MaintenanceAttachment) {
+	gridFS := db.DB.GridFS("maintenance")
+	for _, attachment := range attachments {
+		if err := gridFS.RemoveId(attachment.ID); err != nil && err != mgo.ErrNotFound {
+			panic(err)
+		}
+
+		if attachment.ThumbnailID.Valid() {
+			if err := gridFS.RemoveId(attachment.ThumbnailID); err != nil && err != mgo.ErrNotFound {
+				panic(err)
+			}
+		}
+	}
+}
@@ -1,9 +1,12 @@
 package api
 
 import (
+	"fmt"
+	"math"
 	"net/http"
 	"time"
 
+	mgo "gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 
 	"github.com/gorilla/context"
@@ -86,7 +89,10 @@ func adminGetShiftInfo(w http.ResponseWriter, r *http.Request) {
 
 func adminShiftCheckIn(w http.ResponseWriter, r *http.Request) {
 	var body struct {
-		Date time.Time `json:"date"`
+		Date      time.Time `json:"date"`
+		QRCode    string    `json:"qr_code"`
+		Odometer  int       `json:"odometer"`
+		FuelLevel *int      `json:"fuel_level"`
 	}
 	if err := syrup.Bind(w, r, &body); err != nil {
 		return
@@ -102,16 +108,61 @@ func adminShiftCheckIn(w http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 
+	scannedID, ok := verifyHandoverScan(w, r, shift, body.QRCode, "check-in")
+	if !ok {
+		return
+	}
+
+	if inspectionMissing(shift, "check-in") {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Please complete the check-in inspection first",
+		})
+		return
+	}
+
+	if body.FuelLevel != nil && (*body.FuelLevel < 0 || *body.FuelLevel > 100) {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Fuel level must be a percentage",
+		})
+		return
+	}
+
+	if body.Odometer > 0 {
+		if err := recordShiftOdometer(r, shift, "check-in", body.Odometer, body.Date); err == db.ErrOdometerDecreased {
+			syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+				"error": err.Error(),
+			})
+			return
+		} else if err != nil {
+			panic(err)
+		}
+	}
+
+	// an empty tank is a reading too
+	if body.FuelLevel != nil {
+		if _, err := db.Cols.BikeHistory.Upsert(db.M{"shift_id": shift.ID}, db.M{
+			"$set":         db.M{"fuel_level_start": *body.FuelLevel},
+			"$setOnInsert": db.M{"bike_id": shift.ScooterID},
+		}); err != nil {
+			panic(err)
+		}
+	}
+
 	if err := db.Cols.Shifts.UpdateId(shiftID, db.M{
 		"$set": db.M{
 			"check_in":          body.Date,
 			"check_in_operator": context.Get(r, "userID").(bson.ObjectId),
+			"check_in_bike_id":  scannedID,
 			"status":            "running",
 		},
 	}); err != nil {
 		panic(err)
 	}
 
+	if err := db.RecordShiftEvent(shift, "running", context.Get(r, "userID").(bson.ObjectId)); err != nil {
+		panic(err)
+	}
+
 	syrup.WriteJSON(w, http.StatusOK, map[string]interface{}{
 		"check_in": body.Date,
 		"status":   "running",
@@ -120,7 +171,10 @@ func adminShiftCheckIn(w http.ResponseWriter, r *http.Request) {
 
 func adminShiftCheckOut(w http.ResponseWriter, r *http.Request) {
 	var body struct {
-		Date time.Time `json:"date"`
+		Date      time.Time `json:"date"`
+		QRCode    string    `json:"qr_code"`
+		Odometer  int       `json:"odometer"`
+		FuelLevel *int      `json:"fuel_level"`
 	}
 	if err := syrup.Bind(w, r, &body); err != nil {
 		return
@@ -144,6 +198,45 @@ func adminShiftCheckOut(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	scannedID, ok := verifyHandoverScan(w, r, shift, body.QRCode, "check-out")
+	if !ok {
+		return
+	}
+
+	if inspectionMissing(shift, "check-out") {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Please complete the check-out inspection first",
+		})
+		return
+	}
+
+	if body.FuelLevel != nil && (*body.FuelLevel < 0 || *body.FuelLevel > 100) {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Fuel level must be a percentage",
+		})
+		return
+	}
+
+	if body.Odometer > 0 {
+		if err := recordShiftOdometer(r, shift, "check-out", body.Odometer, body.Date); err == db.ErrOdometerDecreased {
+			syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+				"error": err.Error(),
+			})
+			return
+		} else if err != nil {
+			panic(err)
+		}
+	}
+
+	if body.FuelLevel != nil {
+		if _, err := db.Cols.BikeHistory.Upsert(db.M{"shift_id": shift.ID}, db.M{
+			"$set":         db.M{"fuel_level": *body.FuelLevel},
+			"$setOnInsert": db.M{"bike_id": shift.ScooterID},
+		}); err != nil {
+			panic(err)
+		}
+	}
+
 	// round up shift end
 	minute := body.Date.Minute()
 	if rem := minute % 15; rem > 0 {
@@ -154,20 +247,86 @@ func adminShiftCheckOut(w http.ResponseWriter, r *http.Request) {
 		"$set": db.M{
 			"check_out":          body.Date,
 			"check_out_operator": context.Get(r, "userID").(bson.ObjectId),
+			"check_out_bike_id":  scannedID,
 			"status":             "complete",
 		},
 	}); err != nil {
 		panic(err)
 	}
 
+	if err := db.ComputeShiftFuel(shift); err != nil {
+		panic(err)
+	}
+
+	if err := db.RecordShiftEvent(shift, "complete", context.Get(r, "userID").(bson.ObjectId)); err != nil {
+		panic(err)
+	}
+
 	syrup.WriteJSON(w, http.StatusOK, map[string]interface{}{
 		"check_out": body.Date,
 		"status":    "complete",
 	})
 }
 
+// recordShiftOdometer stores a handover odometer reading in the shift's bike history.
+// At check-out the shift distance is computed and cross-checked against the GPS tracker.
+func recordShiftOdometer(r *http.Request, shift db.Shift, stage string, reading int, at time.Time) error {
+	if err := db.RecordOdometer(db.OdometerReading{
+		BikeID:     shift.ScooterID,
+		ShiftID:    shift.ID,
+		Stage:      stage,
+		Reading:    reading,
+		RecordedBy: context.Get(r, "userID").(bson.ObjectId),
+		RecordedAt: at,
+	}); err != nil {
+		return err
+	}
+
+	set := db.M{"odometer_start": reading}
+	if stage == "check-out" {
+		set = db.M{"odometer_end": reading}
+
+		var history db.BikeHistory
+		if err := db.Cols.BikeHistory.Find(db.M{"shift_id": shift.ID}).One(&history); err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+
+		if history.OdometerStart > 0 {
+			distance := reading - history.OdometerStart
+			set["distance"] = distance
+
+			var bike db.Bike
+			if err := db.Cols.Bikes.FindId(shift.ScooterID).One(&bike); err != nil {
+				return err
+			}
+
+			if bike.TrackerID > 0 {
+				// tracker being unavailable shouldn't block check-out
+				if gpsDistance, err := trackerDistance(bike.TrackerID, shift.CheckIn, at); err != nil {
+					fmt.Println("GPS distance unavailable:", err)
+				} else {
+					set["gps_distance"] = gpsDistance
+					set["distance_mismatch"] = math.Abs(float64(distance)-gpsDistance) > math.Max(2, gpsDistance*0.2)
+				}
+			}
+		}
+	}
+
+	_, err := db.Cols.BikeHistory.Upsert(db.M{"shift_id": shift.ID}, db.M{
+		"$set":         set,
+		"$setOnInsert": db.M{"bike_id": shift.ScooterID},
+	})
+
+	return err
+}
+
 func adminShiftReset(w http.ResponseWriter, r *http.Request) {
 	shiftID := bson.ObjectIdHex(mux.Vars(r)["shift_id"])
+	var shift db.Shift
+	if err := db.Cols.Shifts.FindId(shiftID).One(&shift); err != nil {
+		panic(err)
+	}
+
 	if err := db.Cols.Shifts.UpdateId(shiftID, db.M{
 		"$set": db.M{
 			"status": "created",
@@ -182,6 +341,10 @@ func adminShiftReset(w http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 
+	if err := db.RecordShiftEvent(shift, "created", context.Get(r, "userID").(bson.ObjectId)); err != nil {
+		panic(err)
+	}
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -213,9 +376,12 @@ func adminApproveShiftStatus(w http.ResponseWriter, r *http.Request) {
 		"deleted_by":   context.Get(r, "userID"),
 	}
 
+	status := "cancelled"
 	if r.Method == "POST" {
+		status = "confirmed"
 		day, _ := time.Parse("02-01-2006", shift.Date.Format("02-01-2006"))
-		db.Cols.Shifts.UpdateAll(db.M{
+		var competing []db.Shift
+		if err := db.Cols.Shifts.Find(db.M{
 			"date": db.M{
 				"$gte": day,
 				"$lt":  day.Add(24 * time.Hour),
@@ -225,7 +391,24 @@ func adminApproveShiftStatus(w http.ResponseWriter, r *http.Request) {
 			},
 			"scooter_id": shift.ScooterID,
 			"status":     "created",
-		}, db.M{"$set": deleteSet})
+		}).All(&competing); err != nil {
+			panic(err)
+		}
+
+		for _, other := range competing {
+			if err := db.Cols.Shifts.Update(db.M{
+				"_id":    other.ID,
+				"status": "created",
+			}, db.M{"$set": deleteSet}); err == mgo.ErrNotFound {
+				continue
+			} else if err != nil {
+				panic(err)
+			}
+
+			if err := db.RecordShiftEvent(other, "cancelled", context.Get(r, "userID").(bson.ObjectId)); err != nil {
+				panic(err)
+			}
+		}
 
 		db.Cols.Shifts.UpdateId(shiftID, db.M{"$set": db.M{
 			"status": "confirmed",
@@ -234,6 +417,10 @@ func adminApproveShiftStatus(w http.ResponseWriter, r *http.Request) {
 		db.Cols.Shifts.UpdateId(shiftID, db.M{"$set": deleteSet})
 	}
 
+	if err := db.RecordShiftEvent(shift, status, context.Get(r, "userID").(bson.ObjectId)); err != nil {
+		panic(err)
+	}
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -244,12 +431,146 @@ func adminReassignBike(w http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 
-	bikeID := bson.ObjectIdHex(mux.Vars(r)["bike_id"])
-	db.Cols.Shifts.UpdateId(shift.ID, db.M{"$set": db.M{
+	if err := reassignShiftBike(shift, bson.ObjectIdHex(mux.Vars(r)["bike_id"]), true, context.Get(r, "userID").(bson.ObjectId)); err != nil {
+		panic(err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// reassignShiftBike moves a shift onto another bike. Shifts not yet checked in are (re)confirmed if confirm,
+// otherwise they keep their status. The move is recorded as a shift event.
+func reassignShiftBike(shift db.Shift, bikeID bson.ObjectId, confirm bool, by bson.ObjectId) error {
+	set := db.M{
 		"deleted":    false,
-		"status":     "confirmed",
 		"scooter_id": bikeID,
-	}})
+	}
 
-	w.WriteHeader(http.StatusNoContent)
+	if confirm && shift.CheckIn.IsZero() {
+		set["status"] = "confirmed"
+		shift.Status = "confirmed"
+	}
+
+	if err := db.Cols.Shifts.UpdateId(shift.ID, db.M{"$set": set}); err != nil {
+		return err
+	}
+
+	shift.ScooterID = bikeID
+	return db.RecordShiftEvent(shift, shift.Status, by)
+}
+
+// verifyHandoverScan checks the scanned QR code is for the booked bike.
+// Mismatches are flagged as a pending swap and rejected until a supervisor approves it.
+func verifyHandoverScan(w http.ResponseWriter, r *http.Request, shift db.Shift, qrCode string, stage string) (bson.ObjectId, bool) {
+	if len(qrCode) == 0 {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Please scan the bike QR code",
+		})
+		return "", false
+	}
+
+	scannedID, err := db.ParseBikeQRPayload(qrCode)
+	if err != nil {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+		return "", false
+	}
+
+	if scannedID == shift.ScooterID {
+		return scannedID, true
+	}
+
+	swap := db.BikeSwap{
+		ID:            bson.NewObjectId(),
+		ShiftID:       shift.ID,
+		BookedBikeID:  shift.ScooterID,
+		ScannedBikeID: scannedID,
+		Stage:         stage,
+		Status:        "pending",
+		ReportedBy:    context.Get(r, "userID").(bson.ObjectId),
+		ReportedAt:    time.Now(),
+	}
+
+	// re-scanning the same bike should not create duplicate swaps
+	if err := db.Cols.BikeSwaps.Find(db.M{
+		"shift_id":        shift.ID,
+		"scanned_bike_id": scannedID,
+		"stage":           stage,
+		"status":          "pending",
+	}).One(&swap); err != nil && err != mgo.ErrNotFound {
+		panic(err)
+	} else if err == mgo.ErrNotFound {
+		if err := db.Cols.BikeSwaps.Insert(&swap); err != nil {
+			panic(err)
+		}
+	}
+
+	if err := db.Cols.Shifts.UpdateId(shift.ID, db.M{"$set": db.M{"handover_mismatch": true}}); err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusConflict, map[string]interface{}{
+		"error": "Scanned bike does not match the booked bike, a supervisor must approve the swap",
+		"swap":  swap,
+	})
+
+	return "", false
+}
+
+func adminGetBikeSwaps(w http.ResponseWriter, r *http.Request) {
+	q := db.M{"status": "pending"}
+	if shiftID := mux.Vars(r)["shift_id"]; len(shiftID) > 0 {
+		q = db.M{"shift_id": bson.ObjectIdHex(shiftID)}
+	}
+
+	var swaps []db.BikeSwap
+	if err := db.Cols.BikeSwaps.Find(q).Sort("-reported_at").All(&swaps); err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, swaps)
+}
+
+// adminResolveBikeSwap approves (POST) or rejects (DELETE) a pending swap
+func adminResolveBikeSwap(w http.ResponseWriter, r *http.Request) {
+	var swap db.BikeSwap
+	if err := db.Cols.BikeSwaps.Find(db.M{
+		"_id":      bson.ObjectIdHex(mux.Vars(r)["swap_id"]),
+		"shift_id": bson.ObjectIdHex(mux.Vars(r)["shift_id"]),
+	}).One(&swap); err != nil && err != mgo.ErrNotFound {
+		panic(err)
+	} else if err == mgo.ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if swap.Status != "pending" {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Swap has already been " + swap.Status,
+		})
+		return
+	}
+
+	swap.Status = "rejected"
+	if r.Method == "POST" {
+		var shift db.Shift
+		if err := db.Cols.Shifts.FindId(swap.ShiftID).One(&shift); err != nil {
+			panic(err)
+		}
+
+		if err := reassignShiftBike(shift, swap.ScannedBikeID, true, context.Get(r, "userID").(bson.ObjectId)); err != nil {
+			panic(err)
+		}
+
+		swap.Status = "approved"
+	}
+
+	swap.ResolvedBy = context.Get(r, "userID").(bson.ObjectId)
+	swap.ResolvedAt = time.Now()
+	if err := db.Cols.BikeSwaps.UpdateId(swap.ID, &swap); err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, swap)
 }
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/maple-ai/fleet-api/db"
+	"github.com/maple-ai/syrup"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func adminGetBikeCompliance(w http.ResponseWriter, r *http.Request) {
+	records, err := db.FindBikeCompliance(context.Get(r, "bike").(db.Bike).ID)
+	if err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, records)
+}
+
+func adminSaveBikeCompliance(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Reference string    `json:"reference"`
+		Expiry    time.Time `json:"expiry"`
+	}
+	if err := syrup.Bind(w, r, &body); err != nil {
+		return
+	}
+
+	complianceType := mux.Vars(r)["compliance_type"]
+	if _, ok := db.ComplianceTypes[complianceType]; !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if body.Expiry.IsZero() {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Expiry date is required",
+		})
+		return
+	}
+
+	bike := context.Get(r, "bike").(db.Bike)
+	if _, err := db.Cols.Compliance.Upsert(db.M{
+		"bike_id": bike.ID,
+		"type":    complianceType,
+	}, db.M{"$set": db.M{
+		"reference":  body.Reference,
+		"expiry":     body.Expiry,
+		"updated":    time.Now(),
+		"updated_by": context.Get(r, "userID").(bson.ObjectId),
+	}}); err != nil {
+		panic(err)
+	}
+
+	var record db.BikeCompliance
+	if err := db.Cols.Compliance.Find(db.M{
+		"bike_id": bike.ID,
+		"type":    complianceType,
+	}).One(&record); err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, record)
+}
+
+func adminSetComplianceEvidence(w http.ResponseWriter, r *http.Request) {
+	record := findBikeCompliance(w, r)
+	if record == nil {
+		return
+	}
+
+	f := uploadedFile(w, r, 51200)
+	if f == nil {
+		return
+	}
+
+	gridFS := db.DB.GridFS("compliance")
+	fileID, _, err := writeGridFile(gridFS, record.ID.Hex(), f)
+	if err != nil {
+		panic(err)
+	}
+
+	if err := db.Cols.Compliance.UpdateId(record.ID, db.M{"$set": db.M{"evidence_id": fileID}}); err != nil {
+		panic(err)
+	}
+
+	// replaced evidence
+	if record.EvidenceID.Valid() {
+		if err := gridFS.RemoveId(record.EvidenceID); err != nil && err != mgo.ErrNotFound {
+			panic(err)
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func adminGetComplianceEvidence(w http.ResponseWriter, r *http.Request) {
+	record := findBikeCompliance(w, r)
+	if record == nil {
+		return
+	}
+
+	if !record.EvidenceID.Valid() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	serveGridFile(w, db.DB.GridFS("compliance"), record.EvidenceID)
+}
+
+// findBikeCompliance loads the compliance record in the URL, writing 404 if it doesn't exist
+func findBikeCompliance(w http.ResponseWriter, r *http.Request) *db.BikeCompliance {
+	var record db.BikeCompliance
+	if err := db.Cols.Compliance.Find(db.M{
+		"bike_id": context.Get(r, "bike").(db.Bike).ID,
+		"type":    mux.Vars(r)["compliance_type"],
+	}).One(&record); err != nil && err != mgo.ErrNotFound {
+		panic(err)
+	} else if err == mgo.ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+
+	return &record
+}
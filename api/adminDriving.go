@@ -0,0 +1,131 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/maple-ai/fleet-api/db"
+	"github.com/maple-ai/syrup"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type drivingWeek struct {
+	Week   time.Time `json:"week"`
+	Shifts int       `json:"shifts"`
+
+	Distance     float64       `json:"distance"`
+	MovingTime   time.Duration `json:"moving_time"`
+	MaxSpeed     float64       `json:"max_speed"`
+	AverageSpeed float64       `json:"average_speed"`
+
+	HarshAccelerations int           `json:"harsh_accelerations"`
+	HarshBraking       int           `json:"harsh_braking"`
+	SpeedingEvents     int           `json:"speeding_events"`
+	SpeedingTime       time.Duration `json:"speeding_time"`
+
+	// Average of the week's shift scores
+	Score float64 `json:"score"`
+}
+
+// adminGetUserDriving shows a driver's driving scores by week (Monday) for the last ?weeks= (default 12)
+func adminGetUserDriving(w http.ResponseWriter, r *http.Request) {
+	user := context.Get(r, "admin_user").(db.User)
+
+	weeks, err := strconv.Atoi(r.URL.Query().Get("weeks"))
+	if err != nil || weeks < 1 {
+		weeks = 12
+	} else if weeks > 104 {
+		weeks = 104
+	}
+
+	today := time.Now()
+	today = time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, today.Location())
+	// back to Monday
+	start := today.AddDate(0, 0, -(int(today.Weekday())+6)%7-7*(weeks-1))
+
+	var shifts []db.Shift
+	if err := db.Cols.Shifts.Find(db.M{
+		"user_id":         user.ID,
+		"driving.samples": db.M{"$gte": 2},
+		"check_in":        db.M{"$gte": start},
+	}).Sort("check_in").All(&shifts); err != nil {
+		panic(err)
+	}
+
+	trend := make([]drivingWeek, weeks)
+	for i := range trend {
+		trend[i].Week = start.AddDate(0, 0, 7*i)
+	}
+
+	for _, shift := range shifts {
+		i := int(shift.CheckIn.Sub(start).Hours() / (24 * 7))
+		if i < 0 || i >= weeks {
+			continue
+		}
+
+		week := &trend[i]
+		week.Shifts++
+		week.Distance += shift.Driving.Distance
+		week.MovingTime += shift.Driving.MovingTime
+		week.HarshAccelerations += shift.Driving.HarshAccelerations
+		week.HarshBraking += shift.Driving.HarshBraking
+		week.SpeedingEvents += shift.Driving.SpeedingEvents
+		week.SpeedingTime += shift.Driving.SpeedingTime
+		week.Score += shift.Driving.Score
+		if shift.Driving.MaxSpeed > week.MaxSpeed {
+			week.MaxSpeed = shift.Driving.MaxSpeed
+		}
+	}
+
+	for i := range trend {
+		if trend[i].Shifts > 0 {
+			trend[i].Score /= float64(trend[i].Shifts)
+		}
+		if trend[i].MovingTime > 0 {
+			trend[i].AverageSpeed = trend[i].Distance / trend[i].MovingTime.Hours()
+		}
+	}
+
+	var membership db.UserMembership
+	if err := db.Cols.Memberships.Find(db.M{"user_id": user.ID}).One(&membership); err != nil && err != mgo.ErrNotFound {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"driving_score":  membership.DrivingScore,
+		"driving_shifts": membership.DrivingShifts,
+		"rating":         membership.Rating,
+		"manual_rating":  membership.ManualRating,
+		"weeks":          trend,
+	})
+}
+
+// adminComputeShiftDriving recalculates a shift's driving summary, e.g. after positions arrived late
+func adminComputeShiftDriving(w http.ResponseWriter, r *http.Request) {
+	var shift db.Shift
+	if err := db.Cols.Shifts.FindId(bson.ObjectIdHex(mux.Vars(r)["shift_id"])).One(&shift); err != nil {
+		panic(err)
+	}
+
+	if shift.CheckIn.IsZero() {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Shift has not been checked in",
+		})
+		return
+	}
+
+	summary, err := db.ComputeShiftDriving(shift)
+	if err != nil {
+		panic(err)
+	}
+
+	if err := db.UpdateDrivingScore(shift.UserID); err != nil && err != mgo.ErrNotFound {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, summary)
+}
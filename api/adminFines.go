@@ -0,0 +1,422 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/maple-ai/fleet-api/db"
+	"github.com/maple-ai/syrup"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type fineDetails struct {
+	Reference    string    `json:"reference"`
+	Issuer       string    `json:"issuer"`
+	Kind         string    `json:"kind"`
+	Registration string    `json:"registration"`
+	OffenceAt    time.Time `json:"offence_at"`
+	Location     string    `json:"location"`
+	DueDate      time.Time `json:"due_date"`
+	Amount       int64     `json:"amount"`
+}
+
+func (details fineDetails) validate() []string {
+	errs := []string{}
+	if len(details.Reference) == 0 {
+		errs = append(errs, "PCN reference cannot be empty")
+	}
+	if _, ok := db.FineKinds[details.Kind]; !ok {
+		errs = append(errs, "Unknown fine kind")
+	}
+	if len(db.NormaliseRegistration(details.Registration)) == 0 {
+		errs = append(errs, "Registration cannot be empty")
+	}
+	if details.OffenceAt.IsZero() {
+		errs = append(errs, "Offence time is required")
+	}
+	if details.Amount <= 0 {
+		errs = append(errs, "Amount must be more than zero")
+	}
+
+	return errs
+}
+
+func (details fineDetails) apply(fine *db.Fine) {
+	fine.Reference = details.Reference
+	fine.Issuer = details.Issuer
+	fine.Kind = details.Kind
+	fine.Registration = db.NormaliseRegistration(details.Registration)
+	fine.OffenceAt = details.OffenceAt
+	fine.Location = details.Location
+	fine.DueDate = details.DueDate
+	fine.Amount = details.Amount
+}
+
+func adminFineMiddleware(w http.ResponseWriter, r *http.Request) {
+	fineID := bson.ObjectIdHex(mux.Vars(r)["fine_id"])
+	if !fineID.Valid() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var fine db.Fine
+	if err := db.Cols.Fines.FindId(fineID).One(&fine); err != nil {
+		panic(err)
+	}
+
+	context.Set(r, "fine", fine)
+}
+
+// adminGetFines lists fines, ?status=review is the queue of fines which couldn't be attributed
+func adminGetFines(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := db.M{}
+
+	if status := query.Get("status"); len(status) > 0 {
+		q["status"] = db.M{"$in": strings.Split(status, ",")}
+	}
+	if userID := query.Get("user_id"); bson.IsObjectIdHex(userID) {
+		q["user_id"] = bson.ObjectIdHex(userID)
+	}
+	if bikeID := query.Get("bike_id"); bson.IsObjectIdHex(bikeID) {
+		q["bike_id"] = bson.ObjectIdHex(bikeID)
+	}
+
+	var fines []db.Fine
+	if err := db.Cols.Fines.Find(q).Sort("-offence_at").All(&fines); err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, fines)
+}
+
+func adminGetFine(w http.ResponseWriter, r *http.Request) {
+	syrup.WriteJSON(w, http.StatusOK, context.Get(r, "fine").(db.Fine))
+}
+
+// adminCreateFine records a PCN and attributes it to the driver who had the bike at the time.
+// Fines which can't be attributed go to review.
+func adminCreateFine(w http.ResponseWriter, r *http.Request) {
+	var details fineDetails
+	if err := syrup.Bind(w, r, &details); err != nil {
+		return
+	}
+
+	errs := details.validate()
+	if count, err := db.Cols.Fines.Find(db.M{
+		"reference": details.Reference,
+		"issuer":    details.Issuer,
+	}).Count(); err != nil {
+		panic(err)
+	} else if count > 0 {
+		errs = append(errs, "This PCN has already been entered")
+	}
+
+	if len(errs) > 0 {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"errors": errs,
+		})
+		return
+	}
+
+	userID := context.Get(r, "userID").(bson.ObjectId)
+	fine := db.Fine{
+		ID:            bson.NewObjectId(),
+		Status:        "review",
+		StatusHistory: []db.FineStatusChange{},
+		Created:       time.Now(),
+		CreatedBy:     userID,
+	}
+	details.apply(&fine)
+
+	resolved, err := db.ResolveFine(&fine)
+	if err != nil {
+		panic(err)
+	}
+
+	if resolved {
+		fine.Status = "assigned"
+	}
+
+	fine.StatusHistory = append(fine.StatusHistory, db.FineStatusChange{
+		Status:    fine.Status,
+		ChangedBy: userID,
+		ChangedAt: fine.Created,
+	})
+
+	if err := db.Cols.Fines.Insert(&fine); err != nil {
+		panic(err)
+	}
+
+	if resolved {
+		notifyFineDriver(&fine)
+	}
+
+	syrup.WriteJSON(w, http.StatusCreated, fine)
+}
+
+// adminUpdateFine corrects a fine's details. Fines in review are attributed again.
+func adminUpdateFine(w http.ResponseWriter, r *http.Request) {
+	fine := context.Get(r, "fine").(db.Fine)
+	if fineInPayrollRun(w, fine) {
+		return
+	}
+
+	var details fineDetails
+	if err := syrup.Bind(w, r, &details); err != nil {
+		return
+	}
+
+	if errs := details.validate(); len(errs) > 0 {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"errors": errs,
+		})
+		return
+	}
+
+	details.apply(&fine)
+
+	set := db.M{
+		"reference":    fine.Reference,
+		"issuer":       fine.Issuer,
+		"kind":         fine.Kind,
+		"registration": fine.Registration,
+		"offence_at":   fine.OffenceAt,
+		"location":     fine.Location,
+		"due_date":     fine.DueDate,
+		"amount":       fine.Amount,
+	}
+	update := db.M{"$set": set}
+
+	resolved := false
+	if fine.Status == "review" {
+		var err error
+		if resolved, err = db.ResolveFine(&fine); err != nil {
+			panic(err)
+		}
+
+		if resolved {
+			change := db.FineStatusChange{
+				Status:    "assigned",
+				Notes:     "Matched after correction",
+				ChangedBy: context.Get(r, "userID").(bson.ObjectId),
+				ChangedAt: time.Now(),
+			}
+
+			fine.Status = change.Status
+			fine.StatusHistory = append(fine.StatusHistory, change)
+
+			set["bike_id"] = fine.BikeID
+			set["shift_id"] = fine.ShiftID
+			set["user_id"] = fine.UserID
+			set["status"] = fine.Status
+			update["$push"] = db.M{"status_history": change}
+		}
+	}
+
+	if err := db.Cols.Fines.Update(db.M{
+		"_id":            fine.ID,
+		"payroll_run_id": db.M{"$exists": false},
+	}, update); err == mgo.ErrNotFound {
+		syrup.WriteJSON(w, http.StatusConflict, map[string]string{
+			"error": "Fine is already in a payroll run",
+		})
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	// the driver is debited the corrected amount
+	if fine.Status == "deducted" {
+		if err := db.SetFineTransaction(fine, context.Get(r, "userID").(bson.ObjectId)); err != nil {
+			panic(err)
+		}
+	}
+
+	if resolved {
+		notifyFineDriver(&fine)
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, fine)
+}
+
+// adminAssignFine manually attributes a fine to a shift, e.g. from the review queue
+func adminAssignFine(w http.ResponseWriter, r *http.Request) {
+	fine := context.Get(r, "fine").(db.Fine)
+	if fineInPayrollRun(w, fine) {
+		return
+	}
+
+	var body struct {
+		ShiftID bson.ObjectId `json:"shift_id"`
+		Notes   string        `json:"notes"`
+	}
+	if err := syrup.Bind(w, r, &body); err != nil {
+		return
+	}
+
+	var shift db.Shift
+	if err := db.Cols.Shifts.FindId(body.ShiftID).One(&shift); err == mgo.ErrNotFound {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Shift does not exist",
+		})
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	change := db.FineStatusChange{
+		Status:    "assigned",
+		Notes:     body.Notes,
+		ChangedBy: context.Get(r, "userID").(bson.ObjectId),
+		ChangedAt: time.Now(),
+	}
+
+	update := db.M{
+		"$set": db.M{
+			"bike_id":  shift.ScooterID,
+			"shift_id": shift.ID,
+			"user_id":  shift.UserID,
+			"status":   change.Status,
+		},
+		"$push": db.M{"status_history": change},
+	}
+
+	// a new driver hasn't been emailed about it
+	if fine.UserID != shift.UserID {
+		update["$unset"] = db.M{"notified_at": 1}
+		fine.NotifiedAt = time.Time{}
+	}
+
+	fine.BikeID = shift.ScooterID
+	fine.ShiftID = shift.ID
+	fine.UserID = shift.UserID
+	fine.Status = change.Status
+	fine.StatusHistory = append(fine.StatusHistory, change)
+
+	if err := db.Cols.Fines.Update(db.M{
+		"_id":            fine.ID,
+		"payroll_run_id": db.M{"$exists": false},
+	}, update); err == mgo.ErrNotFound {
+		syrup.WriteJSON(w, http.StatusConflict, map[string]string{
+			"error": "Fine is already in a payroll run",
+		})
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	// no longer deducted, so not debited from the previous driver
+	if err := db.SetFineTransaction(fine, change.ChangedBy); err != nil {
+		panic(err)
+	}
+
+	notifyFineDriver(&fine)
+
+	syrup.WriteJSON(w, http.StatusOK, fine)
+}
+
+// adminSetFineStatus records the outcome of a fine (contested, transferred, paid, deducted)
+func adminSetFineStatus(w http.ResponseWriter, r *http.Request) {
+	fine := context.Get(r, "fine").(db.Fine)
+	if fineInPayrollRun(w, fine) {
+		return
+	}
+
+	var body struct {
+		Status string `json:"status"`
+		Notes  string `json:"notes"`
+	}
+	if err := syrup.Bind(w, r, &body); err != nil {
+		return
+	}
+
+	errs := []string{}
+	switch {
+	case len(db.FineStatuses[body.Status]) == 0:
+		errs = append(errs, "Unknown status")
+	case body.Status == fine.Status:
+		errs = append(errs, "Fine is already "+db.FineStatuses[body.Status])
+	case body.Status == "assigned" || body.Status == "review":
+		errs = append(errs, "Use the assign API to attribute fines")
+	case !fine.UserID.Valid() && (body.Status == "transferred" || body.Status == "deducted"):
+		errs = append(errs, "Fine must be assigned to a driver first")
+	}
+
+	if len(errs) > 0 {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"errors": errs,
+		})
+		return
+	}
+
+	// not both from pay and the card
+	if body.Status == "deducted" {
+		if charged, err := db.CardCharged(db.M{"fine_id": fine.ID}); err != nil {
+			panic(err)
+		} else if charged {
+			syrup.WriteJSON(w, http.StatusConflict, map[string]string{
+				"error": "This fine was charged to the driver's card",
+			})
+			return
+		}
+	}
+
+	change := db.FineStatusChange{
+		Status:    body.Status,
+		Notes:     body.Notes,
+		ChangedBy: context.Get(r, "userID").(bson.ObjectId),
+		ChangedAt: time.Now(),
+	}
+
+	if err := db.Cols.Fines.Update(db.M{
+		"_id":            fine.ID,
+		"status":         fine.Status,
+		"payroll_run_id": db.M{"$exists": false},
+	}, db.M{
+		"$set":  db.M{"status": body.Status},
+		"$push": db.M{"status_history": change},
+	}); err == mgo.ErrNotFound {
+		syrup.WriteJSON(w, http.StatusConflict, map[string]string{
+			"error": "Fine was updated by someone else or taken into a payroll run, please reload",
+		})
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	fine.Status = body.Status
+	fine.StatusHistory = append(fine.StatusHistory, change)
+
+	// deducted fines are debited from the driver's ledger
+	if err := db.SetFineTransaction(fine, change.ChangedBy); err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, fine)
+}
+
+// fineInPayrollRun rejects changes to a fine a payroll run has taken from the driver's pay, true if rejected
+func fineInPayrollRun(w http.ResponseWriter, fine db.Fine) bool {
+	if !fine.PayrollRunID.Valid() {
+		return false
+	}
+
+	syrup.WriteJSON(w, http.StatusConflict, map[string]string{
+		"error": "Fine is already in a payroll run",
+	})
+	return true
+}
+
+// notifyFineDriver emails the driver a fine has been attributed to. Failed emails are retried by the fine
+// emails job, so the fine is still saved.
+func notifyFineDriver(fine *db.Fine) {
+	if err := db.NotifyFineDriver(fine); err != nil {
+		fmt.Println("Failed to email driver about fine", fine.ID.Hex(), err)
+	}
+}
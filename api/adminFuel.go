@@ -0,0 +1,223 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/maple-ai/fleet-api/db"
+	"github.com/maple-ai/syrup"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// adminGetBikeFuel returns the bike's refuels and its fuel consumption over ?from=&to=
+func adminGetBikeFuel(w http.ResponseWriter, r *http.Request) {
+	bike := context.Get(r, "bike").(db.Bike)
+	from, to := reportPeriod(r)
+
+	var events []db.FuelEvent
+	if err := db.Cols.Fuel.Find(db.M{
+		"bike_id":   bike.ID,
+		"filled_at": db.M{"$gte": from, "$lt": to},
+	}).Sort("-filled_at").All(&events); err != nil {
+		panic(err)
+	}
+
+	consumption := fuelConsumption(db.M{"bike_id": bike.ID}, "$bike_id", from, to)
+
+	syrup.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"events":      events,
+		"consumption": consumption,
+	})
+}
+
+// adminAddBikeFuel records a refuel, linked to a shift on this bike if given
+func adminAddBikeFuel(w http.ResponseWriter, r *http.Request) {
+	var event db.FuelEvent
+	if err := syrup.Bind(w, r, &event); err != nil {
+		return
+	}
+
+	bike := context.Get(r, "bike").(db.Bike)
+	if event.FilledAt.IsZero() {
+		event.FilledAt = time.Now()
+	}
+
+	errs := []string{}
+	if event.Litres <= 0 {
+		errs = append(errs, "Litres must be more than zero")
+	}
+	if event.Cost < 0 {
+		errs = append(errs, "Cost cannot be negative")
+	}
+
+	var shift db.Shift
+	if event.ShiftID.Valid() {
+		if err := db.Cols.Shifts.Find(db.M{
+			"_id":        event.ShiftID,
+			"scooter_id": bike.ID,
+		}).One(&shift); err == mgo.ErrNotFound {
+			errs = append(errs, "Shift is not on this bike")
+		} else if err != nil {
+			panic(err)
+		}
+	}
+
+	if len(errs) > 0 {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"errors": errs,
+		})
+		return
+	}
+
+	event.ID = bson.NewObjectId()
+	event.BikeID = bike.ID
+	event.UserID = shift.UserID
+	event.ReceiptID = ""
+	event.RecordedBy = context.Get(r, "userID").(bson.ObjectId)
+
+	if err := db.Cols.Fuel.Insert(&event); err != nil {
+		panic(err)
+	}
+
+	if shift.Status == "complete" {
+		if err := db.ComputeShiftFuel(shift); err != nil {
+			panic(err)
+		}
+	}
+
+	syrup.WriteJSON(w, http.StatusCreated, event)
+}
+
+func adminDeleteBikeFuel(w http.ResponseWriter, r *http.Request) {
+	event := findFuelEvent(r)
+
+	if event.ReceiptID.Valid() {
+		if err := db.DB.GridFS("fuel").RemoveId(event.ReceiptID); err != nil && err != mgo.ErrNotFound {
+			panic(err)
+		}
+	}
+
+	if err := db.Cols.Fuel.RemoveId(event.ID); err != nil {
+		panic(err)
+	}
+
+	if event.ShiftID.Valid() {
+		var shift db.Shift
+		if err := db.Cols.Shifts.FindId(event.ShiftID).One(&shift); err != nil {
+			panic(err)
+		}
+
+		if err := db.ComputeShiftFuel(shift); err != nil {
+			panic(err)
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func adminSetFuelReceipt(w http.ResponseWriter, r *http.Request) {
+	event := findFuelEvent(r)
+
+	f := uploadedFile(w, r, 51200)
+	if f == nil {
+		return
+	}
+
+	gridFS := db.DB.GridFS("fuel")
+	fileID, _, err := writeGridFile(gridFS, event.ID.Hex(), f)
+	if err != nil {
+		panic(err)
+	}
+
+	if err := db.Cols.Fuel.UpdateId(event.ID, db.M{"$set": db.M{"receipt_id": fileID}}); err != nil {
+		panic(err)
+	}
+
+	// replaces the previous receipt
+	if event.ReceiptID.Valid() {
+		if err := gridFS.RemoveId(event.ReceiptID); err != nil && err != mgo.ErrNotFound {
+			panic(err)
+		}
+	}
+
+	syrup.WriteJSON(w, http.StatusCreated, map[string]interface{}{
+		"_id": fileID,
+	})
+}
+
+func adminGetFuelReceipt(w http.ResponseWriter, r *http.Request) {
+	event := findFuelEvent(r)
+	if !event.ReceiptID.Valid() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	serveGridFile(w, db.DB.GridFS("fuel"), event.ReceiptID)
+}
+
+// adminGetFuelReport reports fuel consumption per bike, or per driver with ?group=driver
+func adminGetFuelReport(w http.ResponseWriter, r *http.Request) {
+	from, to := reportPeriod(r)
+
+	group := "$bike_id"
+	if r.URL.Query().Get("group") == "driver" {
+		group = "$shift.user_id"
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, fuelConsumption(db.M{}, group, from, to))
+}
+
+// fuelConsumption totals distance and fuel used on shifts checked out in the period, grouped by the given field
+func fuelConsumption(match db.M, group string, from, to time.Time) []db.M {
+	match["fuel_used"] = db.M{"$gt": 0}
+
+	results := []db.M{}
+	if err := db.Cols.BikeHistory.Pipe([]db.M{
+		{"$match": match},
+		{"$lookup": db.M{
+			"from":         "shifts",
+			"localField":   "shift_id",
+			"foreignField": "_id",
+			"as":           "shift",
+		}},
+		{"$unwind": "$shift"},
+		{"$match": db.M{"shift.check_out": db.M{"$gte": from, "$lt": to}}},
+		{"$group": db.M{
+			"_id":         group,
+			"shifts":      db.M{"$sum": 1},
+			"distance":    db.M{"$sum": "$distance"},
+			"fuel_used":   db.M{"$sum": "$fuel_used"},
+			"fuel_charge": db.M{"$sum": "$shift.fuel_charge"},
+			"anomalies":   db.M{"$sum": db.M{"$cond": []interface{}{"$fuel_anomaly", 1, 0}}},
+		}},
+		{"$project": db.M{
+			"shifts":          1,
+			"distance":        1,
+			"fuel_used":       1,
+			"fuel_charge":     1,
+			"anomalies":       1,
+			"miles_per_litre": db.M{"$divide": []string{"$distance", "$fuel_used"}},
+		}},
+		{"$sort": db.M{"anomalies": -1}},
+	}).All(&results); err != nil {
+		panic(err)
+	}
+
+	return results
+}
+
+// findFuelEvent loads the route's fuel event for the bike in context
+func findFuelEvent(r *http.Request) db.FuelEvent {
+	var event db.FuelEvent
+	if err := db.Cols.Fuel.Find(db.M{
+		"_id":     bson.ObjectIdHex(mux.Vars(r)["fuel_id"]),
+		"bike_id": context.Get(r, "bike").(db.Bike).ID,
+	}).One(&event); err != nil {
+		panic(err)
+	}
+
+	return event
+}
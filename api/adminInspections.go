@@ -0,0 +1,267 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/maple-ai/fleet-api/db"
+	"github.com/maple-ai/syrup"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func adminGetChecklists(w http.ResponseWriter, r *http.Request) {
+	var checklists []db.Checklist
+	if err := db.Cols.Checklists.Find(db.M{}).Sort("name").All(&checklists); err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, checklists)
+}
+
+func adminSaveChecklist(w http.ResponseWriter, r *http.Request) {
+	var checklist db.Checklist
+	if err := syrup.Bind(w, r, &checklist); err != nil {
+		return
+	}
+
+	errs := []string{}
+	if len(checklist.Name) == 0 {
+		errs = append(errs, "Name cannot be empty")
+	}
+
+	keys := map[string]bool{}
+	for _, item := range checklist.Items {
+		switch {
+		case len(item.Key) == 0 || len(item.Label) == 0:
+			errs = append(errs, "Items must have a key and label")
+		case keys[item.Key]:
+			errs = append(errs, "Duplicate item key: "+item.Key)
+		case item.Kind != "check" && item.Kind != "reading":
+			errs = append(errs, item.Label+": kind must be check or reading")
+		}
+
+		keys[item.Key] = true
+	}
+
+	if len(errs) > 0 {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"errors": errs,
+		})
+		return
+	}
+
+	if r.Method == "POST" {
+		checklist.ID = bson.NewObjectId()
+		checklist.Created = time.Now()
+		checklist.CreatedBy = context.Get(r, "userID").(bson.ObjectId)
+
+		if err := db.Cols.Checklists.Insert(&checklist); err != nil {
+			panic(err)
+		}
+
+		syrup.WriteJSON(w, http.StatusCreated, checklist)
+		return
+	}
+
+	checklist.ID = bson.ObjectIdHex(mux.Vars(r)["checklist_id"])
+	set := db.M{
+		"name":  checklist.Name,
+		"model": checklist.Model,
+		"items": checklist.Items,
+	}
+	update := db.M{"$set": set}
+	if checklist.GarageID.Valid() {
+		set["garage_id"] = checklist.GarageID
+	} else {
+		update["$unset"] = db.M{"garage_id": 1}
+	}
+
+	if err := db.Cols.Checklists.UpdateId(checklist.ID, update); err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, checklist)
+}
+
+func adminDeleteChecklist(w http.ResponseWriter, r *http.Request) {
+	if err := db.Cols.Checklists.RemoveId(bson.ObjectIdHex(mux.Vars(r)["checklist_id"])); err != nil {
+		panic(err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminGetShiftChecklist returns the checklist which applies to the shift's bike
+func adminGetShiftChecklist(w http.ResponseWriter, r *http.Request) {
+	var shift db.Shift
+	if err := db.Cols.Shifts.FindId(bson.ObjectIdHex(mux.Vars(r)["shift_id"])).One(&shift); err != nil {
+		panic(err)
+	}
+
+	checklist := shiftChecklist(shift)
+	if checklist == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, checklist)
+}
+
+func adminGetShiftInspections(w http.ResponseWriter, r *http.Request) {
+	var inspections []db.BikeInspection
+	if err := db.Cols.Inspections.Find(db.M{
+		"shift_id": bson.ObjectIdHex(mux.Vars(r)["shift_id"]),
+	}).Sort("checked_at").All(&inspections); err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, inspections)
+}
+
+func adminSetShiftInspection(w http.ResponseWriter, r *http.Request) {
+	var shift db.Shift
+	if err := db.Cols.Shifts.FindId(bson.ObjectIdHex(mux.Vars(r)["shift_id"])).One(&shift); err != nil {
+		panic(err)
+	}
+
+	stage := mux.Vars(r)["stage"]
+	if stage != "check-in" && stage != "check-out" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var inspection db.BikeInspection
+	if err := syrup.Bind(w, r, &inspection); err != nil {
+		return
+	}
+
+	checklist := shiftChecklist(shift)
+	if checklist == nil {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "No checklist applies to this bike",
+		})
+		return
+	}
+
+	if errs := inspection.Validate(checklist); len(errs) > 0 {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"errors": errs,
+		})
+		return
+	}
+
+	// re-submitting replaces the stage's inspection
+	var existing db.BikeInspection
+	if err := db.Cols.Inspections.Find(db.M{
+		"shift_id": shift.ID,
+		"stage":    stage,
+	}).One(&existing); err != nil && err != mgo.ErrNotFound {
+		panic(err)
+	} else if err == mgo.ErrNotFound {
+		existing.ID = bson.NewObjectId()
+	}
+
+	inspection.ID = existing.ID
+	inspection.ShiftID = shift.ID
+	inspection.BikeID = shift.ScooterID
+	inspection.ChecklistID = checklist.ID
+	inspection.Stage = stage
+	inspection.NewDamage = []string{}
+	inspection.CheckedBy = context.Get(r, "userID").(bson.ObjectId)
+	inspection.CheckedAt = time.Now()
+
+	if stage == "check-out" {
+		var before db.BikeInspection
+		if err := db.Cols.Inspections.Find(db.M{
+			"shift_id": shift.ID,
+			"stage":    "check-in",
+		}).One(&before); err != nil && err != mgo.ErrNotFound {
+			panic(err)
+		} else if err == nil {
+			inspection.NewDamage = db.DiffInspections(&before, &inspection)
+		}
+	}
+
+	if failed := inspection.FailedCritical(checklist); len(failed) > 0 {
+		maintenance := db.BikeMaintenance{
+			ID:               bson.NewObjectId(),
+			BikeID:           shift.ScooterID,
+			Notes:            "Failed " + stage + " inspection: " + strings.Join(failed, ", "),
+			CheckedBy:        inspection.CheckedBy,
+			CheckedAt:        inspection.CheckedAt,
+			MechanicRequired: true,
+		}
+		if err := db.Cols.BikeMaintenance.Insert(&maintenance); err != nil {
+			panic(err)
+		}
+
+		inspection.MaintenanceID = maintenance.ID
+	}
+
+	if _, err := db.Cols.Inspections.Upsert(db.M{
+		"shift_id": shift.ID,
+		"stage":    stage,
+	}, &inspection); err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusCreated, inspection)
+}
+
+func adminUploadInspectionPhoto(w http.ResponseWriter, r *http.Request) {
+	shiftID := bson.ObjectIdHex(mux.Vars(r)["shift_id"])
+
+	f := uploadedFile(w, r, 51200)
+	if f == nil {
+		return
+	}
+
+	fileID, _, err := writeGridFile(db.DB.GridFS("inspections"), shiftID.Hex(), f)
+	if err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusCreated, map[string]interface{}{
+		"_id": fileID,
+	})
+}
+
+func adminGetInspectionPhoto(w http.ResponseWriter, r *http.Request) {
+	serveGridFile(w, db.DB.GridFS("inspections"), bson.ObjectIdHex(mux.Vars(r)["photo_id"]))
+}
+
+// shiftChecklist finds the checklist applying to the shift's bike, nil if none
+func shiftChecklist(shift db.Shift) *db.Checklist {
+	var bike db.Bike
+	if err := db.Cols.Bikes.FindId(shift.ScooterID).One(&bike); err != nil {
+		panic(err)
+	}
+
+	checklist, err := db.FindChecklist(bike)
+	if err != nil {
+		panic(err)
+	}
+
+	return checklist
+}
+
+// inspectionMissing is true when a checklist applies but the stage's inspection hasn't been recorded
+func inspectionMissing(shift db.Shift, stage string) bool {
+	if shiftChecklist(shift) == nil {
+		return false
+	}
+
+	count, err := db.Cols.Inspections.Find(db.M{
+		"shift_id": shift.ID,
+		"stage":    stage,
+	}).Count()
+	if err != nil {
+		panic(err)
+	}
+
+	return count == 0
+}
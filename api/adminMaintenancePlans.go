@@ -0,0 +1,130 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/maple-ai/fleet-api/db"
+	"github.com/maple-ai/syrup"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func adminGetMaintenancePlans(w http.ResponseWriter, r *http.Request) {
+	var plans []db.MaintenancePlan
+	if err := db.Cols.ServicePlans.Find(db.M{}).Sort("model", "name").All(&plans); err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, plans)
+}
+
+func adminSaveMaintenancePlan(w http.ResponseWriter, r *http.Request) {
+	var plan db.MaintenancePlan
+	if err := syrup.Bind(w, r, &plan); err != nil {
+		return
+	}
+
+	errs := []string{}
+	switch {
+	case len(plan.Name) == 0:
+		errs = append(errs, "Name cannot be empty")
+	case !plan.BikeID.Valid() && len(plan.Model) == 0:
+		errs = append(errs, "Plan must apply to a bike or a model")
+	case plan.IntervalMiles <= 0 && plan.IntervalDays <= 0:
+		errs = append(errs, "Plan must have an interval in miles or days")
+	}
+
+	if len(errs) > 0 {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"errors": errs,
+		})
+		return
+	}
+
+	if r.Method == "POST" {
+		plan.ID = bson.NewObjectId()
+		plan.Created = time.Now()
+		plan.CreatedBy = context.Get(r, "userID").(bson.ObjectId)
+
+		if err := db.Cols.ServicePlans.Insert(&plan); err != nil {
+			panic(err)
+		}
+
+		syrup.WriteJSON(w, http.StatusCreated, plan)
+		return
+	}
+
+	plan.ID = bson.ObjectIdHex(mux.Vars(r)["plan_id"])
+	set := db.M{
+		"name":           plan.Name,
+		"model":          plan.Model,
+		"interval_miles": plan.IntervalMiles,
+		"interval_days":  plan.IntervalDays,
+		"critical":       plan.Critical,
+	}
+	update := db.M{"$set": set}
+	if plan.BikeID.Valid() {
+		set["bike_id"] = plan.BikeID
+	} else {
+		update["$unset"] = db.M{"bike_id": 1}
+	}
+
+	if err := db.Cols.ServicePlans.UpdateId(plan.ID, update); err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, plan)
+}
+
+func adminDeleteMaintenancePlan(w http.ResponseWriter, r *http.Request) {
+	if err := db.Cols.ServicePlans.RemoveId(bson.ObjectIdHex(mux.Vars(r)["plan_id"])); err != nil {
+		panic(err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminGetBikeMaintenanceStatus returns every plan for the bike with its due state
+func adminGetBikeMaintenanceStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := db.GetMaintenanceStatus(context.Get(r, "bike").(db.Bike))
+	if err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, status)
+}
+
+// adminGetMaintenanceDue is the fleet-wide queue of due and overdue plans
+func adminGetMaintenanceDue(w http.ResponseWriter, r *http.Request) {
+	var bikes []db.Bike
+	if err := db.Cols.Bikes.Find(db.M{"status": db.M{"$nin": db.RetiredBikeStatuses}}).Sort("bike_number").All(&bikes); err != nil {
+		panic(err)
+	}
+
+	overdue := []db.M{}
+	due := []db.M{}
+	for _, bike := range bikes {
+		status, err := db.GetMaintenanceStatus(bike)
+		if err != nil {
+			panic(err)
+		}
+
+		for _, plan := range status {
+			item := db.M{
+				"bike":        bike,
+				"maintenance": plan,
+			}
+
+			switch plan.Status {
+			case "overdue":
+				overdue = append(overdue, item)
+			case "due":
+				due = append(due, item)
+			}
+		}
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, append(overdue, due...))
+}
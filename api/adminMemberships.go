@@ -161,6 +161,13 @@ func adminUpdateUserMembership(w http.ResponseWriter, r *http.Request) {
 	membership.ApprovedDate = originalMembership.ApprovedDate
 	membership.ApprovedBy = originalMembership.ApprovedBy
 	membership.InterviewDate = originalMembership.InterviewDate
+	membership.DrivingScore = originalMembership.DrivingScore
+	membership.DrivingShifts = originalMembership.DrivingShifts
+	// the rating is set through its own endpoint, once set it includes the driving score
+	membership.ManualRating = originalMembership.ManualRating
+	if originalMembership.ManualRating != nil {
+		membership.Rating = originalMembership.Rating
+	}
 
 	if err := db.Cols.Memberships.UpdateId(membership.MID, membership); err != nil {
 		panic(err)
@@ -187,9 +194,9 @@ func adminGetUserPaymentInformation(w http.ResponseWriter, r *http.Request) {
 	user := context.Get(r, "admin_user").(db.User)
 
 	if len(user.StripeUserID) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
 	}
-	w.WriteHeader(http.StatusNotFound)
-	return
 
 	cards := card.List(&stripe.CardListParams{
 		Customer: user.StripeUserID,
@@ -269,7 +276,10 @@ func adminSetRating(w http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 
-	if err := db.Cols.Memberships.UpdateId(membership.MID, db.M{"$set": db.M{"rating": body.Rating}}); err != nil {
+	if err := db.Cols.Memberships.UpdateId(membership.MID, db.M{"$set": db.M{
+		"manual_rating": body.Rating,
+		"rating":        db.MembershipRating(membership, body.Rating),
+	}}); err != nil {
 		panic(err)
 	}
 
@@ -316,6 +326,13 @@ func adminAcceptMembership(w http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 
+	// drivers hiring our bikes leave a deposit, a failed hold is recorded for admins to retry
+	if !membership.UseOwnBike {
+		if _, err := db.HoldDeposit(user, context.Get(r, "userID").(bson.ObjectId)); err != nil {
+			panic(err)
+		}
+	}
+
 	if message, err := db.NewMail(user.Email, db.MembershipAcceptedSubject, db.MembershipAccepted, map[string]interface{}{
 		"UserName":     user.GetName(),
 		"MembershipID": membershipID.ID,
@@ -0,0 +1,298 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/maple-ai/fleet-api/config"
+	"github.com/maple-ai/fleet-api/db"
+	"github.com/maple-ai/syrup"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// adminGetGarageParts lists the garage's stock, ?low_stock=true for parts at their reorder level
+func adminGetGarageParts(w http.ResponseWriter, r *http.Request) {
+	var parts []db.Part
+	if err := db.Cols.Parts.Find(db.M{
+		"garage_id": context.Get(r, "garage").(db.Garage).ID,
+	}).Sort("sku").All(&parts); err != nil {
+		panic(err)
+	}
+
+	if r.URL.Query().Get("low_stock") == "true" {
+		low := []db.Part{}
+		for _, part := range parts {
+			if part.LowStock() {
+				low = append(low, part)
+			}
+		}
+
+		parts = low
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, parts)
+}
+
+// adminSavePart creates a stock line at the garage (POST) or edits its details (PUT).
+// Quantity is only set on creation, after that it changes through adjustments and maintenance work.
+func adminSavePart(w http.ResponseWriter, r *http.Request) {
+	var part db.Part
+	if err := syrup.Bind(w, r, &part); err != nil {
+		return
+	}
+
+	if r.Method == "PUT" {
+		var existing db.Part
+		if err := db.Cols.Parts.FindId(bson.ObjectIdHex(mux.Vars(r)["part_id"])).One(&existing); err != nil {
+			panic(err)
+		}
+
+		part.ID = existing.ID
+		part.GarageID = existing.GarageID
+	} else {
+		part.ID = bson.NewObjectId()
+		part.GarageID = context.Get(r, "garage").(db.Garage).ID
+	}
+
+	errs := []string{}
+	switch {
+	case len(part.SKU) == 0:
+		errs = append(errs, "SKU cannot be empty")
+	case part.Quantity < 0 || part.ReorderLevel < 0:
+		errs = append(errs, "Quantities cannot be negative")
+	case part.UnitCost < 0:
+		errs = append(errs, "Unit cost cannot be negative")
+	}
+
+	if count, err := db.Cols.Parts.Find(db.M{
+		"_id":       db.M{"$ne": part.ID},
+		"garage_id": part.GarageID,
+		"sku":       part.SKU,
+	}).Count(); err != nil {
+		panic(err)
+	} else if count > 0 {
+		errs = append(errs, "SKU is already stocked at this garage")
+	}
+
+	if len(errs) > 0 {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"errors": errs,
+		})
+		return
+	}
+
+	if r.Method == "POST" {
+		part.Created = time.Now()
+		part.CreatedBy = context.Get(r, "userID").(bson.ObjectId)
+
+		if err := db.Cols.Parts.Insert(&part); err != nil {
+			panic(err)
+		}
+
+		syrup.WriteJSON(w, http.StatusCreated, part)
+		return
+	}
+
+	var updated db.Part
+	if _, err := db.Cols.Parts.FindId(part.ID).Apply(mgo.Change{
+		Update: db.M{"$set": db.M{
+			"sku":           part.SKU,
+			"description":   part.Description,
+			"reorder_level": part.ReorderLevel,
+			"unit_cost":     part.UnitCost,
+		}},
+		ReturnNew: true,
+	}, &updated); err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, updated)
+}
+
+func adminDeletePart(w http.ResponseWriter, r *http.Request) {
+	if err := db.Cols.Parts.RemoveId(bson.ObjectIdHex(mux.Vars(r)["part_id"])); err != nil {
+		panic(err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminAdjustPartStock adds deliveries (positive) or write-offs (negative) to stock
+func adminAdjustPartStock(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Quantity int `json:"quantity"`
+	}
+	if err := syrup.Bind(w, r, &body); err != nil {
+		return
+	}
+
+	if body.Quantity == 0 {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Quantity cannot be zero",
+		})
+		return
+	}
+
+	var part db.Part
+	if _, err := db.Cols.Parts.Find(db.M{
+		"_id":      bson.ObjectIdHex(mux.Vars(r)["part_id"]),
+		"quantity": db.M{"$gte": -body.Quantity},
+	}).Apply(mgo.Change{
+		Update:    db.M{"$inc": db.M{"quantity": body.Quantity}},
+		ReturnNew: true,
+	}, &part); err == mgo.ErrNotFound {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Stock cannot go below zero",
+		})
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	if body.Quantity < 0 && part.LowStock() && part.Quantity-body.Quantity > part.ReorderLevel {
+		notifyLowStock(part.GarageID, []db.Part{part})
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, part)
+}
+
+// adminGetBikeMaintenanceCost totals the bike's parts and labour costs over ?from=&to= (dd-mm-yyyy)
+func adminGetBikeMaintenanceCost(w http.ResponseWriter, r *http.Request) {
+	from, to := reportPeriod(r)
+	bike := context.Get(r, "bike").(db.Bike)
+
+	costs := maintenanceCosts(db.M{"bike_id": bike.ID}, from, to)
+	if len(costs) == 0 {
+		costs = []db.M{{"_id": bike.ID, "parts_cost": 0, "labour_cost": 0, "total_cost": 0, "logs": 0}}
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, costs[0])
+}
+
+// adminGetMaintenanceCosts reports maintenance cost per bike over ?from=&to=, most expensive first
+func adminGetMaintenanceCosts(w http.ResponseWriter, r *http.Request) {
+	from, to := reportPeriod(r)
+
+	syrup.WriteJSON(w, http.StatusOK, maintenanceCosts(db.M{}, from, to))
+}
+
+func maintenanceCosts(match db.M, from, to time.Time) []db.M {
+	match["checked_at"] = db.M{"$gte": from, "$lt": to}
+
+	costs := []db.M{}
+	if err := db.Cols.BikeMaintenance.Pipe([]db.M{
+		{"$match": match},
+		{"$group": db.M{
+			"_id":         "$bike_id",
+			"parts_cost":  db.M{"$sum": "$parts_cost"},
+			"labour_cost": db.M{"$sum": "$labour_cost"},
+			"logs":        db.M{"$sum": 1},
+		}},
+		{"$project": db.M{
+			"parts_cost":  1,
+			"labour_cost": 1,
+			"logs":        1,
+			"total_cost":  db.M{"$add": []string{"$parts_cost", "$labour_cost"}},
+		}},
+		{"$lookup": db.M{
+			"from":         "bikes",
+			"localField":   "_id",
+			"foreignField": "_id",
+			"as":           "bike",
+		}},
+		{"$unwind": "$bike"},
+		{"$sort": db.M{"total_cost": -1}},
+	}).All(&costs); err != nil {
+		panic(err)
+	}
+
+	return costs
+}
+
+// reportPeriod reads ?from=&to= (dd-mm-yyyy, to inclusive), defaulting to the last 12 months
+func reportPeriod(r *http.Request) (time.Time, time.Time) {
+	to := time.Now()
+	from := to.AddDate(-1, 0, 0)
+
+	if date, err := time.Parse("02-01-2006", r.URL.Query().Get("from")); err == nil {
+		from = date
+	}
+	if date, err := time.Parse("02-01-2006", r.URL.Query().Get("to")); err == nil {
+		to = date.AddDate(0, 0, 1)
+	}
+
+	return from, to
+}
+
+// writePartsError explains why parts couldn't be taken from stock, panicking on database errors
+func writePartsError(w http.ResponseWriter, err error) {
+	message := ""
+	switch err := err.(type) {
+	case db.StockError:
+		var part db.Part
+		if findErr := db.Cols.Parts.FindId(err.PartID).One(&part); findErr == mgo.ErrNotFound {
+			message = "Part is not stocked at this garage"
+		} else if findErr != nil {
+			panic(findErr)
+		} else {
+			message = "Only " + strconv.Itoa(part.Quantity) + " of " + part.SKU + " in stock, " + strconv.Itoa(err.Quantity) + " needed"
+		}
+	default:
+		if err != db.ErrPartQuantity {
+			panic(err)
+		}
+
+		message = err.Error()
+	}
+
+	syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+		"error": message,
+	})
+}
+
+// notifyLowStock emails admins about parts which have dropped to their reorder level. The stock change is
+// already saved, so failures are only logged.
+func notifyLowStock(garageID bson.ObjectId, parts []db.Part) {
+	if len(parts) == 0 {
+		return
+	}
+
+	if err := sendLowStockEmails(garageID, parts); err != nil {
+		fmt.Println("Failed to email low stock for garage", garageID.Hex(), err)
+	}
+}
+
+func sendLowStockEmails(garageID bson.ObjectId, parts []db.Part) error {
+	garageName := "the garage"
+	if garage, err := db.FindGarageByID(garageID); err != nil {
+		return err
+	} else if garage != nil {
+		garageName = garage.Name
+	}
+
+	emails, err := db.FindPrivilegedEmails("admin", "superadmin")
+	if err != nil {
+		return err
+	}
+
+	for _, email := range emails {
+		message, err := db.NewMail(email, db.LowStockSubject, db.LowStock, map[string]interface{}{
+			"Garage": garageName,
+			"Parts":  parts,
+		})
+		if err != nil {
+			return err
+		}
+
+		if _, _, err := config.Mail.Send(message); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
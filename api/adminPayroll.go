@@ -11,8 +11,19 @@ import (
 	"gopkg.in/mgo.v2/bson"
 )
 
+type payrollShift struct {
+	db.Shift   `bson:",inline"`
+	User       db.User           `bson:"user" json:"user"`
+	Membership db.UserMembership `bson:"membership" json:"membership"`
+
+	// Calculated pay, PayError says why it could not be
+	Pay      *db.PayBreakdown `bson:"-" json:"pay"`
+	PayError string           `bson:"-" json:"pay_error,omitempty"`
+}
+
+// adminPayroll lists completed, unpaid shifts with their calculated pay
 func adminPayroll(w http.ResponseWriter, r *http.Request) {
-	var results []db.M
+	results := []payrollShift{}
 	if err := db.Cols.Shifts.Pipe([]db.M{
 		{"$match": db.M{
 			"paid": false,
@@ -41,16 +52,31 @@ func adminPayroll(w http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 
+	for i := range results {
+		pay, err := db.CalculatePay(results[i].Shift, results[i].Membership)
+		if err != nil {
+			results[i].PayError = err.Error()
+			continue
+		}
+
+		results[i].Pay = &pay
+	}
+
 	syrup.WriteJSON(w, http.StatusOK, results)
 }
 
+// adminPayout pays one driver's shifts straight away, through a payroll run of just those shifts.
+// Totals (in pounds) must match the calculated pay unless the shift has an override reason, and the run must pass
+// the checks made on approval.
+// With the two person rule the run is left as a draft for another admin to approve.
 func adminPayout(w http.ResponseWriter, r *http.Request) {
 	var body struct {
 		UserID bson.ObjectId `json:"user"`
 		Shifts []struct {
-			Shift   bson.ObjectId `json:"shift"`
-			Total   float32       `json:"total"`
-			Removed bool          `json:"removed"`
+			Shift          bson.ObjectId `json:"shift"`
+			Total          float32       `json:"total"`
+			Removed        bool          `json:"removed"`
+			OverrideReason string        `json:"override_reason"`
 		} `json:"shifts"`
 	}
 	if err := syrup.Bind(w, r, &body); err != nil {
@@ -63,54 +89,77 @@ func adminPayout(w http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 
-	// update shifts
+	shiftIDs := []bson.ObjectId{}
 	for _, shift := range body.Shifts {
-		shiftDoc := db.M{
-			"paid":        true,
-			"paid_amount": shift.Total,
-			"paid_by":     context.Get(r, "userID"),
-			"paid_at":     time.Now(),
+		shiftIDs = append(shiftIDs, shift.Shift)
+	}
+
+	userID := context.Get(r, "userID").(bson.ObjectId)
+	now := time.Now()
+	run, err := db.NewPayrollRun(db.M{
+		"_id":     db.M{"$in": shiftIDs},
+		"user_id": user.ID,
+	}, now, now, userID)
+	if err != nil {
+		panic(err)
+	}
+
+	// check every shift before paying any
+	errs := []string{}
+	for _, item := range body.Shifts {
+		shift := findPayrollShift(run, item.Shift)
+		if shift == nil {
+			errs = append(errs, item.Shift.Hex()+": not a completed, unpaid shift for this driver, or already in a payroll run")
+			continue
 		}
 
-		if shift.Removed {
-			shiftDoc["paid_amount"] = 0
-			shiftDoc["deleted"] = true
-			shiftDoc["deleted_reason"] = "Payroll"
-			shiftDoc["deleted_date"] = time.Now()
-			shiftDoc["deleted_by"] = context.Get(r, "userID")
+		if err := setPayrollShift(shift, poundsToPence(item.Total), item.OverrideReason, item.Removed); err != nil {
+			errs = append(errs, err.Error())
 		}
+	}
 
-		db.Cols.Shifts.UpdateId(shift.Shift, db.M{"$set": shiftDoc})
+	if len(errs) == 0 {
+		run.UpdateTotals()
+		errs = payrollRunErrors(run)
 	}
 
-	// _, err := config.PaypalClient.GetAccessToken()
-	// payout := paypal.Payout{
-	// 	SenderBatchHeader: &paypal.SenderBatchHeader{
-	// 		EmailSubject: "Subject",
-	// 	},
-	// 	Items: []paypal.PayoutItem{
-	// 		{
-	// 			RecipientType: "EMAIL",
-	// 			Receiver:      "-buyer@gmail.com",
-	// 			Amount: &paypal.AmountPayout{
-	// 				Value:    "10.00",
-	// 				Currency: "GBP",
-	// 			},
-	// 			Note:         "Hello world",
-	// 			SenderItemID: "no id",
-	// 		},
-	// 	},
-	// }
-
-	// payoutResp, err := config.PaypalClient.CreateSinglePayout(payout)
-	// fmt.Println(payoutResp, err)
-
-	// send alert to user
-	if message, err := db.NewMail(user.Email, db.UserPayoutSubject, db.UserPayout, map[string]interface{}{
-		"UserName": user.GetName(),
-	}); err != nil {
-		panic(err)
-	} else if _, _, err := config.Mail.Send(message); err != nil {
+	if len(errs) > 0 {
+		if err := db.SetPayrollRunStatus(run.ID, []string{"draft"}, "cancelled", db.M{
+			"cancelled_at": now,
+			"cancelled_by": userID,
+		}); err != nil {
+			panic(err)
+		}
+
+		if err := db.ReleasePayrollRun(run.ID); err != nil {
+			panic(err)
+		}
+
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"errors": errs,
+		})
+		return
+	}
+
+	set := db.M{
+		"lines": run.Lines,
+		"total": run.Total,
+	}
+
+	if config.Config.Payroll.TwoPersonRule {
+		if err := db.SetPayrollRunStatus(run.ID, []string{"draft"}, "draft", set); err != nil {
+			panic(err)
+		}
+
+		syrup.WriteJSON(w, http.StatusAccepted, run)
+		return
+	}
+
+	set["approved_at"] = now
+	set["approved_by"] = userID
+	if err := db.SetPayrollRunStatus(run.ID, []string{"draft"}, "approved", set); err != nil {
 		panic(err)
 	}
+
+	executePayrollRun(w, r, *run)
 }
@@ -0,0 +1,340 @@
+package api
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/maple-ai/fleet-api/config"
+	"github.com/maple-ai/fleet-api/db"
+	"github.com/maple-ai/fleet-api/payout"
+	"github.com/maple-ai/syrup"
+	mgo "gopkg.in/mgo.v2"
+)
+
+// paidLine is a driver's line paid by a payroll run
+type paidLine struct {
+	Run  db.PayrollRun
+	Line db.PayrollLine
+}
+
+// payrollJournal is what a run paid on a day, balanced:
+// Gross + Adjustments + BroughtForward + Unrecovered = Total + FuelCharges + FineTotal
+type payrollJournal struct {
+	Number    string
+	Date      time.Time
+	Narration string
+
+	Gross       int64
+	Adjustments int64
+	// shortfalls from earlier runs recovered, owed by drivers so against debtors rather than adjustments
+	BroughtForward int64
+	Unrecovered    int64
+	Total          int64
+	FuelCharges    int64
+	FineTotal      int64
+}
+
+// journalEntry moves an amount in pence into an account: positive debits, negative credits
+type journalEntry struct {
+	Account string
+	Amount  int64
+}
+
+// contractorSummary is a driver's pay over a tax year, for their self assessment
+type contractorSummary struct {
+	UserID            string `json:"user_id"`
+	Name              string `json:"name"`
+	Email             string `json:"email"`
+	Address           string `json:"address"`
+	Postcode          string `json:"postcode"`
+	UTR               string `json:"utr"`
+	NationalInsurance string `json:"national_insurance"`
+
+	Shifts      int   `json:"shifts"`
+	Gross       int64 `json:"gross"`
+	FuelCharges int64 `json:"fuel_charges"`
+	FineTotal   int64 `json:"fine_total"`
+	Adjustments int64 `json:"adjustments"`
+	Total       int64 `json:"total"`
+}
+
+// adminExportPayrollRun exports the lines paid by the run, ?format=csv (default), xero or quickbooks
+func adminExportPayrollRun(w http.ResponseWriter, r *http.Request) {
+	run := context.Get(r, "payroll_run").(db.PayrollRun)
+	writePayrollExport(w, r, "payroll-"+run.ID.Hex(), paidLines([]db.PayrollRun{run}, time.Time{}, time.Time{}))
+}
+
+// adminExportPayroll exports lines paid ?from=&to= (dd-mm-yyyy), ?format=csv (default), xero or quickbooks
+func adminExportPayroll(w http.ResponseWriter, r *http.Request) {
+	from, to := reportPeriod(r)
+
+	var runs []db.PayrollRun
+	if err := db.Cols.PayrollRuns.Find(db.M{
+		"lines": db.M{"$elemMatch": db.M{
+			"payout_status": payout.StatusSuccess,
+			"paid_at":       db.M{"$gte": from, "$lt": to},
+		}},
+	}).Sort("_id").All(&runs); err != nil {
+		panic(err)
+	}
+
+	name := "payroll-" + from.Format("2006-01-02") + "-" + to.AddDate(0, 0, -1).Format("2006-01-02")
+	writePayrollExport(w, r, name, paidLines(runs, from, to))
+}
+
+// adminGetTaxYearSummary totals each driver's pay in the tax year starting 6 April of {year}, JSON or ?format=csv
+func adminGetTaxYearSummary(w http.ResponseWriter, r *http.Request) {
+	year, err := strconv.Atoi(mux.Vars(r)["year"])
+	if err != nil || year < 2000 {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Tax year must be the year it starts, e.g. 2024 for 2024-25",
+		})
+		return
+	}
+
+	from := time.Date(year, time.April, 6, 0, 0, 0, 0, time.Local)
+	to := from.AddDate(1, 0, 0)
+
+	var runs []db.PayrollRun
+	if err := db.Cols.PayrollRuns.Find(db.M{
+		"lines": db.M{"$elemMatch": db.M{
+			"payout_status": payout.StatusSuccess,
+			"paid_at":       db.M{"$gte": from, "$lt": to},
+		}},
+	}).Sort("_id").All(&runs); err != nil {
+		panic(err)
+	}
+
+	summaries := []*contractorSummary{}
+	byUser := map[string]*contractorSummary{}
+	for _, paid := range paidLines(runs, from, to) {
+		summary, ok := byUser[paid.Line.UserID.Hex()]
+		if !ok {
+			summary = &contractorSummary{UserID: paid.Line.UserID.Hex(), Name: paid.Line.Name}
+
+			var user db.User
+			if err := db.Cols.Users.FindId(paid.Line.UserID).One(&user); err != nil && err != mgo.ErrNotFound {
+				panic(err)
+			}
+			summary.Email = user.Email
+
+			var membership db.UserMembership
+			if err := db.Cols.Memberships.Find(db.M{"user_id": paid.Line.UserID}).One(&membership); err != nil && err != mgo.ErrNotFound {
+				panic(err)
+			}
+			summary.Address = membership.Address
+			summary.Postcode = membership.Postcode
+			summary.UTR = membership.UTR
+			summary.NationalInsurance = membership.NationalInsurance
+
+			byUser[summary.UserID] = summary
+			summaries = append(summaries, summary)
+		}
+
+		for _, shift := range paid.Line.Shifts {
+			if !shift.Removed {
+				summary.Shifts++
+			}
+		}
+		summary.Gross += paid.Line.Gross
+		summary.FuelCharges += paid.Line.FuelCharges
+		summary.FineTotal += paid.Line.FineTotal
+		summary.Adjustments += paid.Line.AdjustmentTotal
+		summary.Total += paid.Line.Total
+	}
+
+	sort.SliceStable(summaries, func(i, j int) bool {
+		return summaries[i].Name < summaries[j].Name
+	})
+
+	if r.URL.Query().Get("format") != "csv" {
+		syrup.WriteJSON(w, http.StatusOK, summaries)
+		return
+	}
+
+	rows := [][]string{{
+		"Driver", "Email", "Address", "Postcode", "UTR", "National Insurance",
+		"Shifts", "Gross", "Fuel charges", "Fines", "Adjustments", "Total paid",
+	}}
+	for _, summary := range summaries {
+		rows = append(rows, []string{
+			summary.Name, summary.Email, summary.Address, summary.Postcode, summary.UTR, summary.NationalInsurance,
+			strconv.Itoa(summary.Shifts), penceString(summary.Gross), penceString(summary.FuelCharges),
+			penceString(summary.FineTotal), penceString(summary.Adjustments), penceString(summary.Total),
+		})
+	}
+
+	writeCSV(w, fmt.Sprintf("contractors-%d-%02d", year, (year+1)%100), rows)
+}
+
+// paidLines picks the paid lines from runs, those paid in from and to unless they're zero, in run order
+func paidLines(runs []db.PayrollRun, from time.Time, to time.Time) []paidLine {
+	lines := []paidLine{}
+	for _, run := range runs {
+		for _, line := range run.Lines {
+			if line.PayoutStatus != payout.StatusSuccess {
+				continue
+			}
+			if !from.IsZero() && (line.PaidAt.Before(from) || !line.PaidAt.Before(to)) {
+				continue
+			}
+
+			lines = append(lines, paidLine{Run: run, Line: line})
+		}
+	}
+
+	return lines
+}
+
+// payrollJournals totals lines into a journal per run and day paid
+func payrollJournals(lines []paidLine) []*payrollJournal {
+	journals := []*payrollJournal{}
+	byKey := map[string]*payrollJournal{}
+	for _, paid := range lines {
+		date := paid.Line.PaidAt.Local()
+		key := paid.Run.ID.Hex() + date.Format("20060102")
+
+		journal, ok := byKey[key]
+		if !ok {
+			journal = &payrollJournal{
+				Number:    "PR-" + paid.Run.ID.Hex()[16:] + "-" + date.Format("0102"),
+				Date:      date,
+				Narration: "Payroll run " + paid.Run.ID.Hex() + " for " + paid.Run.From.Format("02/01/2006") + " to " + paid.Run.To.Format("02/01/2006"),
+			}
+			byKey[key] = journal
+			journals = append(journals, journal)
+		}
+
+		journal.Gross += paid.Line.Gross
+		for _, adjustment := range paid.Line.Adjustments {
+			if adjustment.Type == "brought_forward" {
+				journal.BroughtForward += adjustment.Amount
+			} else {
+				journal.Adjustments += adjustment.Amount
+			}
+		}
+		journal.Unrecovered += paid.Line.Unrecovered
+		journal.Total += paid.Line.Total
+		journal.FuelCharges += paid.Line.FuelCharges
+		journal.FineTotal += paid.Line.FineTotal
+	}
+
+	return journals
+}
+
+// entries are the journal's account movements, positive debits and negative credits, zeros left out
+func (journal payrollJournal) entries() []journalEntry {
+	accounts := config.Config.Payroll.Accounts
+	all := []journalEntry{
+		{accounts.Pay, journal.Gross},
+		{accounts.Adjustments, journal.Adjustments},
+		{accounts.Debtors, journal.BroughtForward},
+		{accounts.Debtors, journal.Unrecovered},
+		{accounts.Fuel, -journal.FuelCharges},
+		{accounts.Fines, -journal.FineTotal},
+		{accounts.Bank, -journal.Total},
+	}
+
+	entries := []journalEntry{}
+	for _, entry := range all {
+		if entry.Amount != 0 {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+}
+
+func writePayrollExport(w http.ResponseWriter, r *http.Request, name string, lines []paidLine) {
+	rows := [][]string{}
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "csv":
+		rows = append(rows, []string{
+			"Payroll run", "From", "To", "Paid", "Driver ID", "Driver", "Shifts", "Gross", "Fuel charges", "Fines",
+			"Adjustments", "Not recovered", "Total", "PayPal email", "Payout transaction",
+		})
+
+		for _, paid := range lines {
+			shifts := 0
+			for _, shift := range paid.Line.Shifts {
+				if !shift.Removed {
+					shifts++
+				}
+			}
+
+			rows = append(rows, []string{
+				paid.Run.ID.Hex(), paid.Run.From.Format("02/01/2006"), paid.Run.To.Format("02/01/2006"),
+				paid.Line.PaidAt.Local().Format("02/01/2006"), paid.Line.UserID.Hex(), paid.Line.Name, strconv.Itoa(shifts),
+				penceString(paid.Line.Gross), penceString(paid.Line.FuelCharges), penceString(paid.Line.FineTotal),
+				penceString(paid.Line.AdjustmentTotal), penceString(paid.Line.Unrecovered), penceString(paid.Line.Total),
+				paid.Line.PaypalEmail, paid.Line.TransactionID,
+			})
+		}
+	case "xero":
+		// manual journal import
+		rows = append(rows, []string{
+			"*Narration", "*Date", "Description", "*AccountCode", "*TaxRate", "*Amount",
+			"TrackingName1", "TrackingOption1", "TrackingName2", "TrackingOption2",
+		})
+
+		for _, journal := range payrollJournals(lines) {
+			for _, entry := range journal.entries() {
+				rows = append(rows, []string{
+					journal.Narration, journal.Date.Format("02/01/2006"), journal.Number, entry.Account, "No VAT",
+					penceString(entry.Amount), "", "", "", "",
+				})
+			}
+		}
+		name += "-xero"
+	case "quickbooks":
+		// journal entry import
+		rows = append(rows, []string{"Journal No", "Journal Date", "Account Name", "Debits", "Credits", "Description"})
+
+		for _, journal := range payrollJournals(lines) {
+			for _, entry := range journal.entries() {
+				debit, credit := "", ""
+				if entry.Amount > 0 {
+					debit = penceString(entry.Amount)
+				} else {
+					credit = penceString(-entry.Amount)
+				}
+
+				rows = append(rows, []string{
+					journal.Number, journal.Date.Format("02/01/2006"), entry.Account, debit, credit, journal.Narration,
+				})
+			}
+		}
+		name += "-quickbooks"
+	default:
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Unknown format " + format + ", use csv, xero or quickbooks",
+		})
+		return
+	}
+
+	writeCSV(w, name, rows)
+}
+
+func writeCSV(w http.ResponseWriter, name string, rows [][]string) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+name+".csv\"")
+
+	writer := csv.NewWriter(w)
+	writer.WriteAll(rows)
+}
+
+// penceString formats pence as pounds without a currency sign, e.g. -12.50
+func penceString(pence int64) string {
+	sign := ""
+	if pence < 0 {
+		sign, pence = "-", -pence
+	}
+
+	return fmt.Sprintf("%s%d.%02d", sign, pence/100, pence%100)
+}
@@ -0,0 +1,345 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/maple-ai/fleet-api/config"
+	"github.com/maple-ai/fleet-api/db"
+	"github.com/maple-ai/fleet-api/payout"
+	"github.com/maple-ai/syrup"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func adminPayrollRunMiddleware(w http.ResponseWriter, r *http.Request) {
+	runID := mux.Vars(r)["run_id"]
+	if !bson.IsObjectIdHex(runID) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var run db.PayrollRun
+	if err := db.Cols.PayrollRuns.FindId(bson.ObjectIdHex(runID)).One(&run); err == mgo.ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	context.Set(r, "payroll_run", run)
+}
+
+// adminGetPayrollRuns lists runs, newest first. Filter with ?status=
+func adminGetPayrollRuns(w http.ResponseWriter, r *http.Request) {
+	q := db.M{}
+	if status := r.URL.Query().Get("status"); len(status) > 0 {
+		q["status"] = status
+	}
+
+	runs := []db.PayrollRun{}
+	if err := db.Cols.PayrollRuns.Find(q).Sort("-created").Limit(100).All(&runs); err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, runs)
+}
+
+func adminGetPayrollRun(w http.ResponseWriter, r *http.Request) {
+	syrup.WriteJSON(w, http.StatusOK, context.Get(r, "payroll_run").(db.PayrollRun))
+}
+
+// adminCreatePayrollRun drafts a run for completed, unpaid shifts dated from and to (dd-mm-yyyy, inclusive)
+func adminCreatePayrollRun(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	if err := syrup.Bind(w, r, &body); err != nil {
+		return
+	}
+
+	from, errFrom := time.ParseInLocation("02-01-2006", body.From, time.Local)
+	to, errTo := time.ParseInLocation("02-01-2006", body.To, time.Local)
+	if errFrom != nil || errTo != nil || to.Before(from) {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "from and to must be dd-mm-yyyy, to not before from",
+		})
+		return
+	}
+
+	run, err := db.NewPayrollRun(db.M{
+		"date": db.M{"$gte": from, "$lt": to.AddDate(0, 0, 1)},
+	}, from, to, context.Get(r, "userID").(bson.ObjectId))
+	if err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusCreated, run)
+}
+
+// adminUpdatePayrollShift changes what a shift in a draft run pays: amount (pence) needs an
+// override_reason when it differs from the calculated pay, or removed to not pay it
+func adminUpdatePayrollShift(w http.ResponseWriter, r *http.Request) {
+	run := context.Get(r, "payroll_run").(db.PayrollRun)
+
+	var body struct {
+		Amount         int64  `json:"amount"`
+		OverrideReason string `json:"override_reason"`
+		Removed        bool   `json:"removed"`
+	}
+	if err := syrup.Bind(w, r, &body); err != nil {
+		return
+	}
+
+	if run.Status != "draft" {
+		syrup.WriteJSON(w, http.StatusConflict, map[string]string{
+			"error": "Only draft payroll runs can be changed",
+		})
+		return
+	}
+
+	shift := findPayrollShift(&run, bson.ObjectIdHex(mux.Vars(r)["shift_id"]))
+	if shift == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err := setPayrollShift(shift, body.Amount, body.OverrideReason, body.Removed); err != nil {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	run.UpdateTotals()
+	run.UpdatedAt = time.Now()
+	run.UpdatedBy = context.Get(r, "userID").(bson.ObjectId)
+	if err := db.SetPayrollRunStatus(run.ID, []string{"draft"}, "draft", db.M{
+		"lines":      run.Lines,
+		"total":      run.Total,
+		"updated_at": run.UpdatedAt,
+		"updated_by": run.UpdatedBy,
+	}); err == db.ErrPayrollRunStatus {
+		w.WriteHeader(http.StatusConflict)
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, run)
+}
+
+// adminApprovePayrollRun approves a draft run. With the two person rule the approver can't be the admin who drafted it
+// or last changed it.
+func adminApprovePayrollRun(w http.ResponseWriter, r *http.Request) {
+	run := context.Get(r, "payroll_run").(db.PayrollRun)
+	userID := context.Get(r, "userID").(bson.ObjectId)
+
+	if config.Config.Payroll.TwoPersonRule && (run.CreatedBy == userID || run.UpdatedBy == userID) {
+		syrup.WriteJSON(w, http.StatusForbidden, map[string]string{
+			"error": "Payroll runs must be approved by another admin",
+		})
+		return
+	}
+
+	if errs := payrollRunErrors(&run); len(errs) > 0 {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"errors": errs,
+		})
+		return
+	}
+
+	if err := db.SetPayrollRunStatus(run.ID, []string{"draft"}, "approved", db.M{
+		"approved_at": time.Now(),
+		"approved_by": userID,
+	}); err == db.ErrPayrollRunStatus {
+		syrup.WriteJSON(w, http.StatusConflict, map[string]string{
+			"error": "Only draft payroll runs can be approved",
+		})
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminExecutePayrollRun pays an approved run, or retries a failed one for the drivers who weren't paid
+func adminExecutePayrollRun(w http.ResponseWriter, r *http.Request) {
+	run := context.Get(r, "payroll_run").(db.PayrollRun)
+	executePayrollRun(w, r, run)
+}
+
+// adminCancelPayrollRun cancels a run which hasn't been executed, releasing its shifts and fines
+func adminCancelPayrollRun(w http.ResponseWriter, r *http.Request) {
+	run := context.Get(r, "payroll_run").(db.PayrollRun)
+	if err := db.SetPayrollRunStatus(run.ID, []string{"draft", "approved"}, "cancelled", db.M{
+		"cancelled_at": time.Now(),
+		"cancelled_by": context.Get(r, "userID"),
+	}); err == db.ErrPayrollRunStatus {
+		syrup.WriteJSON(w, http.StatusConflict, map[string]string{
+			"error": "Only draft or approved payroll runs can be cancelled",
+		})
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	if err := db.ReleasePayrollRun(run.ID); err != nil {
+		panic(err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminPayPayrollLineByHand records a driver in a failed run as paid outside the payout provider, with a reference
+// such as the provider's transaction ID. For when the provider paid a batch the run couldn't record.
+func adminPayPayrollLineByHand(w http.ResponseWriter, r *http.Request) {
+	run := context.Get(r, "payroll_run").(db.PayrollRun)
+
+	var body struct {
+		Reference string `json:"reference"`
+	}
+	if err := syrup.Bind(w, r, &body); err != nil {
+		return
+	}
+
+	if len(body.Reference) == 0 {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Reference cannot be empty",
+		})
+		return
+	}
+
+	if run.Status != "failed" {
+		syrup.WriteJSON(w, http.StatusConflict, map[string]string{
+			"error": "Only drivers in failed payroll runs can be marked paid by hand",
+		})
+		return
+	}
+
+	line := -1
+	for i := range run.Lines {
+		if run.Lines[i].UserID.Hex() == mux.Vars(r)["user_id"] {
+			line = i
+		}
+	}
+
+	if line < 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if run.Lines[line].PayoutStatus == payout.StatusSuccess {
+		syrup.WriteJSON(w, http.StatusConflict, map[string]string{
+			"error": "Driver is already paid",
+		})
+		return
+	}
+
+	if err := db.PayPayrollLineByHand(&run, line, body.Reference, context.Get(r, "userID").(bson.ObjectId)); err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, run)
+}
+
+// executePayrollRun pays drivers through the payout provider, or records them paid by hand when there isn't one.
+// Replies 202 while payouts are still settling.
+func executePayrollRun(w http.ResponseWriter, r *http.Request, run db.PayrollRun) {
+	userID := context.Get(r, "userID").(bson.ObjectId)
+	if err := db.ClaimPayrollRunExecution(run.ID, userID); err == db.ErrPayrollRunStatus {
+		syrup.WriteJSON(w, http.StatusConflict, map[string]string{
+			"error": "Only approved or failed payroll runs can be executed",
+		})
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	if err := db.ExecutePayrollRun(&run, config.Payouts, userID); err != nil {
+		if err := db.SetPayrollRunStatus(run.ID, []string{"executing"}, "failed", db.M{"error": err.Error()}); err != nil {
+			panic(err)
+		}
+
+		syrup.WriteJSON(w, http.StatusInternalServerError, map[string]string{
+			"error": "Payroll run failed, it can be executed again: " + err.Error(),
+		})
+		return
+	}
+
+	if err := db.Cols.PayrollRuns.FindId(run.ID).One(&run); err != nil {
+		panic(err)
+	}
+
+	status := http.StatusOK
+	if run.Status == "paying" {
+		status = http.StatusAccepted
+	}
+
+	syrup.WriteJSON(w, status, run)
+}
+
+// payrollRunErrors lists what stops a run being approved: shifts without pay, or drivers the provider can't pay
+func payrollRunErrors(run *db.PayrollRun) []string {
+	errs := []string{}
+	for _, shiftID := range run.Unresolved() {
+		errs = append(errs, shiftID.Hex()+": pay could not be calculated, set an amount with a reason or remove the shift")
+	}
+
+	if config.Payouts != nil {
+		for _, line := range run.Lines {
+			if line.Total > 0 && len(line.PaypalEmail) == 0 {
+				errs = append(errs, line.Name+" has no PayPal email")
+			}
+		}
+	}
+
+	return errs
+}
+
+func findPayrollShift(run *db.PayrollRun, shiftID bson.ObjectId) *db.PayrollShift {
+	for i := range run.Lines {
+		for j := range run.Lines[i].Shifts {
+			if run.Lines[i].Shifts[j].ShiftID == shiftID {
+				return &run.Lines[i].Shifts[j]
+			}
+		}
+	}
+
+	return nil
+}
+
+// setPayrollShift applies a payout decision to a shift in a run
+func setPayrollShift(shift *db.PayrollShift, amount int64, reason string, removed bool) error {
+	shift.Removed = removed
+	shift.OverrideReason = reason
+	if removed {
+		shift.Amount = 0
+		return nil
+	}
+
+	if shift.Pay == nil {
+		if len(reason) == 0 {
+			return fmt.Errorf("%s: %s", shift.ShiftID.Hex(), shift.PayError)
+		}
+	} else if amount != shift.Pay.Total && len(reason) == 0 {
+		return fmt.Errorf("%s: total £%.2f does not match calculated pay £%.2f",
+			shift.ShiftID.Hex(), float64(amount)/100, float64(shift.Pay.Total)/100)
+	}
+
+	if amount < 0 {
+		return fmt.Errorf("%s: amount cannot be negative", shift.ShiftID.Hex())
+	}
+
+	shift.Amount = amount
+	return nil
+}
+
+// poundsToPence rounds an amount in pounds sent by older clients
+func poundsToPence(pounds float32) int64 {
+	return int64(math.Floor(float64(pounds)*100 + 0.5))
+}
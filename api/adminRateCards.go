@@ -0,0 +1,119 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/maple-ai/fleet-api/db"
+	"github.com/maple-ai/syrup"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func adminGetRateCards(w http.ResponseWriter, r *http.Request) {
+	cards := []db.RateCard{}
+	if err := db.Cols.RateCards.Find(db.M{}).Sort("garage_id", "grade").All(&cards); err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, cards)
+}
+
+// adminSaveRateCard creates (POST) or replaces (PUT) a rate card, one per garage and grade
+func adminSaveRateCard(w http.ResponseWriter, r *http.Request) {
+	var card db.RateCard
+	if err := syrup.Bind(w, r, &card); err != nil {
+		return
+	}
+
+	errs := []string{}
+	if len(card.Name) == 0 {
+		errs = append(errs, "Name cannot be empty")
+	}
+	if card.HourlyRate <= 0 {
+		errs = append(errs, "Hourly rate must be above zero")
+	}
+	if card.WeekendMultiplier < 0 || card.NightMultiplier < 0 || card.HolidayMultiplier < 0 {
+		errs = append(errs, "Multipliers cannot be negative")
+	}
+	if card.NightStart < 0 || card.NightStart > 23 || card.NightEnd < 0 || card.NightEnd > 23 {
+		errs = append(errs, "Night start and end must be hours from 0 to 23")
+	}
+	if card.MinimumPay < 0 || card.BikeHire < 0 {
+		errs = append(errs, "Minimum pay and bike hire cannot be negative")
+	}
+	for _, day := range card.Holidays {
+		if _, err := time.Parse("02-01-2006", day); err != nil {
+			errs = append(errs, "Holidays must be dd-mm-yyyy")
+			break
+		}
+	}
+
+	if len(errs) > 0 {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"errors": errs,
+		})
+		return
+	}
+
+	if r.Method == "PUT" {
+		card.ID = bson.ObjectIdHex(mux.Vars(r)["rate_card_id"])
+	}
+
+	// only one card may apply to a garage and grade
+	garage := interface{}(nil)
+	if card.GarageID.Valid() {
+		garage = card.GarageID
+	}
+	existing := db.M{"garage_id": garage, "grade": card.Grade}
+	if card.ID.Valid() {
+		existing["_id"] = db.M{"$ne": card.ID}
+	}
+	if n, err := db.Cols.RateCards.Find(existing).Count(); err != nil {
+		panic(err)
+	} else if n > 0 {
+		syrup.WriteJSON(w, http.StatusConflict, map[string]string{
+			"error": "A rate card already exists for this garage and grade",
+		})
+		return
+	}
+
+	if r.Method == "POST" {
+		card.ID = bson.NewObjectId()
+		card.Created = time.Now()
+		card.CreatedBy = context.Get(r, "userID").(bson.ObjectId)
+
+		if err := db.Cols.RateCards.Insert(&card); err != nil {
+			panic(err)
+		}
+
+		syrup.WriteJSON(w, http.StatusCreated, card)
+		return
+	}
+
+	var original db.RateCard
+	if err := db.Cols.RateCards.FindId(card.ID).One(&original); err == mgo.ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	card.Created = original.Created
+	card.CreatedBy = original.CreatedBy
+	if err := db.Cols.RateCards.UpdateId(card.ID, card); err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, card)
+}
+
+func adminDeleteRateCard(w http.ResponseWriter, r *http.Request) {
+	if err := db.Cols.RateCards.RemoveId(bson.ObjectIdHex(mux.Vars(r)["rate_card_id"])); err != nil {
+		panic(err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
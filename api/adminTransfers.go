@@ -0,0 +1,215 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/maple-ai/fleet-api/db"
+	"github.com/maple-ai/syrup"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// adminTransferBike moves a bike to another garage now, or schedules it for a later date.
+// Upcoming shifts on the bike at the old garage are reported with a free bike they could move to,
+// and moved when `reassign` is set. `dry_run` only reports.
+func adminTransferBike(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		GarageID bson.ObjectId `json:"garage_id"`
+		Date     time.Time     `json:"date"`
+		Reason   string        `json:"reason"`
+		Reassign bool          `json:"reassign"`
+		DryRun   bool          `json:"dry_run"`
+	}
+	if err := syrup.Bind(w, r, &body); err != nil {
+		return
+	}
+
+	bike := context.Get(r, "bike").(db.Bike)
+	errs := []string{}
+
+	if garage, err := db.FindGarageByID(body.GarageID); err != nil {
+		panic(err)
+	} else if garage == nil {
+		errs = append(errs, "Garage does not exist")
+	} else if garage.ID == bike.GarageID {
+		errs = append(errs, "Bike is already at this garage")
+	}
+
+	if bike.Retired() {
+		errs = append(errs, "Bike is archived")
+	}
+
+	if count, err := db.Cols.Transfers.Find(db.M{
+		"bike_id": bike.ID,
+		"status":  "scheduled",
+	}).Count(); err != nil {
+		panic(err)
+	} else if count > 0 {
+		errs = append(errs, "Bike already has a scheduled transfer")
+	}
+
+	if len(errs) > 0 {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"errors": errs,
+		})
+		return
+	}
+
+	now := time.Now()
+	if body.Date.Before(now) {
+		body.Date = now
+	}
+
+	transfer := db.BikeTransfer{
+		ID:             bson.NewObjectId(),
+		BikeID:         bike.ID,
+		FromGarageID:   bike.GarageID,
+		ToGarageID:     body.GarageID,
+		Reason:         body.Reason,
+		Effective:      body.Date,
+		Status:         "scheduled",
+		AffectedShifts: []db.TransferredShift{},
+		Created:        now,
+		CreatedBy:      context.Get(r, "userID").(bson.ObjectId),
+	}
+
+	shifts, err := db.FindTransferAffectedShifts(bike, transfer.Effective)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, shift := range shifts {
+		affected := db.TransferredShift{
+			ShiftID: shift.ID,
+			UserID:  shift.UserID,
+			Date:    shift.Date,
+		}
+
+		for _, candidate := range db.GetAvailableScooters(bike.GarageID, shift.Date, membershipMaxCC(shift.UserID)) {
+			if candidate.ID != bike.ID {
+				affected.NewBikeID = candidate.ID
+				break
+			}
+		}
+
+		if body.Reassign && !body.DryRun && affected.NewBikeID.Valid() {
+			if err := reassignShiftBike(shift, affected.NewBikeID, false, transfer.CreatedBy); err != nil {
+				panic(err)
+			}
+
+			affected.Reassigned = true
+		}
+
+		transfer.AffectedShifts = append(transfer.AffectedShifts, affected)
+	}
+
+	if body.DryRun {
+		syrup.WriteJSON(w, http.StatusOK, transfer)
+		return
+	}
+
+	if err := db.Cols.Transfers.Insert(&transfer); err != nil {
+		panic(err)
+	}
+
+	if !transfer.Effective.After(now) {
+		if err := db.CompleteBikeTransfer(transfer); err != nil {
+			panic(err)
+		}
+
+		transfer.Status = "complete"
+		transfer.CompletedAt = now
+	}
+
+	syrup.WriteJSON(w, http.StatusCreated, transfer)
+}
+
+func adminGetBikeTransfers(w http.ResponseWriter, r *http.Request) {
+	var transfers []db.BikeTransfer
+	if err := db.Cols.Transfers.Find(db.M{
+		"bike_id": context.Get(r, "bike").(db.Bike).ID,
+	}).Sort("-effective").All(&transfers); err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, transfers)
+}
+
+func adminCancelBikeTransfer(w http.ResponseWriter, r *http.Request) {
+	if err := db.Cols.Transfers.Update(db.M{
+		"_id":    bson.ObjectIdHex(mux.Vars(r)["transfer_id"]),
+		"status": "scheduled",
+	}, db.M{"$set": db.M{"status": "cancelled"}}); err == mgo.ErrNotFound {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Only scheduled transfers can be cancelled",
+		})
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminGetGarageFleet reports which bikes were at the garage over a period (default last 30 days)
+// with bike-days and completed shifts for utilisation
+func adminGetGarageFleet(w http.ResponseWriter, r *http.Request) {
+	garage := context.Get(r, "garage").(db.Garage)
+
+	to := time.Now()
+	from := to.AddDate(0, 0, -30)
+	if date, err := time.Parse("02-01-2006", r.URL.Query().Get("from")); err == nil {
+		from = date
+	}
+	if date, err := time.Parse("02-01-2006", r.URL.Query().Get("to")); err == nil {
+		to = date.Add(24 * time.Hour)
+	}
+
+	history, err := db.GarageFleetHistory(garage.ID)
+	if err != nil {
+		panic(err)
+	}
+
+	stays := []db.GarageStay{}
+	bikeDays := 0.0
+	for _, stay := range history {
+		arrived, left := stay.Arrived, stay.Left
+		if left.IsZero() || left.After(to) {
+			left = to
+		}
+		if arrived.Before(from) {
+			arrived = from
+		}
+
+		if left.After(arrived) {
+			stays = append(stays, stay)
+			bikeDays += left.Sub(arrived).Hours() / 24
+		}
+	}
+
+	shifts, err := db.Cols.Shifts.Find(db.M{
+		"garage_id": garage.ID,
+		"status":    "complete",
+		"date":      db.M{"$gte": from, "$lt": to},
+	}).Count()
+	if err != nil {
+		panic(err)
+	}
+
+	utilisation := 0.0
+	if bikeDays > 0 {
+		utilisation = float64(shifts) / bikeDays
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"from":        from,
+		"to":          to,
+		"stays":       stays,
+		"bike_days":   bikeDays,
+		"shifts":      shifts,
+		"utilisation": utilisation,
+	})
+}
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"image"
+	"image/color"
+	_ "image/gif" // register decoders for thumbnails
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/maple-ai/syrup"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// writeGridFile copies an uploaded multipart file into GridFS, returning the new file ID and size
+func writeGridFile(gridFS *mgo.GridFS, name string, f *multipart.FileHeader) (bson.ObjectId, int64, error) {
+	return writeGridFileAs(gridFS, name, f, f.Header.Get("content-type"))
+}
+
+// writeGridFileAs is writeGridFile with the content type given rather than taken from the upload
+func writeGridFileAs(gridFS *mgo.GridFS, name string, f *multipart.FileHeader, contentType string) (bson.ObjectId, int64, error) {
+	file, err := f.Open()
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	gridFile, err := gridFS.Create(name)
+	if err != nil {
+		return "", 0, err
+	}
+
+	gridFile.SetContentType(contentType)
+	gridFile.SetMeta(map[string]string{
+		"name": f.Filename,
+	})
+
+	size, err := io.Copy(gridFile, file)
+	if err != nil {
+		gridFile.Abort()
+		gridFile.Close()
+		return "", 0, err
+	}
+
+	return gridFile.Id().(bson.ObjectId), size, gridFile.Close()
+}
+
+// serveGridFile writes a GridFS file by ID, 404 if missing
+func serveGridFile(w http.ResponseWriter, gridFS *mgo.GridFS, fileID bson.ObjectId) {
+	file, err := gridFS.OpenId(fileID)
+	if err != nil && err != mgo.ErrNotFound {
+		panic(err)
+	} else if err == mgo.ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("content-type", file.ContentType())
+
+	var meta map[string]string
+	if err := file.GetMeta(&meta); err == nil && len(meta["name"]) > 0 {
+		w.Header().Set("content-disposition", "attachment; filename=\""+meta["name"]+"\"")
+	}
+
+	io.Copy(w, file)
+}
+
+// uploadedFile returns the multipart "file" field or writes 400
+func uploadedFile(w http.ResponseWriter, r *http.Request, maxMemory int64) *multipart.FileHeader {
+	if err := r.ParseMultipartForm(maxMemory); err != nil || len(r.MultipartForm.File["file"]) == 0 {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "No file uploaded",
+		})
+		return nil
+	}
+
+	return r.MultipartForm.File["file"][0]
+}
+
+// sniffUpload detects an uploaded file's content type from its first bytes
+func sniffUpload(f *multipart.FileHeader) (string, error) {
+	file, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// writeGridThumbnail stores a JPEG thumbnail of an uploaded image, scaled to fit within size pixels
+func writeGridThumbnail(gridFS *mgo.GridFS, name string, f *multipart.FileHeader, size int) (bson.ObjectId, error) {
+	file, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	src, _, err := image.Decode(file)
+	if err != nil {
+		return "", err
+	}
+
+	gridFile, err := gridFS.Create(name)
+	if err != nil {
+		return "", err
+	}
+
+	gridFile.SetContentType("image/jpeg")
+	if err := jpeg.Encode(gridFile, thumbnail(src, size), &jpeg.Options{Quality: 80}); err != nil {
+		gridFile.Abort()
+		gridFile.Close()
+		return "", err
+	}
+
+	return gridFile.Id().(bson.ObjectId), gridFile.Close()
+}
+
+// thumbnail scales an image down to fit within size pixels, averaging the source pixels under each output pixel
+func thumbnail(src image.Image, size int) image.Image {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= size && height <= size {
+		return src
+	}
+
+	dstWidth, dstHeight := size, height*size/width
+	if height > width {
+		dstWidth, dstHeight = width*size/height, size
+	}
+	if dstWidth < 1 {
+		dstWidth = 1
+	}
+	if dstHeight < 1 {
+		dstHeight = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		y0, y1 := bounds.Min.Y+y*height/dstHeight, bounds.Min.Y+(y+1)*height/dstHeight
+		for x := 0; x < dstWidth; x++ {
+			x0, x1 := bounds.Min.X+x*width/dstWidth, bounds.Min.X+(x+1)*width/dstWidth
+
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, b, a, n = r+pr, g+pg, b+pb, a+pa, n+1
+				}
+			}
+
+			dst.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(b / n), uint16(a / n)})
+		}
+	}
+
+	return dst
+}
@@ -1,48 +1,260 @@
 package api
 
 import (
-	"io"
+	"fmt"
+	"math"
 	"net/http"
-	"net/url"
 	"strconv"
+	"time"
 
+	"github.com/gorilla/context"
 	"github.com/gorilla/mux"
-	"gopkg.in/mgo.v2/bson"
 	"github.com/maple-ai/fleet-api/config"
 	"github.com/maple-ai/fleet-api/db"
+	"github.com/maple-ai/fleet-api/tracker"
+	"github.com/maple-ai/syrup"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	positionsPageSize    = 500
+	positionsMaxPageSize = 5000
+	positionsMaxRange    = 31 * 24 * time.Hour
 )
 
+// adminGetGPSPositions serves the shift's route from stored positions, with the tracker's field names
+// (fixTime, deviceId...) unless ?v=2. Paged with ?page= (from 1) and ?limit=, the total is in the X-Total-Count header.
+// With ?format= or an Accept header for GPX, KML or GeoJSON the whole route is exported instead.
 func adminGetGPSPositions(w http.ResponseWriter, r *http.Request) {
 	var shift db.Shift
 	if err := db.Cols.Shifts.FindId(bson.ObjectIdHex(mux.Vars(r)["shift_id"])).One(&shift); err != nil {
 		panic(err)
 	}
 
+	if shift.CheckIn.IsZero() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	to := shift.CheckOut
+	if to.IsZero() {
+		to = time.Now()
+	}
+
+	writePositions(w, r, shift.ScooterID, shift.CheckIn, to, "shift-"+shift.ID.Hex(), r.URL.Query().Get("v") != "2")
+}
+
+// adminGetBikePositions serves a bike's positions between ?from= and ?to= (RFC 3339, at most 31 days apart),
+// paged or exported as adminGetGPSPositions
+func adminGetBikePositions(w http.ResponseWriter, r *http.Request) {
+	bike := context.Get(r, "bike").(db.Bike)
+
+	from, errFrom := time.Parse(time.RFC3339, r.URL.Query().Get("from"))
+	to, errTo := time.Parse(time.RFC3339, r.URL.Query().Get("to"))
+	if errFrom != nil || errTo != nil {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "from and to must be RFC 3339 times",
+		})
+		return
+	}
+
+	if !to.After(from) || to.Sub(from) > positionsMaxRange {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "to must be after from and at most 31 days later",
+		})
+		return
+	}
+
+	writePositions(w, r, bike.ID, from, to, "bike-"+bike.ID.Hex(), false)
+}
+
+// writePositions pages or exports the bike's positions. Pages are tracker.Position shaped if trackerFields,
+// as the route was served before positions were stored locally.
+func writePositions(w http.ResponseWriter, r *http.Request, bikeID bson.ObjectId, from time.Time, to time.Time, name string, trackerFields bool) {
+	query := db.Cols.Positions.Find(db.M{
+		"bike_id":  bikeID,
+		"fix_time": db.M{"$gte": from, "$lte": to},
+	})
+
+	format, ok := routeFormat(r)
+	if !ok {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "format must be json, gpx, kml or geojson",
+		})
+		return
+	}
+
+	if format != nil {
+		positions := []db.Position{}
+		if err := query.Sort("fix_time").All(&positions); err != nil {
+			panic(err)
+		}
+
+		var bike db.Bike
+		if err := db.Cols.Bikes.FindId(bikeID).One(&bike); err != nil {
+			panic(err)
+		}
+
+		w.Header().Set("Content-Type", format.contentType)
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+name+"."+format.extension+"\"")
+		if err := format.write(w, route{
+			Name:      name,
+			Bike:      bike,
+			Positions: positions,
+		}); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit < 1 {
+		limit = positionsPageSize
+	} else if limit > positionsMaxPageSize {
+		limit = positionsMaxPageSize
+	}
+
+	total, err := query.Count()
+	if err != nil {
+		panic(err)
+	}
+
+	positions := []db.Position{}
+	if err := query.Sort("fix_time").Skip((page - 1) * limit).Limit(limit).All(&positions); err != nil {
+		panic(err)
+	}
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if !trackerFields {
+		syrup.WriteJSON(w, http.StatusOK, positions)
+		return
+	}
+
+	fixes := make([]tracker.Position, len(positions))
+	for i, position := range positions {
+		fixes[i] = tracker.Position{
+			ID:        position.PositionID,
+			DeviceID:  position.TrackerID,
+			FixTime:   position.FixTime,
+			Latitude:  position.Latitude,
+			Longitude: position.Longitude,
+			Speed:     position.Speed,
+			Course:    position.Course,
+		}
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, fixes)
+}
+
+// trackerDistance returns miles travelled by a tracker between from and to, asking the tracker directly
+// as stored positions may not have caught up
+func trackerDistance(trackerID int, from time.Time, to time.Time) (float64, error) {
+	positions, err := tracker.New(config.Config.GPS.Endpoint, config.GetGPSAuthorization()).Positions(trackerID, from, to)
+	if err != nil {
+		return 0, err
+	}
+
+	distance := 0.0
+	for i := 1; i < len(positions); i++ {
+		distance += db.DistanceMiles(positions[i-1].Latitude, positions[i-1].Longitude, positions[i].Latitude, positions[i].Longitude)
+	}
+
+	return distance, nil
+}
+
+// osmandPosition accepts a position report using the OsmAnd protocol (query or form parameters
+// id, lat, lon, timestamp, speed, bearing, batt). The device ID is the bike's DeviceID.
+func osmandPosition(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.FormValue("id")
+	if len(deviceID) == 0 {
+		deviceID = r.FormValue("deviceid")
+	}
+
+	if len(deviceID) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
 	var bike db.Bike
-	db.Cols.Bikes.FindId(shift.ScooterID).One(&bike)
+	if err := db.Cols.Bikes.Find(db.M{
+		"device_id": deviceID,
+		"status":    db.M{"$nin": db.RetiredBikeStatuses},
+	}).One(&bike); err == mgo.ErrNotFound {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		panic(err)
+	}
 
-	if bike.TrackerID <= 0 {
+	lat, errLat := strconv.ParseFloat(r.FormValue("lat"), 64)
+	lon, errLon := strconv.ParseFloat(r.FormValue("lon"), 64)
+	if errLat != nil || errLon != nil || math.Abs(lat) > 90 || math.Abs(lon) > 180 {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	q := url.Values{}
-	q.Set("deviceId", strconv.Itoa(bike.TrackerID))
-	q.Set("from", shift.CheckIn.Format("2006-01-02T15:04:05.000Z"))
-	q.Set("to", shift.CheckOut.Format("2006-01-02T15:04:05.000Z"))
-	q.Set("page", "1")
-	q.Set("start", "0")
-	q.Set("limit", "25")
+	fixTime, ok := parseOsmandTimestamp(r.FormValue("timestamp"))
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	position := db.Position{
+		BikeID:    bike.ID,
+		DeviceID:  deviceID,
+		FixTime:   fixTime,
+		Latitude:  lat,
+		Longitude: lon,
+	}
 
-	req, _ := http.NewRequest("GET", config.Config.GPS.Endpoint+"/positions?"+q.Encode(), nil)
-	req.Header.Add("Authorization", config.GetGPSAuthorization())
+	// optional
+	position.Speed, _ = strconv.ParseFloat(r.FormValue("speed"), 64)
+	position.Course, _ = strconv.ParseFloat(r.FormValue("bearing"), 64)
+	if heading := r.FormValue("heading"); len(heading) > 0 {
+		position.Course, _ = strconv.ParseFloat(heading, 64)
+	}
+	position.Battery, _ = strconv.ParseFloat(r.FormValue("batt"), 64)
 
-	if resp, err := (&http.Client{}).Do(req); err != nil {
+	if err := db.InsertPositions([]db.Position{position}); err != nil {
 		panic(err)
-	} else {
-		defer resp.Body.Close()
+	}
+
+	alerts, err := db.CheckPositions(bike, []db.Position{position})
+	if err != nil {
+		panic(err)
+	}
 
-		w.WriteHeader(http.StatusOK)
-		io.Copy(w, resp.Body)
+	// the alerts are stored, so the emails are retried by the alert emails job
+	if err := db.NotifyAlerts(alerts); err != nil {
+		fmt.Println("Failed to email alerts for bike", bike.ID.Hex(), err)
 	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// parseOsmandTimestamp reads unix seconds, unix milliseconds or RFC 3339, defaulting to now
+func parseOsmandTimestamp(timestamp string) (time.Time, bool) {
+	if len(timestamp) == 0 {
+		return time.Now(), true
+	}
+
+	if unix, err := strconv.ParseInt(timestamp, 10, 64); err == nil {
+		if unix > 1e12 {
+			return time.Unix(0, unix*int64(time.Millisecond)), true
+		}
+
+		return time.Unix(unix, 0), true
+	}
+
+	if t, err := time.Parse(time.RFC3339, timestamp); err == nil {
+		return t, true
+	}
+
+	return time.Time{}, false
 }
@@ -0,0 +1,385 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/maple-ai/fleet-api/config"
+	"github.com/maple-ai/fleet-api/db"
+	"github.com/maple-ai/syrup"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type incidentDetails struct {
+	IncidentType string         `json:"incident_type"`
+	Level        string         `json:"level"`
+	Description  string         `json:"description"`
+	Location     string         `json:"location"`
+	Lat          float64        `json:"lat"`
+	Lng          float64        `json:"lng"`
+	OccurredAt   time.Time      `json:"occurred_at"`
+	ThirdParty   *db.ThirdParty `json:"third_party"`
+}
+
+func (details incidentDetails) validate() []string {
+	errs := []string{}
+	if _, ok := db.IncidentTypes[details.IncidentType]; !ok {
+		errs = append(errs, "Unknown incident type")
+	}
+	if db.EventLevelRank(details.Level) < 0 {
+		errs = append(errs, "Severity must be one of "+strings.Join(db.EventLevels, ", "))
+	}
+	if len(details.Description) == 0 {
+		errs = append(errs, "Description cannot be empty")
+	}
+	if details.OccurredAt.After(time.Now()) {
+		errs = append(errs, "Incident cannot be in the future")
+	}
+
+	return errs
+}
+
+// incidentMiddleware loads an incident belonging to the driver's shift
+func incidentMiddleware(w http.ResponseWriter, r *http.Request) {
+	shift := context.Get(r, "shift").(db.Shift)
+
+	incidentID := bson.ObjectIdHex(mux.Vars(r)["incident_id"])
+	if !incidentID.Valid() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var incident db.Event
+	if err := db.Cols.Events.Find(db.M{
+		"_id":      incidentID,
+		"shift_id": shift.ID,
+		"type":     "incident",
+	}).One(&incident); err != nil {
+		panic(err)
+	}
+
+	context.Set(r, "incident", incident)
+}
+
+// createIncident files an incident against the driver's own shift
+func createIncident(w http.ResponseWriter, r *http.Request) {
+	fileIncident(w, r, context.Get(r, "shift").(db.Shift))
+}
+
+func getShiftIncidents(w http.ResponseWriter, r *http.Request) {
+	var incidents []db.Event
+	if err := db.Cols.Events.Find(db.M{
+		"shift_id": context.Get(r, "shift").(db.Shift).ID,
+		"type":     "incident",
+	}).Sort("-occurred_at").All(&incidents); err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, incidents)
+}
+
+// uploadIncidentPhoto adds a photo to the incident in context
+func uploadIncidentPhoto(w http.ResponseWriter, r *http.Request) {
+	incident := context.Get(r, "incident").(db.Event)
+
+	f := uploadedFile(w, r, 51200)
+	if f == nil {
+		return
+	}
+
+	if !strings.HasPrefix(f.Header.Get("content-type"), "image/") {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Photos must be images",
+		})
+		return
+	}
+
+	fileID, _, err := writeGridFile(db.DB.GridFS("incidents"), incident.ID.Hex(), f)
+	if err != nil {
+		panic(err)
+	}
+
+	if err := db.Cols.Events.UpdateId(incident.ID, db.M{
+		"$push": db.M{"photos": fileID},
+	}); err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusCreated, map[string]interface{}{
+		"_id": fileID,
+	})
+}
+
+func getIncidentPhoto(w http.ResponseWriter, r *http.Request) {
+	incident := context.Get(r, "incident").(db.Event)
+	photoID := bson.ObjectIdHex(mux.Vars(r)["photo_id"])
+
+	for _, id := range incident.Photos {
+		if id == photoID {
+			serveGridFile(w, db.DB.GridFS("incidents"), photoID)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNotFound)
+}
+
+// fileIncident creates an incident for the shift's bike and driver
+func fileIncident(w http.ResponseWriter, r *http.Request, shift db.Shift) {
+	var details incidentDetails
+	if err := syrup.Bind(w, r, &details); err != nil {
+		return
+	}
+
+	if details.OccurredAt.IsZero() {
+		details.OccurredAt = time.Now()
+	}
+
+	errs := details.validate()
+	if shift.Status != "running" && shift.Status != "complete" {
+		errs = append(errs, "Incidents can only be reported for shifts which have started")
+	}
+
+	if len(errs) > 0 {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"errors": errs,
+		})
+		return
+	}
+
+	userID := context.Get(r, "userID").(bson.ObjectId)
+	now := time.Now()
+
+	incident := db.Event{
+		ID:      bson.NewObjectId(),
+		BikeID:  shift.ScooterID,
+		Type:    "incident",
+		ShiftID: shift.ID,
+		UserID:  shift.UserID,
+		Photos:  []bson.ObjectId{},
+		Status:  "reported",
+		StatusHistory: []db.EventStatusChange{{
+			Status:    "reported",
+			ChangedBy: userID,
+			ChangedAt: now,
+		}},
+		Created:   now,
+		CreatedBy: userID,
+	}
+	details.apply(&incident)
+
+	incidentOffRoad(&incident, userID)
+
+	if err := db.Cols.Events.Insert(&incident); err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusCreated, incident)
+}
+
+func (details incidentDetails) apply(incident *db.Event) {
+	incident.IncidentType = details.IncidentType
+	incident.Level = details.Level
+	incident.Description = details.Description
+	incident.Location = details.Location
+	incident.Lat = details.Lat
+	incident.Lng = details.Lng
+	incident.OccurredAt = details.OccurredAt
+	incident.ThirdParty = details.ThirdParty
+}
+
+// incidentOffRoad takes an in-service bike off road when the incident is at or above the configured severity
+func incidentOffRoad(incident *db.Event, by bson.ObjectId) {
+	if incident.OffRoad || db.EventLevelRank(incident.Level) < db.EventLevelRank(config.Config.Incidents.OffRoadLevel) {
+		return
+	}
+
+	var bike db.Bike
+	if err := db.Cols.Bikes.FindId(incident.BikeID).One(&bike); err != nil {
+		panic(err)
+	}
+
+	// already out of service
+	if bike.Status != db.BikeStatusInService && bike.Status != db.BikeStatusReserved {
+		return
+	}
+
+	reason := db.IncidentTypes[incident.IncidentType] + " reported (" + incident.Level + " severity)"
+	if _, err := db.SetBikeStatus(bike, db.BikeStatusOffRoad, reason, by); err != nil {
+		panic(err)
+	}
+
+	incident.OffRoad = true
+}
+
+// adminIncidentMiddleware loads any incident by ID
+func adminIncidentMiddleware(w http.ResponseWriter, r *http.Request) {
+	incidentID := bson.ObjectIdHex(mux.Vars(r)["incident_id"])
+	if !incidentID.Valid() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var incident db.Event
+	if err := db.Cols.Events.Find(db.M{
+		"_id":  incidentID,
+		"type": "incident",
+	}).One(&incident); err != nil {
+		panic(err)
+	}
+
+	context.Set(r, "incident", incident)
+}
+
+// adminGetIncidents lists incidents, filtered by ?status=a,b, bike_id and user_id. Closed incidents are
+// excluded unless asked for.
+func adminGetIncidents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := db.M{
+		"type":   "incident",
+		"status": db.M{"$ne": "closed"},
+	}
+
+	if status := query.Get("status"); len(status) > 0 {
+		q["status"] = db.M{"$in": strings.Split(status, ",")}
+	}
+	if bikeID := query.Get("bike_id"); bson.IsObjectIdHex(bikeID) {
+		q["bike_id"] = bson.ObjectIdHex(bikeID)
+	}
+	if userID := query.Get("user_id"); bson.IsObjectIdHex(userID) {
+		q["user_id"] = bson.ObjectIdHex(userID)
+	}
+
+	var incidents []db.Event
+	if err := db.Cols.Events.Find(q).Sort("-occurred_at").All(&incidents); err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, incidents)
+}
+
+func adminGetIncident(w http.ResponseWriter, r *http.Request) {
+	syrup.WriteJSON(w, http.StatusOK, context.Get(r, "incident").(db.Event))
+}
+
+// adminCreateIncident files an incident on behalf of the shift's driver
+func adminCreateIncident(w http.ResponseWriter, r *http.Request) {
+	var shift db.Shift
+	if err := db.Cols.Shifts.FindId(bson.ObjectIdHex(mux.Vars(r)["shift_id"])).One(&shift); err != nil {
+		panic(err)
+	}
+
+	fileIncident(w, r, shift)
+}
+
+func adminUpdateIncident(w http.ResponseWriter, r *http.Request) {
+	incident := context.Get(r, "incident").(db.Event)
+
+	var details incidentDetails
+	if err := syrup.Bind(w, r, &details); err != nil {
+		return
+	}
+
+	if details.OccurredAt.IsZero() {
+		details.OccurredAt = incident.OccurredAt
+	}
+
+	if errs := details.validate(); len(errs) > 0 {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"errors": errs,
+		})
+		return
+	}
+
+	details.apply(&incident)
+	if incident.Status != "closed" {
+		incidentOffRoad(&incident, context.Get(r, "userID").(bson.ObjectId))
+	}
+
+	if err := db.Cols.Events.UpdateId(incident.ID, db.M{"$set": db.M{
+		"incident_type": incident.IncidentType,
+		"level":         incident.Level,
+		"description":   incident.Description,
+		"location":      incident.Location,
+		"lat":           incident.Lat,
+		"lng":           incident.Lng,
+		"occurred_at":   incident.OccurredAt,
+		"third_party":   incident.ThirdParty,
+		"off_road":      incident.OffRoad,
+	}}); err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, incident)
+}
+
+// adminSetIncidentStatus moves an incident through reported/investigating/claim_filed/closed
+func adminSetIncidentStatus(w http.ResponseWriter, r *http.Request) {
+	incident := context.Get(r, "incident").(db.Event)
+
+	var body struct {
+		Status         string `json:"status"`
+		Notes          string `json:"notes"`
+		ClaimReference string `json:"claim_reference"`
+	}
+	if err := syrup.Bind(w, r, &body); err != nil {
+		return
+	}
+
+	if len(body.ClaimReference) == 0 {
+		body.ClaimReference = incident.ClaimReference
+	}
+
+	errs := []string{}
+	switch {
+	case !db.IsIncidentStatus(body.Status):
+		errs = append(errs, "Status must be one of "+strings.Join(db.IncidentStatuses, ", "))
+	case body.Status == incident.Status:
+		errs = append(errs, "Incident is already "+body.Status)
+	case body.Status == "claim_filed" && len(body.ClaimReference) == 0:
+		errs = append(errs, "Please provide the claim reference")
+	}
+
+	if len(errs) > 0 {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"errors": errs,
+		})
+		return
+	}
+
+	change := db.EventStatusChange{
+		Status:    body.Status,
+		Notes:     body.Notes,
+		ChangedBy: context.Get(r, "userID").(bson.ObjectId),
+		ChangedAt: time.Now(),
+	}
+
+	// only move from the status we loaded, in case of concurrent updates
+	if err := db.Cols.Events.Update(db.M{
+		"_id":    incident.ID,
+		"status": incident.Status,
+	}, db.M{
+		"$set": db.M{
+			"status":          body.Status,
+			"claim_reference": body.ClaimReference,
+		},
+		"$push": db.M{"status_history": change},
+	}); err == mgo.ErrNotFound {
+		syrup.WriteJSON(w, http.StatusConflict, map[string]string{
+			"error": "Incident was updated by someone else, please reload",
+		})
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	incident.Status = body.Status
+	incident.ClaimReference = body.ClaimReference
+	incident.StatusHistory = append(incident.StatusHistory, change)
+
+	syrup.WriteJSON(w, http.StatusOK, incident)
+}
@@ -0,0 +1,463 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/websocket"
+	"github.com/maple-ai/fleet-api/db"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// mgo has no change stream support, so each connection polls Mongo for
+// positions and shift events. This works the same across API instances.
+const (
+	livePollInterval  = 2 * time.Second
+	liveHeartbeat     = 15 * time.Second
+	liveBikesInterval = time.Minute
+	liveWriteTimeout  = 10 * time.Second
+)
+
+var liveUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// Same as the CORS policy, clients authenticate with ?authorization=
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+type liveShift struct {
+	ID     bson.ObjectId `json:"_id"`
+	Status string        `json:"status"`
+	UserID bson.ObjectId `json:"user_id"`
+	Driver string        `json:"driver"`
+}
+
+type liveBike struct {
+	BikeID       bson.ObjectId `json:"bike_id"`
+	GarageID     bson.ObjectId `json:"garage_id"`
+	Registration string        `json:"registration"`
+	Position     *db.Position  `json:"position"`
+	Shift        *liveShift    `json:"shift"`
+}
+
+type liveShiftEvent struct {
+	db.ShiftEvent `bson:",inline"`
+	Driver        string `json:"driver"`
+}
+
+// liveSender writes feed events over SSE or a websocket
+type liveSender interface {
+	Send(id, event string, data interface{}) error
+	Ping() error
+	// Done is closed when the client goes away
+	Done() <-chan struct{}
+}
+
+type sseSender struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	done    <-chan struct{}
+}
+
+func (s *sseSender) Send(id, event string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	if len(id) > 0 {
+		if _, err := fmt.Fprintf(s.w, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, b); err != nil {
+		return err
+	}
+
+	s.flusher.Flush()
+	return nil
+}
+
+func (s *sseSender) Ping() error {
+	if _, err := fmt.Fprint(s.w, ": ping\n\n"); err != nil {
+		return err
+	}
+
+	s.flusher.Flush()
+	return nil
+}
+
+func (s *sseSender) Done() <-chan struct{} {
+	return s.done
+}
+
+type wsSender struct {
+	conn *websocket.Conn
+	done chan struct{}
+}
+
+func (s *wsSender) Send(id, event string, data interface{}) error {
+	s.conn.SetWriteDeadline(time.Now().Add(liveWriteTimeout))
+	return s.conn.WriteJSON(map[string]interface{}{
+		"id":    id,
+		"event": event,
+		"data":  data,
+	})
+}
+
+func (s *wsSender) Ping() error {
+	return s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(liveWriteTimeout))
+}
+
+func (s *wsSender) Done() <-chan struct{} {
+	return s.done
+}
+
+// liveGarages resolves the garages the feed covers, nil for all.
+// Writes 403 and returns false when ?garage_id is outside the user's restrictions.
+func liveGarages(w http.ResponseWriter, r *http.Request) ([]bson.ObjectId, bool) {
+	allowed, err := db.FindRestrictedGarages(context.Get(r, "userID").(bson.ObjectId))
+	if err != nil {
+		panic(err)
+	}
+
+	garageID := r.URL.Query().Get("garage_id")
+	if len(garageID) == 0 {
+		return allowed, true
+	}
+
+	if !bson.IsObjectIdHex(garageID) {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, false
+	}
+
+	id := bson.ObjectIdHex(garageID)
+	if allowed != nil {
+		found := false
+		for _, allowedID := range allowed {
+			if allowedID == id {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			w.WriteHeader(http.StatusForbidden)
+			return nil, false
+		}
+	}
+
+	return []bson.ObjectId{id}, true
+}
+
+// lastEventID is where a reconnecting client left off
+func lastEventID(r *http.Request) bson.ObjectId {
+	id := r.Header.Get("Last-Event-ID")
+	if len(id) == 0 {
+		id = r.URL.Query().Get("last_event_id")
+	}
+
+	if !bson.IsObjectIdHex(id) {
+		return ""
+	}
+
+	return bson.ObjectIdHex(id)
+}
+
+// adminLiveFleet streams the fleet as Server-Sent Events:
+// a "bike" event per tracked bike on connect, then "position" and "shift" events.
+// Shift events carry IDs so EventSource resumes from Last-Event-ID.
+func adminLiveFleet(w http.ResponseWriter, r *http.Request) {
+	garages, ok := liveGarages(w, r)
+	if !ok {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Stop proxies buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	streamLiveFleet(&sseSender{w: w, flusher: flusher, done: r.Context().Done()}, garages, lastEventID(r))
+}
+
+// adminLiveFleetSocket is adminLiveFleet over a websocket, messages are {id, event, data}
+func adminLiveFleetSocket(w http.ResponseWriter, r *http.Request) {
+	garages, ok := liveGarages(w, r)
+	if !ok {
+		return
+	}
+
+	conn, err := liveUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already replied
+		return
+	}
+	defer conn.Close()
+
+	sender := &wsSender{conn: conn, done: make(chan struct{})}
+	go func() {
+		// Only reading to notice the client closing
+		defer close(sender.done)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	streamLiveFleet(sender, garages, lastEventID(r))
+}
+
+// streamLiveFleet runs until the client leaves. The response is already under way,
+// so database errors end the stream and the client reconnects.
+func streamLiveFleet(sender liveSender, garages []bson.ObjectId, since bson.ObjectId) {
+	bikes, err := liveFleetBikes(garages)
+	if err != nil {
+		return
+	}
+
+	// Cursors start at the newest documents so only changes after the snapshot are sent
+	positionCursor, err := latestID(db.Cols.Positions)
+	if err != nil {
+		return
+	}
+
+	eventCursor := since
+	if !eventCursor.Valid() {
+		if eventCursor, err = latestID(db.Cols.ShiftEvents); err != nil {
+			return
+		}
+	}
+
+	snapshot, err := liveSnapshot(bikes)
+	if err != nil {
+		return
+	}
+
+	for _, bike := range snapshot {
+		if err := sender.Send("", "bike", bike); err != nil {
+			return
+		}
+	}
+
+	poll := time.NewTicker(livePollInterval)
+	defer poll.Stop()
+	heartbeat := time.NewTicker(liveHeartbeat)
+	defer heartbeat.Stop()
+	bikesReloaded := time.Now()
+
+	for {
+		select {
+		case <-sender.Done():
+			return
+		case <-heartbeat.C:
+			if err := sender.Ping(); err != nil {
+				return
+			}
+		case <-poll.C:
+			if time.Since(bikesReloaded) > liveBikesInterval {
+				if bikes, err = liveFleetBikes(garages); err != nil {
+					return
+				}
+				bikesReloaded = time.Now()
+			}
+
+			events, err := liveShiftEvents(garages, eventCursor)
+			if err != nil {
+				return
+			}
+
+			for _, event := range events {
+				if err := sender.Send(event.ID.Hex(), "shift", event); err != nil {
+					return
+				}
+				eventCursor = event.ID
+			}
+
+			positions, cursor, err := livePositions(bikes, positionCursor)
+			if err != nil {
+				return
+			}
+			positionCursor = cursor
+
+			for _, position := range positions {
+				if err := sender.Send("", "position", position); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// liveFleetBikes are the tracked bikes in the garages (nil for all), keyed by ID
+func liveFleetBikes(garages []bson.ObjectId) (map[bson.ObjectId]db.Bike, error) {
+	query := db.M{
+		"$or": []db.M{
+			{"tracker_id": db.M{"$gt": 0}},
+			{"device_id": db.M{"$nin": []interface{}{"", nil}}},
+		},
+	}
+	if garages != nil {
+		query["garage_id"] = db.M{"$in": garages}
+	}
+
+	var bikes []db.Bike
+	if err := db.Cols.Bikes.Find(query).All(&bikes); err != nil {
+		return nil, err
+	}
+
+	byID := make(map[bson.ObjectId]db.Bike, len(bikes))
+	for _, bike := range bikes {
+		byID[bike.ID] = bike
+	}
+
+	return byID, nil
+}
+
+// latestID is the newest _id in the collection, empty if there are no documents
+func latestID(col *mgo.Collection) (bson.ObjectId, error) {
+	var doc struct {
+		ID bson.ObjectId `bson:"_id"`
+	}
+
+	if err := col.Find(nil).Select(db.M{"_id": 1}).Sort("-_id").One(&doc); err != nil && err != mgo.ErrNotFound {
+		return "", err
+	}
+
+	return doc.ID, nil
+}
+
+func liveSnapshot(bikes map[bson.ObjectId]db.Bike) ([]liveBike, error) {
+	snapshot := make([]liveBike, 0, len(bikes))
+	for _, bike := range bikes {
+		entry := liveBike{
+			BikeID:       bike.ID,
+			GarageID:     bike.GarageID,
+			Registration: bike.Registration,
+		}
+
+		var position db.Position
+		err := db.Cols.Positions.Find(db.M{"bike_id": bike.ID}).Sort("-fix_time").One(&position)
+		if err == nil {
+			entry.Position = &position
+		} else if err != mgo.ErrNotFound {
+			return nil, err
+		}
+
+		var shift db.Shift
+		err = db.Cols.Shifts.Find(db.M{"scooter_id": bike.ID, "status": "running"}).One(&shift)
+		if err == nil {
+			driver, err := driverName(shift.UserID)
+			if err != nil {
+				return nil, err
+			}
+
+			entry.Shift = &liveShift{
+				ID:     shift.ID,
+				Status: shift.Status,
+				UserID: shift.UserID,
+				Driver: driver,
+			}
+		} else if err != mgo.ErrNotFound {
+			return nil, err
+		}
+
+		snapshot = append(snapshot, entry)
+	}
+
+	return snapshot, nil
+}
+
+func liveShiftEvents(garages []bson.ObjectId, after bson.ObjectId) ([]liveShiftEvent, error) {
+	query := db.M{}
+	if after.Valid() {
+		query["_id"] = db.M{"$gt": after}
+	}
+	if garages != nil {
+		query["garage_id"] = db.M{"$in": garages}
+	}
+
+	var events []liveShiftEvent
+	if err := db.Cols.ShiftEvents.Find(query).Sort("_id").All(&events); err != nil {
+		return nil, err
+	}
+
+	for i := range events {
+		driver, err := driverName(events[i].UserID)
+		if err != nil {
+			return nil, err
+		}
+		events[i].Driver = driver
+	}
+
+	return events, nil
+}
+
+// livePositions is the newest new fix per bike since the cursor, and the cursor to poll from next
+func livePositions(bikes map[bson.ObjectId]db.Bike, after bson.ObjectId) ([]db.Position, bson.ObjectId, error) {
+	query := db.M{}
+	if after.Valid() {
+		query["_id"] = db.M{"$gt": after}
+	}
+
+	var positions []db.Position
+	if err := db.Cols.Positions.Find(query).Sort("_id").All(&positions); err != nil {
+		return nil, after, err
+	}
+
+	if len(positions) == 0 {
+		return nil, after, nil
+	}
+
+	latest := map[bson.ObjectId]int{}
+	result := []db.Position{}
+	for _, position := range positions {
+		if _, ok := bikes[position.BikeID]; !ok {
+			continue
+		}
+
+		if i, ok := latest[position.BikeID]; ok {
+			if position.FixTime.After(result[i].FixTime) {
+				result[i] = position
+			}
+			continue
+		}
+
+		latest[position.BikeID] = len(result)
+		result = append(result, position)
+	}
+
+	return result, positions[len(positions)-1].ID, nil
+}
+
+func driverName(userID bson.ObjectId) (string, error) {
+	if !userID.Valid() {
+		return "", nil
+	}
+
+	var user db.User
+	if err := db.Cols.Users.FindId(userID).Select(db.M{"name": 1}).One(&user); err != nil {
+		if err == mgo.ErrNotFound {
+			return "", nil
+		}
+
+		return "", err
+	}
+
+	return user.Name, nil
+}
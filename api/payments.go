@@ -0,0 +1,452 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/maple-ai/fleet-api/config"
+	"github.com/maple-ai/fleet-api/db"
+	"github.com/maple-ai/syrup"
+	stripe "github.com/stripe/stripe-go"
+	"github.com/stripe/stripe-go/charge"
+	"github.com/stripe/stripe-go/refund"
+	"github.com/stripe/stripe-go/webhook"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// getUserPayments lists the driver's deposits, card charges and refunds
+func getUserPayments(w http.ResponseWriter, r *http.Request) {
+	writeCardTransactions(w, context.Get(r, "userID").(bson.ObjectId))
+}
+
+func adminGetUserPayments(w http.ResponseWriter, r *http.Request) {
+	writeCardTransactions(w, context.Get(r, "admin_user").(db.User).ID)
+}
+
+// adminHoldDeposit holds the deposit on the driver's card, e.g. after a hold lapsed or a card was added
+func adminHoldDeposit(w http.ResponseWriter, r *http.Request) {
+	user := context.Get(r, "admin_user").(db.User)
+
+	errs := []string{}
+	if config.Config.Stripe.Deposit <= 0 {
+		errs = append(errs, "Deposits are not enabled")
+	}
+	if len(user.StripeUserID) == 0 {
+		errs = append(errs, "Driver has no card")
+	}
+
+	if len(errs) > 0 {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"errors": errs,
+		})
+		return
+	}
+
+	entry, err := db.HoldDeposit(user, context.Get(r, "userID").(bson.ObjectId))
+	if err != nil {
+		panic(err)
+	}
+
+	if entry == nil {
+		syrup.WriteJSON(w, http.StatusConflict, map[string]string{
+			"error": "Driver already has a deposit",
+		})
+		return
+	}
+
+	syrup.WriteJSON(w, http.StatusCreated, entry)
+}
+
+// adminChargeUser charges the driver's card (amount in pence) for an incident or fine, instead of deducting it from pay
+func adminChargeUser(w http.ResponseWriter, r *http.Request) {
+	user := context.Get(r, "admin_user").(db.User)
+
+	var body struct {
+		Amount      int64         `json:"amount"`
+		Description string        `json:"description"`
+		IncidentID  bson.ObjectId `json:"incident_id"`
+		FineID      bson.ObjectId `json:"fine_id"`
+	}
+	if err := syrup.Bind(w, r, &body); err != nil {
+		return
+	}
+
+	errs := []string{}
+	if len(user.StripeUserID) == 0 {
+		errs = append(errs, "Driver has no card")
+	}
+	if body.Amount <= 0 {
+		errs = append(errs, "Amount must be above zero")
+	}
+	if len(body.Description) == 0 {
+		errs = append(errs, "Description cannot be empty")
+	}
+	if body.IncidentID.Valid() == body.FineID.Valid() {
+		errs = append(errs, "Charges must be for one incident or fine")
+	}
+
+	if len(errs) > 0 {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"errors": errs,
+		})
+		return
+	}
+
+	entry := db.Transaction{
+		Type:        "card_charge",
+		Amount:      body.Amount,
+		Description: body.Description,
+		CreatedBy:   context.Get(r, "userID").(bson.ObjectId),
+	}
+
+	if body.IncidentID.Valid() {
+		var incident db.Event
+		if err := db.Cols.Events.Find(db.M{
+			"_id":     body.IncidentID,
+			"type":    "incident",
+			"user_id": user.ID,
+		}).One(&incident); err == mgo.ErrNotFound {
+			syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+				"error": "Incident not found for this driver",
+			})
+			return
+		} else if err != nil {
+			panic(err)
+		}
+
+		// not both from pay and the card
+		if n, err := db.Cols.Transactions.Find(db.M{"type": "damage", "incident_id": incident.ID}).Count(); err != nil {
+			panic(err)
+		} else if n > 0 {
+			syrup.WriteJSON(w, http.StatusConflict, map[string]string{
+				"error": "Damage for this incident is being deducted from pay",
+			})
+			return
+		}
+
+		entry.IncidentID = incident.ID
+		entry.ShiftID = incident.ShiftID
+	} else {
+		var fine db.Fine
+		if err := db.Cols.Fines.Find(db.M{
+			"_id":     body.FineID,
+			"user_id": user.ID,
+		}).One(&fine); err == mgo.ErrNotFound {
+			syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+				"error": "Fine not found for this driver",
+			})
+			return
+		} else if err != nil {
+			panic(err)
+		}
+
+		if fine.Status == "deducted" {
+			syrup.WriteJSON(w, http.StatusConflict, map[string]string{
+				"error": "This fine is being deducted from pay",
+			})
+			return
+		}
+
+		entry.FineID = fine.ID
+		entry.ShiftID = fine.ShiftID
+	}
+
+	entry, err := db.ChargeCard(user, entry, true)
+	if err != nil {
+		panic(err)
+	}
+
+	status := http.StatusCreated
+	if entry.Status == "failed" {
+		status = http.StatusPaymentRequired
+	}
+
+	syrup.WriteJSON(w, status, entry)
+}
+
+// adminCardTransactionMiddleware loads a deposit or card charge
+func adminCardTransactionMiddleware(w http.ResponseWriter, r *http.Request) {
+	transactionID := mux.Vars(r)["transaction_id"]
+	if !bson.IsObjectIdHex(transactionID) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var entry db.Transaction
+	if err := db.Cols.Transactions.Find(db.M{
+		"_id":  bson.ObjectIdHex(transactionID),
+		"type": db.M{"$in": []string{"deposit", "card_charge"}},
+	}).One(&entry); err == mgo.ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	context.Set(r, "card_transaction", entry)
+}
+
+// adminCaptureDeposit takes some (amount in pence) or all of a held deposit, e.g. for damage. The rest is released.
+func adminCaptureDeposit(w http.ResponseWriter, r *http.Request) {
+	entry := context.Get(r, "card_transaction").(db.Transaction)
+
+	var body struct {
+		Amount      int64  `json:"amount"`
+		Description string `json:"description"`
+	}
+	if err := syrup.Bind(w, r, &body); err != nil {
+		return
+	}
+
+	if entry.Type != "deposit" || entry.Status != "held" {
+		syrup.WriteJSON(w, http.StatusConflict, map[string]string{
+			"error": "Only held deposits can be captured",
+		})
+		return
+	}
+
+	if body.Amount < 0 || body.Amount > entry.Amount {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Amount must be up to the deposit held",
+		})
+		return
+	}
+
+	params := &stripe.CaptureParams{}
+	if body.Amount > 0 {
+		params.Amount = stripe.Int64(body.Amount)
+	}
+
+	ch, err := charge.Capture(entry.StripeID, params)
+	if err != nil {
+		syrup.WriteJSON(w, http.StatusBadGateway, map[string]string{
+			"error": db.StripeErrorMessage(err),
+		})
+		return
+	}
+
+	if len(body.Description) > 0 {
+		entry.Description = body.Description
+	}
+	if err := db.Cols.Transactions.UpdateId(entry.ID, db.M{"$set": db.M{"description": entry.Description}}); err != nil {
+		panic(err)
+	}
+
+	if err := db.RecordCharge(&entry, ch, false); err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, entry)
+}
+
+// adminRefundCardTransaction refunds some (amount in pence) or all of a card charge or captured deposit,
+// or releases a held deposit
+func adminRefundCardTransaction(w http.ResponseWriter, r *http.Request) {
+	entry := context.Get(r, "card_transaction").(db.Transaction)
+
+	var body struct {
+		Amount      int64  `json:"amount"`
+		Description string `json:"description"`
+	}
+	if err := syrup.Bind(w, r, &body); err != nil {
+		return
+	}
+
+	remaining := entry.Amount - entry.Refunded
+	switch {
+	case entry.Status == "held":
+		// holds can only be released whole
+		body.Amount = remaining
+	case entry.Status != "captured" && entry.Status != "succeeded":
+		syrup.WriteJSON(w, http.StatusConflict, map[string]string{
+			"error": "Only held deposits, captured deposits and successful charges can be refunded",
+		})
+		return
+	case body.Amount == 0:
+		body.Amount = remaining
+	}
+
+	if body.Amount <= 0 || body.Amount > remaining {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+			"error": "Amount must be up to what is left to refund",
+		})
+		return
+	}
+
+	if len(body.Description) == 0 {
+		body.Description = "Refund of " + entry.Description
+	}
+
+	refundEntry, err := db.AddTransaction(db.Transaction{
+		UserID:      entry.UserID,
+		Type:        "card_refund",
+		Status:      "pending",
+		Amount:      body.Amount,
+		Description: body.Description,
+		StripeUser:  entry.StripeUser,
+		StripeCard:  entry.StripeCard,
+		RefundOf:    entry.ID,
+		ShiftID:     entry.ShiftID,
+		IncidentID:  entry.IncidentID,
+		FineID:      entry.FineID,
+		CreatedBy:   context.Get(r, "userID").(bson.ObjectId),
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	params := &stripe.RefundParams{Charge: stripe.String(entry.StripeID)}
+	if entry.Status != "held" {
+		params.Amount = stripe.Int64(body.Amount)
+	}
+	params.AddMetadata("transaction_id", refundEntry.ID.Hex())
+	params.SetIdempotencyKey(refundEntry.ID.Hex())
+
+	re, err := refund.New(params)
+	if err != nil {
+		refundEntry.Status, refundEntry.Error = "failed", db.StripeErrorMessage(err)
+		if err := db.Cols.Transactions.UpdateId(refundEntry.ID, db.M{"$set": db.M{
+			"status": refundEntry.Status,
+			"error":  refundEntry.Error,
+		}}); err != nil {
+			panic(err)
+		}
+
+		syrup.WriteJSON(w, http.StatusBadGateway, refundEntry)
+		return
+	}
+
+	if err := recordRefund(&refundEntry, re); err != nil {
+		panic(err)
+	}
+
+	// the charge's refunded amount and status
+	ch, err := charge.Get(entry.StripeID, nil)
+	if err != nil {
+		panic(err)
+	}
+	if err := db.RecordCharge(&entry, ch, false); err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusCreated, refundEntry)
+}
+
+// stripeWebhook records charge and refund results sent by Stripe, verified with the webhook secret
+func stripeWebhook(w http.ResponseWriter, r *http.Request) {
+	if len(config.Config.Stripe.WebhookSecret) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	payload, err := ioutil.ReadAll(io.LimitReader(r.Body, 65536))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	event, err := webhook.ConstructEvent(payload, r.Header.Get("Stripe-Signature"), config.Config.Stripe.WebhookSecret)
+	if err != nil {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	switch event.Type {
+	case "charge.succeeded", "charge.pending", "charge.captured", "charge.failed", "charge.refunded", "charge.expired":
+		var ch stripe.Charge
+		if err := json.Unmarshal(event.Data.Raw, &ch); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		entry, err := findStripeTransaction(ch.ID, ch.Metadata)
+		if err != nil {
+			panic(err)
+		}
+		if entry == nil {
+			break
+		}
+
+		// events arrive out of order, so use the charge as it is now
+		current, err := charge.Get(ch.ID, nil)
+		if err != nil {
+			panic(err)
+		}
+
+		if err := db.RecordCharge(entry, current, event.Type == "charge.expired"); err != nil {
+			panic(err)
+		}
+	case "charge.refund.updated":
+		var re stripe.Refund
+		if err := json.Unmarshal(event.Data.Raw, &re); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		entry, err := findStripeTransaction(re.ID, re.Metadata)
+		if err != nil {
+			panic(err)
+		}
+		if entry == nil {
+			break
+		}
+
+		if err := recordRefund(entry, &re); err != nil {
+			panic(err)
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// recordRefund updates a card refund from the Stripe refund
+func recordRefund(entry *db.Transaction, re *stripe.Refund) error {
+	entry.StripeID = re.ID
+	entry.Status = string(re.Status)
+	if entry.Status == "canceled" {
+		entry.Status = "failed"
+	}
+
+	return db.Cols.Transactions.UpdateId(entry.ID, db.M{"$set": db.M{
+		"stripe_id": entry.StripeID,
+		"status":    entry.Status,
+	}})
+}
+
+// findStripeTransaction finds the card entry for a Stripe object, by the entry ID it was created with
+// in case the request recording its Stripe ID failed. Nil if it wasn't created by us.
+func findStripeTransaction(stripeID string, metadata map[string]string) (*db.Transaction, error) {
+	q := db.M{"stripe_id": stripeID}
+	if transactionID := metadata["transaction_id"]; bson.IsObjectIdHex(transactionID) {
+		q = db.M{"_id": bson.ObjectIdHex(transactionID)}
+	}
+	q["type"] = db.M{"$in": db.CardTransactionTypes}
+
+	var entry db.Transaction
+	if err := db.Cols.Transactions.Find(q).One(&entry); err == mgo.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+func writeCardTransactions(w http.ResponseWriter, userID bson.ObjectId) {
+	entries := []db.Transaction{}
+	if err := db.Cols.Transactions.Find(db.M{
+		"user_id": userID,
+		"type":    db.M{"$in": db.CardTransactionTypes},
+	}).Sort("-created").All(&entries); err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, entries)
+}
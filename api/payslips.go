@@ -0,0 +1,68 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/maple-ai/fleet-api/db"
+	"github.com/maple-ai/syrup"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func getUserPayslips(w http.ResponseWriter, r *http.Request) {
+	payslips := []db.Payslip{}
+	if err := db.Cols.Payslips.Find(db.M{
+		"user_id": context.Get(r, "userID").(bson.ObjectId),
+	}).Sort("-paid_at").All(&payslips); err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, payslips)
+}
+
+// getUserPayslip downloads one of the driver's payslip PDFs
+func getUserPayslip(w http.ResponseWriter, r *http.Request) {
+	payslipID := mux.Vars(r)["payslip_id"]
+	if !bson.IsObjectIdHex(payslipID) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var payslip db.Payslip
+	if err := db.Cols.Payslips.Find(db.M{
+		"_id":     bson.ObjectIdHex(payslipID),
+		"user_id": context.Get(r, "userID").(bson.ObjectId),
+	}).One(&payslip); err == mgo.ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	serveGridFile(w, db.DB.GridFS(db.PayslipBucket), payslip.FileID)
+}
+
+func adminGetUserPayslips(w http.ResponseWriter, r *http.Request) {
+	user := context.Get(r, "admin_user").(db.User)
+
+	payslips := []db.Payslip{}
+	if err := db.Cols.Payslips.Find(db.M{"user_id": user.ID}).Sort("-paid_at").All(&payslips); err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, payslips)
+}
+
+func adminGetPayslip(w http.ResponseWriter, r *http.Request) {
+	var payslip db.Payslip
+	if err := db.Cols.Payslips.FindId(bson.ObjectIdHex(mux.Vars(r)["payslip_id"])).One(&payslip); err == mgo.ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	serveGridFile(w, db.DB.GridFS(db.PayslipBucket), payslip.FileID)
+}
@@ -0,0 +1,221 @@
+package api
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maple-ai/fleet-api/db"
+)
+
+// Positions store speed in knots, GPX wants metres per second
+const knotsToMetresPerSecond = 0.514444
+
+type route struct {
+	Name      string
+	Bike      db.Bike
+	Positions []db.Position
+}
+
+type routeExporter struct {
+	contentType string
+	extension   string
+	write       func(w io.Writer, route route) error
+}
+
+var routeFormats = map[string]*routeExporter{
+	"gpx":     {"application/gpx+xml", "gpx", writeGPX},
+	"kml":     {"application/vnd.google-earth.kml+xml", "kml", writeKML},
+	"geojson": {"application/geo+json", "geojson", writeGeoJSON},
+}
+
+// routeFormat picks the export from ?format= or the Accept header, nil for paged JSON.
+// ok is false for an unknown ?format=.
+func routeFormat(r *http.Request) (*routeExporter, bool) {
+	if format := strings.ToLower(r.URL.Query().Get("format")); len(format) > 0 {
+		if format == "json" {
+			return nil, true
+		}
+
+		exporter, ok := routeFormats[format]
+		return exporter, ok
+	}
+
+	accept := r.Header.Get("Accept")
+	for _, exporter := range routeFormats {
+		if strings.Contains(accept, exporter.contentType) {
+			return exporter, true
+		}
+	}
+
+	return nil, true
+}
+
+type gpxDocument struct {
+	XMLName        xml.Name `xml:"gpx"`
+	Version        string   `xml:"version,attr"`
+	Creator        string   `xml:"creator,attr"`
+	Namespace      string   `xml:"xmlns,attr"`
+	TrackNamespace string   `xml:"xmlns:gpxtpx,attr"`
+	Track          struct {
+		Name    string `xml:"name"`
+		Desc    string `xml:"desc,omitempty"`
+		Segment struct {
+			Points []gpxPoint `xml:"trkpt"`
+		} `xml:"trkseg"`
+	} `xml:"trk"`
+}
+
+type gpxPoint struct {
+	Lat        float64 `xml:"lat,attr"`
+	Lon        float64 `xml:"lon,attr"`
+	Time       string  `xml:"time"`
+	Extensions struct {
+		Track struct {
+			Speed  float64 `xml:"gpxtpx:speed"`
+			Course float64 `xml:"gpxtpx:course"`
+		} `xml:"gpxtpx:TrackPointExtension"`
+	} `xml:"extensions"`
+}
+
+// writeGPX writes a GPX 1.1 track, speed and course use the Garmin TrackPointExtension
+func writeGPX(w io.Writer, route route) error {
+	doc := gpxDocument{
+		Version:        "1.1",
+		Creator:        "Maple fleet",
+		Namespace:      "http://www.topografix.com/GPX/1/1",
+		TrackNamespace: "http://www.garmin.com/xmlschemas/TrackPointExtension/v2",
+	}
+	doc.Track.Name = route.Name
+	doc.Track.Desc = route.Bike.Registration
+
+	for _, position := range route.Positions {
+		point := gpxPoint{
+			Lat:  position.Latitude,
+			Lon:  position.Longitude,
+			Time: position.FixTime.UTC().Format(time.RFC3339),
+		}
+		point.Extensions.Track.Speed = position.Speed * knotsToMetresPerSecond
+		point.Extensions.Track.Course = position.Course
+
+		doc.Track.Segment.Points = append(doc.Track.Segment.Points, point)
+	}
+
+	return writeXML(w, doc)
+}
+
+type kmlDocument struct {
+	XMLName     xml.Name `xml:"kml"`
+	Namespace   string   `xml:"xmlns,attr"`
+	GxNamespace string   `xml:"xmlns:gx,attr"`
+	Document    struct {
+		Name   string `xml:"name"`
+		Schema struct {
+			ID    string `xml:"id,attr"`
+			Field struct {
+				Name        string `xml:"name,attr"`
+				Type        string `xml:"type,attr"`
+				DisplayName string `xml:"displayName"`
+			} `xml:"gx:SimpleArrayField"`
+		} `xml:"Schema"`
+		Placemark struct {
+			Name        string `xml:"name"`
+			Description string `xml:"description,omitempty"`
+			Track       struct {
+				When         []string `xml:"when"`
+				Coords       []string `xml:"gx:coord"`
+				ExtendedData struct {
+					SchemaData struct {
+						SchemaURL string `xml:"schemaUrl,attr"`
+						ArrayData struct {
+							Name   string   `xml:"name,attr"`
+							Values []string `xml:"gx:value"`
+						} `xml:"gx:SimpleArrayData"`
+					} `xml:"SchemaData"`
+				} `xml:"ExtendedData"`
+			} `xml:"gx:Track"`
+		} `xml:"Placemark"`
+	} `xml:"Document"`
+}
+
+// writeKML writes the route as a gx:Track with speed (knots) per point
+func writeKML(w io.Writer, route route) error {
+	doc := kmlDocument{
+		Namespace:   "http://www.opengis.net/kml/2.2",
+		GxNamespace: "http://www.google.com/kml/ext/2.2",
+	}
+	doc.Document.Name = route.Name
+	doc.Document.Schema.ID = "speed"
+	doc.Document.Schema.Field.Name = "speed"
+	doc.Document.Schema.Field.Type = "float"
+	doc.Document.Schema.Field.DisplayName = "Speed (knots)"
+
+	placemark := &doc.Document.Placemark
+	placemark.Name = route.Name
+	placemark.Description = route.Bike.Registration
+	placemark.Track.ExtendedData.SchemaData.SchemaURL = "#speed"
+	placemark.Track.ExtendedData.SchemaData.ArrayData.Name = "speed"
+
+	for _, position := range route.Positions {
+		placemark.Track.When = append(placemark.Track.When, position.FixTime.UTC().Format(time.RFC3339))
+		placemark.Track.Coords = append(placemark.Track.Coords,
+			strconv.FormatFloat(position.Longitude, 'f', -1, 64)+" "+strconv.FormatFloat(position.Latitude, 'f', -1, 64)+" 0")
+		placemark.Track.ExtendedData.SchemaData.ArrayData.Values = append(placemark.Track.ExtendedData.SchemaData.ArrayData.Values,
+			strconv.FormatFloat(position.Speed, 'f', -1, 64))
+	}
+
+	return writeXML(w, doc)
+}
+
+func writeXML(w io.Writer, doc interface{}) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	return encoder.Encode(doc)
+}
+
+// writeGeoJSON writes a feature collection with the route as a LineString (a Point for a single fix).
+// Times and speeds (knots) per coordinate are in the coordTimes and speeds properties.
+func writeGeoJSON(w io.Writer, route route) error {
+	coordinates := [][]float64{}
+	times := []string{}
+	speeds := []float64{}
+	for _, position := range route.Positions {
+		coordinates = append(coordinates, []float64{position.Longitude, position.Latitude})
+		times = append(times, position.FixTime.UTC().Format(time.RFC3339))
+		speeds = append(speeds, position.Speed)
+	}
+
+	var geometry interface{}
+	switch len(coordinates) {
+	case 0:
+	case 1:
+		geometry = map[string]interface{}{"type": "Point", "coordinates": coordinates[0]}
+	default:
+		geometry = map[string]interface{}{"type": "LineString", "coordinates": coordinates}
+	}
+
+	return json.NewEncoder(w).Encode(map[string]interface{}{
+		"type": "FeatureCollection",
+		"features": []interface{}{
+			map[string]interface{}{
+				"type":     "Feature",
+				"geometry": geometry,
+				"properties": map[string]interface{}{
+					"name":         route.Name,
+					"bike_id":      route.Bike.ID,
+					"registration": route.Bike.Registration,
+					"coordTimes":   times,
+					"speeds":       speeds,
+				},
+			},
+		},
+	})
+}
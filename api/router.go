@@ -22,6 +22,13 @@ func Routes() syrup.Router {
 		api.Post("/reset", doReset)
 	}(r.Group("/auth"))
 
+	// Position reports straight from trackers and phones, authenticated by device ID
+	r.Get("/osmand", osmandPosition)
+	r.Post("/osmand", osmandPosition)
+
+	// Charge and refund results from Stripe, authenticated by signature
+	r.Post("/stripe/webhook", stripeWebhook)
+
 	// 'Logged in' middleware
 	r.Use(secureMiddleware)
 
@@ -47,6 +54,16 @@ func Routes() syrup.Router {
 		api.Get("/billing", getUserBilling)
 		// Update payment method
 		api.Post("/billing/card", addUserCard)
+		// Deposits and card charges
+		api.Get("/payments", getUserPayments)
+
+		// Penalty notices attributed to the driver
+		api.Get("/fines", getUserFines)
+		// Payslips from payroll runs
+		api.Get("/payslips", getUserPayslips)
+		api.Get("/payslips/{payslip_id}", getUserPayslip)
+		// Earnings ledger
+		api.Get("/transactions", getUserTransactions)
 
 		// Get driver license info
 		api.Get("/license", getUserDrivingLicenseInfo)
@@ -69,6 +86,12 @@ func Routes() syrup.Router {
 		api.Get("/search", shiftSearch)
 		api.Delete("/{shift_id}", shiftMiddleware, cancelShift)
 		api.Get("/history", getShiftHistory)
+
+		// Incidents on the driver's shift
+		api.Get("/{shift_id}/incidents", shiftMiddleware, getShiftIncidents)
+		api.Post("/{shift_id}/incidents", shiftMiddleware, createIncident)
+		api.Post("/{shift_id}/incidents/{incident_id}/photos", shiftMiddleware, incidentMiddleware, uploadIncidentPhoto)
+		api.Get("/{shift_id}/incidents/{incident_id}/photos/{photo_id}", shiftMiddleware, incidentMiddleware, getIncidentPhoto)
 	}(r.Group("/shifts"))
 
 	return r
@@ -83,12 +106,34 @@ func adminRouter(api syrup.Router) {
 	api.Get("/bikes", adminGetBikes)
 	api.Get("/bikes/maintenance", adminGetBikesNeedMaintenance)
 	api.Get("/bikes/shift_maintenance", adminGetBikesNeedShiftMaintenance)
+	api.Get("/bikes/maintenance/due", adminGetMaintenanceDue)
+	api.Get("/maintenance-plans", adminGetMaintenancePlans)
 	func(api syrup.Router) {
 		api.Get("", adminGetBike)
 		api.Get("/operator-notes", adminGetBikeOperatorNotes)
+		api.Get("/qr", adminGetBikeQRCode)
+		api.Get("/mileage", adminGetBikeMileage)
+		api.Get("/timeline", adminGetBikeTimeline)
+		api.Get("/positions", adminGetBikePositions)
+		api.Get("/transfers", adminGetBikeTransfers)
+		api.Get("/compliance", adminGetBikeCompliance)
+		api.Get("/compliance/{compliance_type}/evidence", adminGetComplianceEvidence)
 
 		api.Get("/maintenance", adminGetBikeMaintenance)
+		api.Get("/maintenance/plans", adminGetBikeMaintenanceStatus)
+		api.Get("/maintenance/cost", adminGetBikeMaintenanceCost)
+
+		api.Get("/fuel", adminGetBikeFuel)
+		api.Post("/fuel", adminAddBikeFuel)
+		api.Get("/fuel/{fuel_id}/receipt", adminGetFuelReceipt)
+		api.Post("/fuel/{fuel_id}/receipt", adminSetFuelReceipt)
 		api.Post("/maintenance", adminSetBikeMaintenance)
+		api.Get("/maintenance/{maintenance_log_id}/attachments", adminGetMaintenanceAttachments)
+		api.Post("/maintenance/{maintenance_log_id}/attachments", adminSetMaintenanceAttachment)
+		api.Get("/maintenance/{maintenance_log_id}/attachments/{attachment_id}", adminGetMaintenanceAttachment)
+		api.Get("/maintenance/{maintenance_log_id}/attachments/{attachment_id}/thumbnail", adminGetMaintenanceThumbnail)
+		api.Delete("/maintenance/{maintenance_log_id}/attachments/{attachment_id}", adminDeleteMaintenanceAttachment)
+		// Single attachment API for older clients: latest attachment, delete removes all
 		api.Post("/maintenance/{maintenance_log_id}/attachment", adminSetMaintenanceAttachment)
 		api.Get("/maintenance/{maintenance_log_id}/attachment", adminGetMaintenanceAttachment)
 		api.Delete("/maintenance/{maintenance_log_id}/attachment", adminDeleteMaintenanceAttachment)
@@ -99,6 +144,10 @@ func adminRouter(api syrup.Router) {
 	// Garages
 	api.Get("/garages", adminGetGarages)
 	api.Get("/garages/{garage_id}", adminGarageMiddleware, adminGetGarage)
+	api.Get("/garages/{garage_id}/fleet", adminGarageMiddleware, adminGetGarageFleet)
+	api.Get("/garages/{garage_id}/parts", adminGarageMiddleware, adminGetGarageParts)
+	api.Get("/reports/maintenance-cost", adminGetMaintenanceCosts)
+	api.Get("/reports/fuel", adminGetFuelReport)
 
 	// Users
 	api.Get("/users", adminGetUsers)
@@ -121,6 +170,40 @@ func adminRouter(api syrup.Router) {
 	api.Delete("/shifts/{shift_id}/status", adminApproveShiftStatus)
 	api.Post("/shifts/{shift_id}/reassign/{bike_id}", adminReassignBike)
 
+	// Pre-ride/post-ride inspections
+	api.Get("/checklists", adminGetChecklists)
+	api.Get("/shifts/{shift_id}/checklist", adminGetShiftChecklist)
+	api.Get("/shifts/{shift_id}/inspections", adminGetShiftInspections)
+	api.Post("/shifts/{shift_id}/inspections/photos", adminUploadInspectionPhoto)
+	api.Post("/shifts/{shift_id}/inspections/{stage}", adminSetShiftInspection)
+	api.Get("/inspections/photos/{photo_id}", adminGetInspectionPhoto)
+
+	// Bike swaps flagged at check-in/out
+	api.Get("/swaps", adminGetBikeSwaps)
+	api.Get("/shifts/{shift_id}/swaps", adminGetBikeSwaps)
+	api.Post("/shifts/{shift_id}/swaps/{swap_id}", adminResolveBikeSwap)
+	api.Delete("/shifts/{shift_id}/swaps/{swap_id}", adminResolveBikeSwap)
+
+	// Incidents (accidents, theft, damage)
+	api.Get("/incidents", adminGetIncidents)
+	api.Post("/shifts/{shift_id}/incidents", adminCreateIncident)
+	func(api syrup.Router) {
+		api.Get("", adminGetIncident)
+		api.Put("", adminUpdateIncident)
+		api.Post("/status", adminSetIncidentStatus)
+		api.Post("/photos", uploadIncidentPhoto)
+		api.Get("/photos/{photo_id}", getIncidentPhoto)
+	}(api.Group("/incidents/{incident_id}", adminIncidentMiddleware))
+
+	// Operating zones and GPS alerts
+	api.Get("/geofences", adminGetGeofences)
+	api.Get("/alerts", adminGetAlerts)
+	api.Post("/alerts/{alert_id}/acknowledge", adminAcknowledgeAlert)
+
+	// Live fleet map, SSE or websocket
+	api.Get("/live", adminLiveFleet)
+	api.Get("/live/ws", adminLiveFleetSocket)
+
 	api.Get("/payroll", adminPayroll)
 
 	// User API
@@ -137,6 +220,8 @@ func adminRouter(api syrup.Router) {
 		api.Get("/shifts", getShifts)
 		api.Get("/shifts/search", shiftSearch)
 		api.Get("/shifts/history", getShiftHistory)
+		// Driving scores by week
+		api.Get("/driving", adminGetUserDriving)
 
 		// Restrict to admins below here (editing & deleting)
 		api.Use(adminMiddleware)
@@ -178,6 +263,16 @@ func adminRouter(api syrup.Router) {
 		api.Post("/name", adminSetUserName)
 		// User privileges
 		api.Put("/privileges", adminUserSetPrivileges)
+		// Payslips
+		api.Get("/payslips", adminGetUserPayslips)
+		// Earnings ledger and manual adjustments
+		api.Get("/transactions", adminGetUserTransactions)
+		api.Post("/transactions", adminAddUserTransaction)
+		// Deposits and card charges
+		api.Get("/payments", adminGetUserPayments)
+		api.Post("/deposit", adminHoldDeposit)
+		api.Post("/charges", adminChargeUser)
+
 		// Block/unblock user
 		api.Post("/block", blockUser)
 		api.Delete("/block", blockUser)
@@ -194,6 +289,48 @@ func adminRouter(api syrup.Router) {
 	api.Post("/bikes", adminSaveBike)
 	api.Put("/bikes/{bike_id}", adminBikeMiddleware, adminSaveBike)
 	api.Post("/bikes/{bike_id}/archive", adminBikeMiddleware, adminDeleteBike)
+	api.Delete("/bikes/{bike_id}/archive", adminBikeMiddleware, adminDeleteBike)
+	api.Post("/bikes/{bike_id}/status", adminBikeMiddleware, adminSetBikeStatus)
+	api.Post("/bikes/{bike_id}/transfer", adminBikeMiddleware, adminTransferBike)
+	api.Delete("/bikes/{bike_id}/fuel/{fuel_id}", adminBikeMiddleware, adminDeleteBikeFuel)
+	api.Put("/incidents/{incident_id}/damage", adminIncidentMiddleware, adminChargeIncidentDamage)
+	api.Delete("/transfers/{transfer_id}", adminCancelBikeTransfer)
+	api.Put("/bikes/{bike_id}/compliance/{compliance_type}", adminBikeMiddleware, adminSaveBikeCompliance)
+	api.Post("/bikes/{bike_id}/compliance/{compliance_type}/evidence", adminBikeMiddleware, adminSetComplianceEvidence)
+
+	// Driving analytics
+	api.Post("/shifts/{shift_id}/driving", adminComputeShiftDriving)
+
+	// Inspection checklists
+	api.Post("/checklists", adminSaveChecklist)
+	api.Put("/checklists/{checklist_id}", adminSaveChecklist)
+	api.Delete("/checklists/{checklist_id}", adminDeleteChecklist)
+
+	// Maintenance plans
+	api.Post("/maintenance-plans", adminSaveMaintenancePlan)
+	api.Put("/maintenance-plans/{plan_id}", adminSaveMaintenancePlan)
+	api.Delete("/maintenance-plans/{plan_id}", adminDeleteMaintenancePlan)
+
+	// Penalty notices (PCNs)
+	api.Get("/fines", adminGetFines)
+	api.Post("/fines", adminCreateFine)
+	func(api syrup.Router) {
+		api.Get("", adminGetFine)
+		api.Put("", adminUpdateFine)
+		api.Post("/assign", adminAssignFine)
+		api.Post("/status", adminSetFineStatus)
+	}(api.Group("/fines/{fine_id}", adminFineMiddleware))
+
+	// Geofences
+	api.Post("/geofences", adminSaveGeofence)
+	api.Put("/geofences/{geofence_id}", adminSaveGeofence)
+	api.Delete("/geofences/{geofence_id}", adminDeleteGeofence)
+
+	// Parts inventory
+	api.Post("/garages/{garage_id}/parts", adminGarageMiddleware, adminSavePart)
+	api.Put("/parts/{part_id}", adminSavePart)
+	api.Delete("/parts/{part_id}", adminDeletePart)
+	api.Post("/parts/{part_id}/stock", adminAdjustPartStock)
 
 	// Garages
 	api.Post("/garages", adminSaveGarage)
@@ -205,4 +342,30 @@ func adminRouter(api syrup.Router) {
 	api.Get("/memberships/stats", adminGetMembershipStats)
 
 	api.Post("/payroll/payout", adminPayout)
+	api.Get("/payslips/{payslip_id}", adminGetPayslip)
+	api.Get("/payroll/export", adminExportPayroll)
+	api.Get("/payroll/tax-years/{year}", adminGetTaxYearSummary)
+	api.Get("/payroll/runs", adminGetPayrollRuns)
+	api.Post("/payroll/runs", adminCreatePayrollRun)
+	func(api syrup.Router) {
+		api.Get("", adminGetPayrollRun)
+		api.Put("/shifts/{shift_id}", adminUpdatePayrollShift)
+		api.Post("/approve", adminApprovePayrollRun)
+		api.Post("/execute", adminExecutePayrollRun)
+		api.Post("/lines/{user_id}/paid", adminPayPayrollLineByHand)
+		api.Delete("", adminCancelPayrollRun)
+		api.Get("/export", adminExportPayrollRun)
+	}(api.Group("/payroll/runs/{run_id}", adminPayrollRunMiddleware))
+
+	// Deposits and card charges
+	func(api syrup.Router) {
+		api.Post("/capture", adminCaptureDeposit)
+		api.Post("/refund", adminRefundCardTransaction)
+	}(api.Group("/payments/{transaction_id}", adminCardTransactionMiddleware))
+
+	// Pay rates
+	api.Get("/rate-cards", adminGetRateCards)
+	api.Post("/rate-cards", adminSaveRateCard)
+	api.Put("/rate-cards/{rate_card_id}", adminSaveRateCard)
+	api.Delete("/rate-cards/{rate_card_id}", adminDeleteRateCard)
 }
@@ -148,6 +148,7 @@ func createShift(w http.ResponseWriter, r *http.Request) {
 	}
 
 	shiftDoc := db.Shift{
+		ID:        bson.NewObjectId(),
 		GarageID:  shift.GarageID,
 		UserID:    userID,
 		ScooterID: foundBike.ID,
@@ -163,6 +164,10 @@ func createShift(w http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 
+	if err := db.RecordShiftEvent(shiftDoc, "created", shiftDoc.AddedBy); err != nil {
+		panic(err)
+	}
+
 	syrup.WriteJSON(w, http.StatusCreated, shiftDoc)
 }
 
@@ -192,15 +197,19 @@ func shiftSearch(w http.ResponseWriter, r *http.Request) {
 		userID = adminUserObj.(db.User).ID
 	}
 
+	syrup.WriteJSON(w, http.StatusOK, db.GetAvailableScooters(garageID, date, membershipMaxCC(userID)))
+}
+
+// membershipMaxCC returns the largest engine a driver may ride, 0 for no limit
+func membershipMaxCC(userID bson.ObjectId) int {
 	var membership db.UserMembership
 	db.Cols.Memberships.Find(db.M{"user_id": userID}).One(&membership)
 
-	maxCC := 0
 	if membership.License == "cbt" {
-		maxCC = 125
+		return 125
 	}
 
-	syrup.WriteJSON(w, http.StatusOK, db.GetAvailableScooters(garageID, date, maxCC))
+	return 0
 }
 
 func cancelShift(w http.ResponseWriter, r *http.Request) {
@@ -227,6 +236,10 @@ func cancelShift(w http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 
+	if err := db.RecordShiftEvent(shift, "cancelled", context.Get(r, "userID").(bson.ObjectId)); err != nil {
+		panic(err)
+	}
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
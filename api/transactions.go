@@ -0,0 +1,143 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gorilla/context"
+	"github.com/maple-ai/fleet-api/db"
+	"github.com/maple-ai/syrup"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// getUserTransactions returns the driver's ledger over ?from=&to= (dd-mm-yyyy)
+func getUserTransactions(w http.ResponseWriter, r *http.Request) {
+	writeTransactions(w, r, context.Get(r, "userID").(bson.ObjectId))
+}
+
+func adminGetUserTransactions(w http.ResponseWriter, r *http.Request) {
+	writeTransactions(w, r, context.Get(r, "admin_user").(db.User).ID)
+}
+
+// adminAddUserTransaction credits (positive amount, pence) or debits the driver, settled by their next payroll run
+func adminAddUserTransaction(w http.ResponseWriter, r *http.Request) {
+	user := context.Get(r, "admin_user").(db.User)
+
+	var body struct {
+		Amount      int64  `json:"amount"`
+		Description string `json:"description"`
+	}
+	if err := syrup.Bind(w, r, &body); err != nil {
+		return
+	}
+
+	errs := []string{}
+	if body.Amount == 0 {
+		errs = append(errs, "Amount cannot be zero")
+	}
+	if len(body.Description) == 0 {
+		errs = append(errs, "A reason for the adjustment is required")
+	}
+
+	if len(errs) > 0 {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"errors": errs,
+		})
+		return
+	}
+
+	entry, err := db.AddTransaction(db.Transaction{
+		UserID:      user.ID,
+		Type:        "adjustment",
+		Amount:      body.Amount,
+		Description: body.Description,
+		CreatedBy:   context.Get(r, "userID").(bson.ObjectId),
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusCreated, entry)
+}
+
+// adminChargeIncidentDamage charges the incident's driver for damage (amount in pence), zero removes the charge
+func adminChargeIncidentDamage(w http.ResponseWriter, r *http.Request) {
+	incident := context.Get(r, "incident").(db.Event)
+
+	var body struct {
+		Amount      int64  `json:"amount"`
+		Description string `json:"description"`
+	}
+	if err := syrup.Bind(w, r, &body); err != nil {
+		return
+	}
+
+	errs := []string{}
+	if !incident.UserID.Valid() {
+		errs = append(errs, "Incident has no driver to charge")
+	}
+	if body.Amount < 0 {
+		errs = append(errs, "Amount cannot be negative")
+	}
+	if len(body.Description) == 0 {
+		body.Description = "Damage: " + incident.Description
+	}
+
+	if len(errs) > 0 {
+		syrup.WriteJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"errors": errs,
+		})
+		return
+	}
+
+	// not both from pay and the card
+	if body.Amount > 0 {
+		if charged, err := db.CardCharged(db.M{"incident_id": incident.ID}); err != nil {
+			panic(err)
+		} else if charged {
+			syrup.WriteJSON(w, http.StatusConflict, map[string]string{
+				"error": "Damage for this incident was charged to the driver's card",
+			})
+			return
+		}
+	}
+
+	if err := db.SetTransaction(db.Transaction{
+		UserID:      incident.UserID,
+		Type:        "damage",
+		Amount:      -body.Amount,
+		Description: body.Description,
+		IncidentID:  incident.ID,
+		ShiftID:     incident.ShiftID,
+		CreatedBy:   context.Get(r, "userID").(bson.ObjectId),
+	}); err == db.ErrTransactionSettled {
+		syrup.WriteJSON(w, http.StatusConflict, map[string]string{
+			"error": "The damage charge is already in a payroll run",
+		})
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeTransactions writes the driver's ledger entries in the report period with running balances
+func writeTransactions(w http.ResponseWriter, r *http.Request, userID bson.ObjectId) {
+	from, to := reportPeriod(r)
+
+	entries, opening, err := db.FindTransactions(userID, from, to)
+	if err != nil {
+		panic(err)
+	}
+
+	closing := opening
+	if len(entries) > 0 {
+		closing = entries[len(entries)-1].Balance
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"opening_balance": opening,
+		"closing_balance": closing,
+		"transactions":    entries,
+	})
+}
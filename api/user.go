@@ -69,6 +69,18 @@ func getUserBilling(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// getUserFines lists penalty notices attributed to the driver
+func getUserFines(w http.ResponseWriter, r *http.Request) {
+	var fines []db.Fine
+	if err := db.Cols.Fines.Find(db.M{
+		"user_id": context.Get(r, "userID").(bson.ObjectId),
+	}).Sort("-offence_at").All(&fines); err != nil {
+		panic(err)
+	}
+
+	syrup.WriteJSON(w, http.StatusOK, fines)
+}
+
 func addUserCard(w http.ResponseWriter, r *http.Request) {
 	user, _ := db.FindUserByID(context.Get(r, "userID").(bson.ObjectId))
 	var body struct {
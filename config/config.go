@@ -14,8 +14,8 @@ import (
 	"os"
 
 	"github.com/gorilla/securecookie"
-	// paypal "github.com/logpacker/PayPal-Go-SDK"
 	mailgun "github.com/mailgun/mailgun-go"
+	"github.com/maple-ai/fleet-api/payout"
 	"github.com/stripe/stripe-go"
 )
 
@@ -34,6 +34,9 @@ var Config struct {
 	CookieHash       string `json:"cookie_hash"`
 	CookieEncryption string `json:"cookie_encryption"`
 
+	// Signs bike handover QR codes, falls back to cookie_hash
+	QRSecret string `json:"qr_secret"`
+
 	Port       string `json:"port"`
 	BugsnagKey string `json:"bugsnag_key"`
 	Google     struct {
@@ -45,6 +48,12 @@ var Config struct {
 	Stripe struct {
 		Secret string `json:"secret"`
 		Pub    string `json:"pub"`
+		// Verifies webhook signatures, from the webhook endpoint in the Stripe dashboard
+		WebhookSecret string `json:"webhook_secret"`
+		// API base URL, e.g. http://localhost:12111 for stripe-mock, empty for Stripe
+		APIURL string `json:"api_url"`
+		// Pence held on the card of drivers without their own bike when approved, 0 for no deposit
+		Deposit int64 `json:"deposit"`
 	} `json:"stripe"`
 
 	GPS struct {
@@ -57,18 +66,70 @@ var Config struct {
 		Account string `json:"account"`
 		ID      string `json:"id"`
 		Secret  string `json:"secret"`
+		Sandbox bool   `json:"sandbox"`
 	} `json:"paypal"`
 
 	Mailgun struct {
 		Domain string `json:"domain"`
 		APIKey string `json:"api_key"`
 	} `json:"mailgun"`
+
+	Compliance struct {
+		// Days before expiry to email admins
+		ReminderDays int `json:"reminder_days"`
+	} `json:"compliance"`
+
+	Incidents struct {
+		// Incidents at or above this level take the bike off road
+		OffRoadLevel string `json:"off_road_level"`
+	} `json:"incidents"`
+
+	Fuel struct {
+		// Fraction above a bike's expected fuel use before a shift is flagged, default 0.5
+		AnomalyTolerance float64 `json:"anomaly_tolerance"`
+		// Pence per litre charged for fuel missing at check-out, 0 to not charge
+		ChargePerLitre int64 `json:"charge_per_litre"`
+	} `json:"fuel"`
+
+	Driving struct {
+		// Speed in mph above which a rider is speeding, default 70
+		SpeedLimit float64 `json:"speed_limit"`
+		// Acceleration and deceleration in m/s² counted as harsh, defaults 3 and 4
+		HarshAcceleration float64 `json:"harsh_acceleration"`
+		HarshBraking      float64 `json:"harsh_braking"`
+		// Fixes further apart than this many seconds are not used to estimate acceleration, default 30
+		MaxSampleGap int `json:"max_sample_gap"`
+		// Share of the membership rating taken from the driving score (0 to 1), 0 leaves ratings alone
+		RatingWeight float64 `json:"rating_weight"`
+		// Highest membership rating, default 5
+		RatingMax int `json:"rating_max"`
+	} `json:"driving"`
+
+	Payroll struct {
+		// Payroll runs must be approved by someone other than the admin who drafted them
+		TwoPersonRule bool `json:"two_person_rule"`
+		// Sends payroll run payouts: "paypal", "fake" for local development, empty to pay drivers by hand
+		PayoutProvider string `json:"payout_provider"`
+		// Accounts posted to by journal exports: codes for Xero, names for QuickBooks
+		Accounts struct {
+			Pay         string `json:"pay"`
+			Adjustments string `json:"adjustments"`
+			Fuel        string `json:"fuel"`
+			Fines       string `json:"fines"`
+			// Shortfalls owed by drivers
+			Debtors string `json:"debtors"`
+			// Account payouts are made from
+			Bank string `json:"bank"`
+		} `json:"accounts"`
+	} `json:"payroll"`
 }
 var Cookie *securecookie.SecureCookie
 
-// var PaypalClient *paypal.Client
 var Mail mailgun.Mailgun
 
+// Payouts sends payroll run payouts, nil when drivers are paid by hand
+var Payouts payout.Provider
+
 func Parse() error {
 	// stage := ""
 	// if gin.Mode() == "release" {
@@ -119,6 +180,55 @@ func Parse() error {
 		Config.Port = ":3000"
 	}
 
+	if Config.Compliance.ReminderDays <= 0 {
+		Config.Compliance.ReminderDays = 30
+	}
+
+	if len(Config.Incidents.OffRoadLevel) == 0 {
+		Config.Incidents.OffRoadLevel = "high"
+	}
+
+	if Config.Fuel.AnomalyTolerance <= 0 {
+		Config.Fuel.AnomalyTolerance = 0.5
+	}
+
+	if Config.Driving.SpeedLimit <= 0 {
+		Config.Driving.SpeedLimit = 70
+	}
+
+	if Config.Driving.HarshAcceleration <= 0 {
+		Config.Driving.HarshAcceleration = 3
+	}
+
+	if Config.Driving.HarshBraking <= 0 {
+		Config.Driving.HarshBraking = 4
+	}
+
+	if Config.Driving.MaxSampleGap <= 0 {
+		Config.Driving.MaxSampleGap = 30
+	}
+
+	if Config.Driving.RatingMax <= 0 {
+		Config.Driving.RatingMax = 5
+	}
+
+	accounts := &Config.Payroll.Accounts
+	for _, account := range []struct {
+		value    *string
+		fallback string
+	}{
+		{&accounts.Pay, "Contractor pay"},
+		{&accounts.Adjustments, "Contractor pay"},
+		{&accounts.Fuel, "Fuel recharges"},
+		{&accounts.Fines, "Fines recovered"},
+		{&accounts.Debtors, "Driver debtors"},
+		{&accounts.Bank, "PayPal"},
+	} {
+		if len(*account.value) == 0 {
+			*account.value = account.fallback
+		}
+	}
+
 	var encryption []byte
 	encryption = nil
 
@@ -129,14 +239,26 @@ func Parse() error {
 
 	Cookie = securecookie.New(hash, encryption)
 	stripe.Key = Config.Stripe.Secret
+	if len(Config.Stripe.APIURL) > 0 {
+		stripe.SetBackend(stripe.APIBackend, stripe.GetBackendWithConfig(stripe.APIBackend, &stripe.BackendConfig{
+			URL: Config.Stripe.APIURL,
+		}))
+	}
 
-	// Setup paypal
-	// if c, err := paypal.NewClient(Config.Paypal.ID, Config.Paypal.Secret, paypal.APIBaseSandBox); err != nil {
-	// 	panic(err)
-	// } else {
-	// 	c.SetLog(os.Stdout)
-	// 	PaypalClient = c
-	// }
+	// Setup payouts
+	switch Config.Payroll.PayoutProvider {
+	case "paypal":
+		endpoint := payout.PayPalLive
+		if Config.Paypal.Sandbox {
+			endpoint = payout.PayPalSandbox
+		}
+		Payouts = payout.NewPayPal(endpoint, Config.Paypal.ID, Config.Paypal.Secret)
+	case "fake":
+		Payouts = payout.NewFake()
+	case "":
+	default:
+		return fmt.Errorf("Unknown payout provider %q", Config.Payroll.PayoutProvider)
+	}
 
 	// Setup mailgun
 	Mail = mailgun.NewMailgun(Config.Mailgun.Domain, Config.Mailgun.APIKey)
@@ -148,3 +270,13 @@ func GetGPSAuthorization() string {
 	str := Config.GPS.Email + ":" + Config.GPS.Password
 	return "Basic " + base64.StdEncoding.EncodeToString([]byte(str))
 }
+
+// GetQRSecret returns the key used to sign bike handover QR codes
+func GetQRSecret() []byte {
+	if len(Config.QRSecret) > 0 {
+		return []byte(Config.QRSecret)
+	}
+
+	hash, _ := base64.StdEncoding.DecodeString(Config.CookieHash)
+	return hash
+}
@@ -1,12 +1,20 @@
 package db
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
 	"time"
 
+	"github.com/maple-ai/fleet-api/config"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
+const bikeQRPrefix = "maple-fleet:bike:"
+
 type Bike struct {
 	ID       bson.ObjectId `bson:"_id,omitempty" json:"_id"`
 	GarageID bson.ObjectId `bson:"garage_id" json:"garage_id"`
@@ -18,6 +26,15 @@ type Bike struct {
 	Price            int64  `json:"price"`
 	Available        bool   `json:"available"`
 	EngineSize       int    `bson:"engine_size" json:"engine_size"`
+	Model            string `json:"model"`
+
+	// Latest odometer reading in miles
+	Odometer        int       `json:"odometer" bson:"odometer"`
+	OdometerUpdated time.Time `json:"odometer_updated" bson:"odometer_updated,omitempty"`
+
+	// Litres, and expected miles per litre for spotting unusual fuel use
+	TankCapacity float64 `json:"tank_capacity" bson:"tank_capacity"`
+	FuelEconomy  float64 `json:"fuel_economy" bson:"fuel_economy"`
 
 	Created   time.Time     `json:"created"`
 	CreatedBy bson.ObjectId `json:"created_by" bson:"created_by,omitempty"`
@@ -26,6 +43,13 @@ type Bike struct {
 	PhoneNumber string `json:"phone_number" bson:"phone_number"`
 	DeviceID    string `json:"device_id" bson:"device_id"`
 
+	// Lifecycle status (BikeStatus*), only changed through SetBikeStatus
+	Status        string        `json:"status"`
+	StatusReason  string        `json:"status_reason" bson:"status_reason"`
+	StatusChanged time.Time     `json:"status_changed" bson:"status_changed,omitempty"`
+	StatusBy      bson.ObjectId `json:"status_by" bson:"status_by,omitempty"`
+
+	// Available and Archived are derived from Status for older clients
 	Archived       bool          `json:"archived"`
 	ArchivedReason string        `json:"archived_reason" bson:"archived_reason"`
 	ArchivedBy     bson.ObjectId `json:"archived_by" bson:"archived_by,omitempty"`
@@ -40,7 +64,21 @@ type BikeHistory struct {
 
 	Condition string `json:"condition"`
 	Notes     string `json:"notes"`
-	FuelLevel int    `bson:"fuel_level" json:"fuel_level"`
+
+	// Tank levels as a percentage, FuelLevel is at check-out. Nil until recorded, 0 is an empty tank
+	FuelLevelStart *int `bson:"fuel_level_start,omitempty" json:"fuel_level_start"`
+	FuelLevel      *int `bson:"fuel_level,omitempty" json:"fuel_level"`
+	// Litres used over the shift including refuels, FuelAnomaly when far above the bike's economy
+	FuelUsed    float64 `bson:"fuel_used" json:"fuel_used"`
+	FuelAnomaly bool    `bson:"fuel_anomaly" json:"fuel_anomaly"`
+
+	// Odometer readings (miles) captured at check-in/out
+	OdometerStart int `bson:"odometer_start" json:"odometer_start"`
+	OdometerEnd   int `bson:"odometer_end" json:"odometer_end"`
+	Distance      int `bson:"distance" json:"distance"`
+	// Distance driven according to the GPS tracker, if the bike has one
+	GPSDistance      float64 `bson:"gps_distance" json:"gps_distance"`
+	DistanceMismatch bool    `bson:"distance_mismatch" json:"distance_mismatch"`
 
 	LockedUp        bool `json:"locked_up" bson:"locked_up"`
 	ClothesReturned bool `json:"clothes_returned" bson:"clothes_returned"`
@@ -50,11 +88,62 @@ type BikeHistory struct {
 	MechanicAlertReason string `bson:"mechanic_alert_reason" json:"mechanic_alert_reason"`
 }
 
+// OdometerReading is a mileage reading taken at shift handover
+type OdometerReading struct {
+	ID      bson.ObjectId `bson:"_id,omitempty" json:"_id"`
+	BikeID  bson.ObjectId `bson:"bike_id" json:"bike_id"`
+	ShiftID bson.ObjectId `bson:"shift_id,omitempty" json:"shift_id"`
+
+	// check-in/check-out
+	Stage   string `json:"stage"`
+	Reading int    `json:"reading"`
+
+	RecordedBy bson.ObjectId `bson:"recorded_by" json:"recorded_by"`
+	RecordedAt time.Time     `bson:"recorded_at" json:"recorded_at"`
+}
+
+var ErrOdometerDecreased = errors.New("Odometer reading is lower than the last recorded reading")
+
+// RecordOdometer stores a reading and moves the bike's odometer forward.
+// Readings must never be lower than the bike's current odometer.
+func RecordOdometer(reading OdometerReading) error {
+	var bike Bike
+	if err := Cols.Bikes.FindId(reading.BikeID).One(&bike); err != nil {
+		return err
+	}
+
+	if reading.Reading < bike.Odometer {
+		return ErrOdometerDecreased
+	}
+
+	reading.ID = bson.NewObjectId()
+	if err := Cols.Mileage.Insert(&reading); err != nil {
+		return err
+	}
+
+	return Cols.Bikes.UpdateId(bike.ID, M{
+		"$max": M{"odometer": reading.Reading},
+		"$set": M{"odometer_updated": reading.RecordedAt},
+	})
+}
+
 type BikeMaintenance struct {
-	ID            bson.ObjectId `bson:"_id,omitempty" json:"_id"`
-	BikeID        bson.ObjectId `bson:"bike_id" json:"bike_id"`
-	Notes         string        `json:"notes"`
-	HasAttachment bool          `json:"has_attachment" bson:"has_attachment"`
+	ID     bson.ObjectId `bson:"_id,omitempty" json:"_id"`
+	BikeID bson.ObjectId `bson:"bike_id" json:"bike_id"`
+	Notes  string        `json:"notes"`
+
+	// HasAttachment is derived from Attachments for older clients
+	Attachments   []MaintenanceAttachment `json:"attachments" bson:"attachments"`
+	HasAttachment bool                    `json:"has_attachment" bson:"has_attachment"`
+
+	// Set when the work carries out a maintenance plan
+	PlanID   bson.ObjectId `json:"plan_id" bson:"plan_id,omitempty"`
+	Odometer int           `json:"odometer" bson:"odometer"`
+
+	// Parts taken from the garage's stock. Costs in pence, PartsCost is derived from Parts.
+	Parts      []PartUsage `json:"parts" bson:"parts"`
+	PartsCost  int64       `json:"parts_cost" bson:"parts_cost"`
+	LabourCost int64       `json:"labour_cost" bson:"labour_cost"`
 
 	CheckedBy bson.ObjectId `bson:"checked_by" json:"checked_by"`
 	CheckedAt time.Time     `bson:"checked_at" json:"checked_at"`
@@ -62,10 +151,73 @@ type BikeMaintenance struct {
 	MechanicRequired bool `json:"mechanic_required" bson:"mechanic_required"`
 }
 
+// MaintenanceAttachment is a file stored in the "maintenance" GridFS bucket
+type MaintenanceAttachment struct {
+	ID          bson.ObjectId `json:"_id" bson:"_id"`
+	Filename    string        `json:"filename" bson:"filename"`
+	ContentType string        `json:"content_type" bson:"content_type"`
+	Size        int64         `json:"size" bson:"size"`
+
+	// Set for images
+	ThumbnailID bson.ObjectId `json:"thumbnail_id" bson:"thumbnail_id,omitempty"`
+
+	UploadedBy bson.ObjectId `json:"uploaded_by" bson:"uploaded_by,omitempty"`
+	UploadedAt time.Time     `json:"uploaded_at" bson:"uploaded_at"`
+}
+
+// MigrateMaintenanceAttachments lists files uploaded when logs could only have one attachment,
+// which were stored under the log's ID
+func MigrateMaintenanceAttachments() error {
+	var logs []BikeMaintenance
+	if err := Cols.BikeMaintenance.Find(M{
+		"has_attachment": true,
+		"attachments":    M{"$exists": false},
+	}).All(&logs); err != nil {
+		return err
+	}
+
+	gridFS := DB.GridFS("maintenance")
+	for _, log := range logs {
+		var files []struct {
+			ID          bson.ObjectId `bson:"_id"`
+			ContentType string        `bson:"contentType"`
+			Length      int64         `bson:"length"`
+			UploadDate  time.Time     `bson:"uploadDate"`
+			Metadata    struct {
+				Name string `bson:"name"`
+			} `bson:"metadata"`
+		}
+		if err := gridFS.Find(M{"filename": log.ID.Hex()}).Sort("uploadDate").All(&files); err != nil {
+			return err
+		}
+
+		attachments := []MaintenanceAttachment{}
+		for _, file := range files {
+			attachments = append(attachments, MaintenanceAttachment{
+				ID:          file.ID,
+				Filename:    file.Metadata.Name,
+				ContentType: file.ContentType,
+				Size:        file.Length,
+				UploadedAt:  file.UploadDate,
+			})
+		}
+
+		if err := Cols.BikeMaintenance.UpdateId(log.ID, M{"$set": M{
+			"attachments":    attachments,
+			"has_attachment": len(attachments) > 0,
+		}}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 type Garage struct {
 	ID bson.ObjectId `bson:"_id,omitempty" json:"_id"`
 
 	Name     string `json:"name"`
+	City     string `json:"city"`
 	Location struct {
 		Lat float64 `json:"lat"`
 		Lng float64 `json:"lng"`
@@ -91,3 +243,34 @@ func FindGarageByID(ID bson.ObjectId) (*Garage, error) {
 
 	return &garage, nil
 }
+
+// QRPayload returns the signed content printed on the bike's handover QR code
+func (bike *Bike) QRPayload() string {
+	return bikeQRPrefix + bike.ID.Hex() + ":" + signBikeID(bike.ID)
+}
+
+// ParseBikeQRPayload verifies a scanned QR payload and returns the bike it was issued for
+func ParseBikeQRPayload(payload string) (bson.ObjectId, error) {
+	if !strings.HasPrefix(payload, bikeQRPrefix) {
+		return "", errors.New("Not a bike QR code")
+	}
+
+	parts := strings.Split(strings.TrimPrefix(payload, bikeQRPrefix), ":")
+	if len(parts) != 2 || !bson.IsObjectIdHex(parts[0]) {
+		return "", errors.New("Malformed bike QR code")
+	}
+
+	bikeID := bson.ObjectIdHex(parts[0])
+	if !hmac.Equal([]byte(parts[1]), []byte(signBikeID(bikeID))) {
+		return "", errors.New("Bike QR code signature invalid")
+	}
+
+	return bikeID, nil
+}
+
+func signBikeID(ID bson.ObjectId) string {
+	mac := hmac.New(sha256.New, config.GetQRSecret())
+	mac.Write([]byte(ID.Hex()))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
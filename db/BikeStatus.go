@@ -0,0 +1,132 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Bike lifecycle statuses
+const (
+	BikeStatusInService     = "in_service"
+	BikeStatusReserved      = "reserved"
+	BikeStatusMaintenance   = "maintenance"
+	BikeStatusOffRoad       = "off_road"
+	BikeStatusAwaitingParts = "awaiting_parts"
+	BikeStatusSold          = "sold"
+	BikeStatusWrittenOff    = "written_off"
+)
+
+// BikeStatuses maps statuses to display names
+var BikeStatuses = map[string]string{
+	BikeStatusInService:     "In service",
+	BikeStatusReserved:      "Reserved",
+	BikeStatusMaintenance:   "In maintenance",
+	BikeStatusOffRoad:       "Off road",
+	BikeStatusAwaitingParts: "Awaiting parts",
+	BikeStatusSold:          "Sold",
+	BikeStatusWrittenOff:    "Written off",
+}
+
+// RetiredBikeStatuses have left the fleet (archived)
+var RetiredBikeStatuses = []string{BikeStatusSold, BikeStatusWrittenOff}
+
+// BikeStatusChange is an entry in a bike's status history
+type BikeStatusChange struct {
+	ID     bson.ObjectId `bson:"_id,omitempty" json:"_id"`
+	BikeID bson.ObjectId `bson:"bike_id" json:"bike_id"`
+
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Reason string `json:"reason"`
+
+	ChangedBy bson.ObjectId `bson:"changed_by,omitempty" json:"changed_by"`
+	ChangedAt time.Time     `bson:"changed_at" json:"changed_at"`
+}
+
+// IsRetiredBikeStatus is true for statuses where the bike has left the fleet
+func IsRetiredBikeStatus(status string) bool {
+	for _, retired := range RetiredBikeStatuses {
+		if status == retired {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Retired is true when the bike has been sold or written off
+func (bike *Bike) Retired() bool {
+	return IsRetiredBikeStatus(bike.Status)
+}
+
+// SetBikeStatus moves a bike to a new status, recording who changed it and why
+func SetBikeStatus(bike Bike, status string, reason string, by bson.ObjectId) (*BikeStatusChange, error) {
+	if _, ok := BikeStatuses[status]; !ok {
+		return nil, errors.New("Unknown status: " + status)
+	}
+
+	if len(reason) == 0 {
+		return nil, errors.New("Please provide a reason for the status change")
+	}
+
+	if bike.Status == status {
+		return nil, errors.New("Bike is already " + BikeStatuses[status])
+	}
+
+	change := BikeStatusChange{
+		ID:        bson.NewObjectId(),
+		BikeID:    bike.ID,
+		From:      bike.Status,
+		To:        status,
+		Reason:    reason,
+		ChangedBy: by,
+		ChangedAt: time.Now(),
+	}
+
+	set := M{
+		"status":         status,
+		"status_reason":  reason,
+		"status_changed": change.ChangedAt,
+		"status_by":      by,
+		"available":      status == BikeStatusInService,
+		"archived":       IsRetiredBikeStatus(status),
+	}
+
+	if IsRetiredBikeStatus(status) {
+		set["archived_reason"] = reason
+		set["archived_by"] = by
+	}
+
+	if err := Cols.Bikes.UpdateId(bike.ID, M{"$set": set}); err != nil {
+		return nil, err
+	}
+
+	if err := Cols.BikeStatus.Insert(&change); err != nil {
+		return nil, err
+	}
+
+	return &change, nil
+}
+
+// MigrateBikeStatus derives Status for bikes added before statuses existed
+func MigrateBikeStatus() error {
+	migrations := []struct {
+		query  M
+		status string
+	}{
+		{M{"archived": true}, BikeStatusWrittenOff},
+		{M{"archived": M{"$ne": true}, "available": false}, BikeStatusOffRoad},
+		{M{"archived": M{"$ne": true}, "available": true}, BikeStatusInService},
+	}
+
+	for _, migration := range migrations {
+		migration.query["status"] = M{"$exists": false}
+		if _, err := Cols.Bikes.UpdateAll(migration.query, M{"$set": M{"status": migration.status}}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package db
+
+import (
+	"sort"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// BikeTransfer moves a bike between garages, immediately or at a scheduled time
+type BikeTransfer struct {
+	ID           bson.ObjectId `bson:"_id,omitempty" json:"_id"`
+	BikeID       bson.ObjectId `bson:"bike_id" json:"bike_id"`
+	FromGarageID bson.ObjectId `bson:"from_garage_id" json:"from_garage_id"`
+	ToGarageID   bson.ObjectId `bson:"to_garage_id" json:"to_garage_id"`
+	Reason       string        `json:"reason"`
+
+	Effective time.Time `json:"effective"`
+	// scheduled/complete/cancelled
+	Status string `json:"status"`
+
+	// Future shifts at the old garage which were booked on the bike
+	AffectedShifts []TransferredShift `bson:"affected_shifts" json:"affected_shifts"`
+
+	Created     time.Time     `json:"created"`
+	CreatedBy   bson.ObjectId `bson:"created_by" json:"created_by"`
+	CompletedAt time.Time     `bson:"completed_at,omitempty" json:"completed_at"`
+}
+
+type TransferredShift struct {
+	ShiftID bson.ObjectId `bson:"shift_id" json:"shift_id"`
+	UserID  bson.ObjectId `bson:"user_id" json:"user_id"`
+	Date    time.Time     `json:"date"`
+	// Bike at the old garage the shift was (or could be) moved to, empty if none are free
+	NewBikeID  bson.ObjectId `bson:"new_bike_id,omitempty" json:"new_bike_id"`
+	Reassigned bool          `json:"reassigned"`
+}
+
+// GarageStay is a period a bike spent at a garage. Left is zero while the bike is still there.
+type GarageStay struct {
+	BikeID  bson.ObjectId `json:"bike_id"`
+	Arrived time.Time     `json:"arrived"`
+	Left    time.Time     `json:"left"`
+}
+
+// FindTransferAffectedShifts returns the bike's upcoming shifts at its current garage from a date
+func FindTransferAffectedShifts(bike Bike, from time.Time) ([]Shift, error) {
+	var shifts []Shift
+	err := Cols.Shifts.Find(M{
+		"scooter_id": bike.ID,
+		"garage_id":  bike.GarageID,
+		"date":       M{"$gte": from},
+		"deleted":    false,
+		"status":     M{"$in": []string{"created", "confirmed"}},
+	}).Sort("date").All(&shifts)
+
+	return shifts, err
+}
+
+// FindTransferringBikeIDs returns bikes with a scheduled transfer effective by the date, which can't be booked
+// at their current garage from then
+func FindTransferringBikeIDs(date time.Time) ([]bson.ObjectId, error) {
+	bikeIDs := []bson.ObjectId{}
+	err := Cols.Transfers.Find(M{
+		"status":    "scheduled",
+		"effective": M{"$lte": date},
+	}).Distinct("bike_id", &bikeIDs)
+
+	return bikeIDs, err
+}
+
+// CompleteBikeTransfer moves the bike to the destination garage. Only scheduled transfers are completed,
+// so concurrent callers complete a transfer once.
+func CompleteBikeTransfer(transfer BikeTransfer) error {
+	if err := Cols.Transfers.Update(M{
+		"_id":    transfer.ID,
+		"status": "scheduled",
+	}, M{"$set": M{
+		"status":       "complete",
+		"completed_at": time.Now(),
+	}}); err != nil {
+		return err
+	}
+
+	return Cols.Bikes.UpdateId(transfer.BikeID, M{"$set": M{"garage_id": transfer.ToGarageID}})
+}
+
+// GarageFleetHistory returns every period a bike spent at the garage, derived from completed transfers
+func GarageFleetHistory(garageID bson.ObjectId) ([]GarageStay, error) {
+	var transfers []BikeTransfer
+	if err := Cols.Transfers.Find(M{
+		"status": "complete",
+		"$or": []M{
+			{"from_garage_id": garageID},
+			{"to_garage_id": garageID},
+		},
+	}).Sort("completed_at").All(&transfers); err != nil {
+		return nil, err
+	}
+
+	byBike := map[bson.ObjectId][]BikeTransfer{}
+	bikeIDs := []bson.ObjectId{}
+	for _, transfer := range transfers {
+		if _, ok := byBike[transfer.BikeID]; !ok {
+			bikeIDs = append(bikeIDs, transfer.BikeID)
+		}
+
+		byBike[transfer.BikeID] = append(byBike[transfer.BikeID], transfer)
+	}
+
+	// bikes in the garage which never moved, or moved out since being added
+	var bikes []Bike
+	if err := Cols.Bikes.Find(M{
+		"$or": []M{
+			{"garage_id": garageID},
+			{"_id": M{"$in": bikeIDs}},
+		},
+	}).Select(M{"created": 1, "garage_id": 1}).All(&bikes); err != nil {
+		return nil, err
+	}
+
+	stays := []GarageStay{}
+	for _, bike := range bikes {
+		bikeTransfers := byBike[bike.ID]
+
+		var stay *GarageStay
+		if len(bikeTransfers) == 0 || bikeTransfers[0].FromGarageID == garageID {
+			stay = &GarageStay{BikeID: bike.ID, Arrived: bike.Created}
+		}
+
+		for _, transfer := range bikeTransfers {
+			if transfer.FromGarageID == garageID && stay != nil {
+				stay.Left = transfer.CompletedAt
+				stays = append(stays, *stay)
+				stay = nil
+			}
+
+			if transfer.ToGarageID == garageID {
+				stay = &GarageStay{BikeID: bike.ID, Arrived: transfer.CompletedAt}
+			}
+		}
+
+		if stay != nil {
+			stays = append(stays, *stay)
+		}
+	}
+
+	sort.Slice(stays, func(i, j int) bool {
+		return stays[i].Arrived.Before(stays[j].Arrived)
+	})
+
+	return stays, nil
+}
@@ -0,0 +1,151 @@
+package db
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ChecklistItem is a single line on an inspection checklist
+type ChecklistItem struct {
+	Key   string `json:"key"`
+	Label string `json:"label"`
+
+	// check (pass/fail) or reading (numeric, e.g. fuel, odometer)
+	Kind string `json:"kind"`
+	Unit string `json:"unit"`
+
+	Required bool `json:"required"`
+	// Number of photos which must be attached to the item
+	Photos int `json:"photos"`
+	// Failing a critical item raises a maintenance log
+	Critical bool `json:"critical"`
+}
+
+// Checklist applies to bikes in a garage and/or of a model. Empty GarageID/Model matches any.
+type Checklist struct {
+	ID       bson.ObjectId `bson:"_id,omitempty" json:"_id"`
+	Name     string        `json:"name"`
+	GarageID bson.ObjectId `bson:"garage_id,omitempty" json:"garage_id"`
+	Model    string        `json:"model"`
+
+	Items []ChecklistItem `json:"items"`
+
+	Created   time.Time     `json:"created"`
+	CreatedBy bson.ObjectId `json:"created_by" bson:"created_by,omitempty"`
+}
+
+type InspectionResult struct {
+	Key     string   `json:"key"`
+	Passed  bool     `json:"passed"`
+	Reading *float64 `json:"reading,omitempty" bson:"reading,omitempty"`
+	Notes   string   `json:"notes"`
+	// GridFS IDs from the `inspections` bucket
+	Photos []bson.ObjectId `json:"photos"`
+}
+
+// BikeInspection is a completed checklist, one per shift per stage
+type BikeInspection struct {
+	ID          bson.ObjectId `bson:"_id,omitempty" json:"_id"`
+	ShiftID     bson.ObjectId `bson:"shift_id" json:"shift_id"`
+	BikeID      bson.ObjectId `bson:"bike_id" json:"bike_id"`
+	ChecklistID bson.ObjectId `bson:"checklist_id" json:"checklist_id"`
+
+	// check-in/check-out
+	Stage   string             `json:"stage"`
+	Results []InspectionResult `json:"results"`
+
+	// Keys which passed at check-in but failed at check-out, attributed to the shift
+	NewDamage []string `json:"new_damage" bson:"new_damage"`
+	// Maintenance log raised for failed critical items
+	MaintenanceID bson.ObjectId `json:"maintenance_id" bson:"maintenance_id,omitempty"`
+
+	CheckedBy bson.ObjectId `bson:"checked_by" json:"checked_by"`
+	CheckedAt time.Time     `bson:"checked_at" json:"checked_at"`
+}
+
+// FindChecklist returns the most specific checklist for a bike (garage and model, model, garage, default)
+func FindChecklist(bike Bike) (*Checklist, error) {
+	var checklists []Checklist
+	if err := Cols.Checklists.Find(M{
+		"garage_id": M{"$in": []interface{}{bike.GarageID, nil}},
+		"model":     M{"$in": []string{bike.Model, ""}},
+	}).All(&checklists); err != nil {
+		return nil, err
+	}
+
+	var found *Checklist
+	best := -1
+	for i, checklist := range checklists {
+		score := 0
+		if checklist.Model != "" {
+			score += 2
+		}
+		if checklist.GarageID.Valid() {
+			score++
+		}
+
+		if score > best {
+			best = score
+			found = &checklists[i]
+		}
+	}
+
+	return found, nil
+}
+
+// Result returns the result recorded for a checklist item key
+func (inspection *BikeInspection) Result(key string) *InspectionResult {
+	for i := range inspection.Results {
+		if inspection.Results[i].Key == key {
+			return &inspection.Results[i]
+		}
+	}
+
+	return nil
+}
+
+// Validate returns a list of problems with the inspection against its checklist
+func (inspection *BikeInspection) Validate(checklist *Checklist) []string {
+	errs := []string{}
+
+	for _, item := range checklist.Items {
+		result := inspection.Result(item.Key)
+		switch {
+		case result == nil && item.Required:
+			errs = append(errs, item.Label+": required")
+		case result == nil:
+			continue
+		case item.Kind == "reading" && result.Reading == nil && item.Required:
+			errs = append(errs, item.Label+": reading required")
+		case len(result.Photos) < item.Photos:
+			errs = append(errs, item.Label+": photos required")
+		}
+	}
+
+	return errs
+}
+
+// FailedCritical returns labels of critical items which failed
+func (inspection *BikeInspection) FailedCritical(checklist *Checklist) []string {
+	failed := []string{}
+	for _, item := range checklist.Items {
+		if result := inspection.Result(item.Key); item.Critical && result != nil && !result.Passed {
+			failed = append(failed, item.Label)
+		}
+	}
+
+	return failed
+}
+
+// DiffInspections returns the keys which passed before but fail after
+func DiffInspections(before *BikeInspection, after *BikeInspection) []string {
+	damage := []string{}
+	for _, result := range after.Results {
+		if previous := before.Result(result.Key); previous != nil && previous.Passed && !result.Passed {
+			damage = append(damage, result.Key)
+		}
+	}
+
+	return damage
+}
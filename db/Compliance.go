@@ -0,0 +1,74 @@
+package db
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ComplianceTypes maps compliance record types to display names
+var ComplianceTypes = map[string]string{
+	"mot":          "MOT",
+	"road_tax":     "Road tax",
+	"insurance":    "Insurance",
+	"registration": "Registration",
+}
+
+// BikeCompliance is a road-legal document with an expiry, one per bike per type
+type BikeCompliance struct {
+	ID     bson.ObjectId `bson:"_id,omitempty" json:"_id"`
+	BikeID bson.ObjectId `bson:"bike_id" json:"bike_id"`
+
+	// mot/road_tax/insurance/registration
+	Type      string    `json:"type"`
+	Reference string    `json:"reference"`
+	Expiry    time.Time `json:"expiry"`
+
+	// GridFS file in the `compliance` bucket
+	EvidenceID bson.ObjectId `bson:"evidence_id,omitempty" json:"evidence_id"`
+
+	Updated   time.Time     `json:"updated"`
+	UpdatedBy bson.ObjectId `json:"updated_by" bson:"updated_by,omitempty"`
+	// Last expiry reminder sent to admins
+	RemindedAt time.Time `json:"reminded_at" bson:"reminded_at,omitempty"`
+}
+
+// Lapsed is true once the document has expired
+func (compliance *BikeCompliance) Lapsed() bool {
+	return compliance.Expiry.Before(time.Now())
+}
+
+// FindBikeCompliance returns all compliance records for a bike
+func FindBikeCompliance(bikeID bson.ObjectId) ([]BikeCompliance, error) {
+	var records []BikeCompliance
+	err := Cols.Compliance.Find(M{"bike_id": bikeID}).Sort("expiry").All(&records)
+
+	return records, err
+}
+
+// GetComplianceIssues describes every lapsed document for the bike
+func GetComplianceIssues(bikeID bson.ObjectId) ([]string, error) {
+	records, err := FindBikeCompliance(bikeID)
+	if err != nil {
+		return nil, err
+	}
+
+	issues := []string{}
+	for _, record := range records {
+		if record.Lapsed() {
+			issues = append(issues, ComplianceTypes[record.Type]+" expired on "+record.Expiry.Format("02/01/2006"))
+		}
+	}
+
+	return issues, nil
+}
+
+// FindLapsedBikeIDs returns bikes with at least one lapsed document
+func FindLapsedBikeIDs() ([]bson.ObjectId, error) {
+	bikeIDs := []bson.ObjectId{}
+	err := Cols.Compliance.Find(M{
+		"expiry": M{"$lt": time.Now()},
+	}).Distinct("bike_id", &bikeIDs)
+
+	return bikeIDs, err
+}
@@ -0,0 +1,192 @@
+package db
+
+import (
+	"math"
+	"time"
+
+	"github.com/maple-ai/fleet-api/config"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	knotsToMPH = 1.15078
+	knotsToMPS = 0.514444
+	// Driving scores averaged into the membership
+	drivingScoreShifts = 20
+)
+
+// DrivingSummary is how a shift was ridden, worked out from stored positions.
+// Speeds are mph, acceleration events are estimated from the speed reported at consecutive fixes.
+type DrivingSummary struct {
+	Samples  int     `bson:"samples" json:"samples"`
+	Distance float64 `bson:"distance" json:"distance"`
+
+	MovingTime   time.Duration `bson:"moving_time" json:"moving_time"`
+	IdleTime     time.Duration `bson:"idle_time" json:"idle_time"`
+	MaxSpeed     float64       `bson:"max_speed" json:"max_speed"`
+	AverageSpeed float64       `bson:"average_speed" json:"average_speed"`
+
+	HarshAccelerations int           `bson:"harsh_accelerations" json:"harsh_accelerations"`
+	HarshBraking       int           `bson:"harsh_braking" json:"harsh_braking"`
+	SpeedingEvents     int           `bson:"speeding_events" json:"speeding_events"`
+	SpeedingTime       time.Duration `bson:"speeding_time" json:"speeding_time"`
+
+	// 0 to 100, lower for harsh events per hour moving and time spent speeding
+	Score    float64   `bson:"score" json:"score"`
+	Computed time.Time `bson:"computed" json:"computed"`
+}
+
+// SummariseDriving works out driving metrics from positions sorted by fix time
+func SummariseDriving(positions []Position) DrivingSummary {
+	summary := DrivingSummary{
+		Samples:  len(positions),
+		Score:    100,
+		Computed: time.Now(),
+	}
+
+	maxGap := time.Duration(config.Config.Driving.MaxSampleGap) * time.Second
+	speeding := false
+	// moving time without the cap, as the distance covers the whole gap between fixes
+	var travelling time.Duration
+	for i, position := range positions {
+		if speed := position.Speed * knotsToMPH; speed > summary.MaxSpeed {
+			summary.MaxSpeed = speed
+		}
+
+		if i == 0 {
+			continue
+		}
+
+		previous := positions[i-1]
+		summary.Distance += DistanceMiles(previous.Latitude, previous.Longitude, position.Latitude, position.Longitude)
+
+		gap := position.FixTime.Sub(previous.FixTime)
+		if gap <= 0 {
+			continue
+		}
+
+		// Time between distant fixes is unknown, count at most maxGap of it
+		interval := gap
+		if interval > maxGap {
+			interval = maxGap
+		}
+
+		if previous.Speed > AlertMovingSpeed {
+			summary.MovingTime += interval
+			travelling += gap
+		} else {
+			summary.IdleTime += interval
+		}
+
+		if previous.Speed*knotsToMPH > config.Config.Driving.SpeedLimit {
+			summary.SpeedingTime += interval
+			if !speeding {
+				summary.SpeedingEvents++
+			}
+			speeding = true
+		} else {
+			speeding = false
+		}
+
+		if gap > maxGap {
+			continue
+		}
+
+		acceleration := (position.Speed - previous.Speed) * knotsToMPS / gap.Seconds()
+		if acceleration >= config.Config.Driving.HarshAcceleration {
+			summary.HarshAccelerations++
+		} else if -acceleration >= config.Config.Driving.HarshBraking {
+			summary.HarshBraking++
+		}
+	}
+
+	if summary.MovingTime > 0 {
+		hours := summary.MovingTime.Hours()
+		summary.AverageSpeed = summary.Distance / travelling.Hours()
+
+		harshPerHour := float64(summary.HarshAccelerations+summary.HarshBraking) / hours
+		speedingShare := float64(summary.SpeedingTime) / float64(summary.MovingTime)
+		summary.Score = math.Max(0, math.Min(100, 100-5*harshPerHour-100*speedingShare))
+	}
+
+	return summary
+}
+
+// ComputeShiftDriving stores the driving summary for a shift that has been checked in
+func ComputeShiftDriving(shift Shift) (DrivingSummary, error) {
+	to := shift.CheckOut
+	if to.IsZero() {
+		to = time.Now()
+	}
+
+	var positions []Position
+	if err := Cols.Positions.Find(M{
+		"bike_id":  shift.ScooterID,
+		"fix_time": M{"$gte": shift.CheckIn, "$lte": to},
+	}).Sort("fix_time").All(&positions); err != nil {
+		return DrivingSummary{}, err
+	}
+
+	summary := SummariseDriving(positions)
+	if err := Cols.Shifts.UpdateId(shift.ID, M{"$set": M{"driving": summary}}); err != nil {
+		return DrivingSummary{}, err
+	}
+
+	return summary, nil
+}
+
+// UpdateDrivingScore averages the driver's recent driving scores into their membership,
+// and into the rating when config.Driving.RatingWeight is set
+func UpdateDrivingScore(userID bson.ObjectId) error {
+	var shifts []Shift
+	if err := Cols.Shifts.Find(M{
+		"user_id":         userID,
+		"driving.samples": M{"$gte": 2},
+	}).Sort("-check_in").Limit(drivingScoreShifts).All(&shifts); err != nil {
+		return err
+	}
+
+	if len(shifts) == 0 {
+		return nil
+	}
+
+	total := 0.0
+	for _, shift := range shifts {
+		total += shift.Driving.Score
+	}
+
+	var membership UserMembership
+	if err := Cols.Memberships.Find(M{"user_id": userID}).One(&membership); err != nil {
+		return err
+	}
+
+	membership.DrivingScore = total / float64(len(shifts))
+	membership.DrivingShifts = len(shifts)
+
+	manual := membership.Rating
+	if membership.ManualRating != nil {
+		manual = *membership.ManualRating
+	}
+
+	return Cols.Memberships.UpdateId(membership.MID, M{"$set": M{
+		"driving_score":  membership.DrivingScore,
+		"driving_shifts": membership.DrivingShifts,
+		"manual_rating":  manual,
+		"rating":         MembershipRating(membership, manual),
+	}})
+}
+
+// MembershipRating blends a rating given by staff with the driving score, by config.Driving.RatingWeight
+func MembershipRating(membership UserMembership, manual int) int {
+	weight := config.Config.Driving.RatingWeight
+	if weight <= 0 || membership.DrivingShifts == 0 {
+		return manual
+	}
+
+	if weight > 1 {
+		weight = 1
+	}
+
+	driving := membership.DrivingScore / 100 * float64(config.Config.Driving.RatingMax)
+	return int(math.Floor((1-weight)*float64(manual) + weight*driving + 0.5))
+}
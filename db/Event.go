@@ -1,11 +1,101 @@
 package db
 
-import "gopkg.in/mgo.v2/bson"
+import (
+	"time"
 
+	"gopkg.in/mgo.v2/bson"
+)
+
+// EventLevels in increasing severity
+var EventLevels = []string{"low", "medium", "high", "critical"}
+
+// IncidentTypes maps incident types to display names
+var IncidentTypes = map[string]string{
+	"accident": "Accident",
+	"theft":    "Theft",
+	"damage":   "Damage",
+	"other":    "Other",
+}
+
+// IncidentStatuses in workflow order
+var IncidentStatuses = []string{"reported", "investigating", "claim_filed", "closed"}
+
+// Event is something that happened to a bike. Type "incident" is filed against a shift by the driver or a supervisor,
+// AlertTypes are raised from GPS positions.
 type Event struct {
 	ID bson.ObjectId `bson:"_id,omitempty" json:"_id"`
 
-	BikeID bson.ObjectId `json:"bike_id"`
+	BikeID bson.ObjectId `bson:"bike_id" json:"bike_id"`
 	Type   string        `json:"type"`
 	Level  string        `json:"level"`
+
+	ShiftID bson.ObjectId `bson:"shift_id,omitempty" json:"shift_id"`
+	UserID  bson.ObjectId `bson:"user_id,omitempty" json:"user_id"`
+
+	IncidentType string    `bson:"incident_type,omitempty" json:"incident_type"`
+	Description  string    `json:"description"`
+	Location     string    `json:"location"`
+	Lat          float64   `json:"lat"`
+	Lng          float64   `json:"lng"`
+	OccurredAt   time.Time `bson:"occurred_at" json:"occurred_at"`
+
+	Photos     []bson.ObjectId `json:"photos"`
+	ThirdParty *ThirdParty     `bson:"third_party,omitempty" json:"third_party"`
+
+	Status         string              `json:"status"`
+	StatusHistory  []EventStatusChange `bson:"status_history" json:"status_history"`
+	ClaimReference string              `bson:"claim_reference" json:"claim_reference"`
+
+	// bike was taken out of service because of this event
+	OffRoad bool `bson:"off_road" json:"off_road"`
+
+	// Alerts raised from GPS positions are open until acknowledged
+	AcknowledgedBy bson.ObjectId `bson:"acknowledged_by,omitempty" json:"acknowledged_by"`
+	AcknowledgedAt time.Time     `bson:"acknowledged_at,omitempty" json:"acknowledged_at"`
+	// when supervisors were emailed about the alert
+	NotifiedAt time.Time `bson:"notified_at,omitempty" json:"notified_at"`
+
+	Created   time.Time     `json:"created"`
+	CreatedBy bson.ObjectId `bson:"created_by,omitempty" json:"created_by"`
+}
+
+// ThirdParty is the other party involved in an incident
+type ThirdParty struct {
+	Name         string `json:"name"`
+	Phone        string `json:"phone"`
+	Email        string `json:"email"`
+	Registration string `json:"registration"`
+	Insurer      string `json:"insurer"`
+	PolicyNumber string `bson:"policy_number" json:"policy_number"`
+	Notes        string `json:"notes"`
+}
+
+// EventStatusChange is an entry in an event's workflow history
+type EventStatusChange struct {
+	Status    string        `json:"status"`
+	Notes     string        `json:"notes"`
+	ChangedBy bson.ObjectId `bson:"changed_by" json:"changed_by"`
+	ChangedAt time.Time     `bson:"changed_at" json:"changed_at"`
+}
+
+// EventLevelRank orders levels by severity, -1 if unknown
+func EventLevelRank(level string) int {
+	for i, l := range EventLevels {
+		if l == level {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// IsIncidentStatus is true for statuses in the incident workflow
+func IsIncidentStatus(status string) bool {
+	for _, s := range IncidentStatuses {
+		if s == status {
+			return true
+		}
+	}
+
+	return false
 }
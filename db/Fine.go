@@ -0,0 +1,214 @@
+package db
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/maple-ai/fleet-api/config"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// FineKinds maps kinds of penalty notice to display names
+var FineKinds = map[string]string{
+	"parking":    "Parking",
+	"speeding":   "Speeding",
+	"bus_lane":   "Bus lane",
+	"congestion": "Congestion charge",
+	"other":      "Other",
+}
+
+// FineStatuses maps fine statuses to display names. Fines which can't be matched to a driver stay in review.
+var FineStatuses = map[string]string{
+	"review":      "Needs review",
+	"assigned":    "Assigned to driver",
+	"contested":   "Contested",
+	"transferred": "Liability transferred",
+	"paid":        "Paid",
+	"deducted":    "Deducted from pay",
+}
+
+// Fine emails which failed are sent again for this long after the fine last changed status
+const FineEmailRetry = 7 * 24 * time.Hour
+
+// Fine is a penalty charge notice received for one of our bikes
+type Fine struct {
+	ID        bson.ObjectId `bson:"_id,omitempty" json:"_id"`
+	Reference string        `json:"reference"`
+	Issuer    string        `json:"issuer"`
+	Kind      string        `json:"kind"`
+
+	Registration string    `json:"registration"`
+	OffenceAt    time.Time `bson:"offence_at" json:"offence_at"`
+	Location     string    `json:"location"`
+	DueDate      time.Time `bson:"due_date,omitempty" json:"due_date"`
+
+	// Amount in pence
+	Amount int64 `json:"amount"`
+
+	// Set once attributed
+	BikeID  bson.ObjectId `bson:"bike_id,omitempty" json:"bike_id"`
+	ShiftID bson.ObjectId `bson:"shift_id,omitempty" json:"shift_id"`
+	UserID  bson.ObjectId `bson:"user_id,omitempty" json:"user_id"`
+
+	Status        string             `json:"status"`
+	StatusHistory []FineStatusChange `bson:"status_history" json:"status_history"`
+	NotifiedAt    time.Time          `bson:"notified_at,omitempty" json:"notified_at"`
+	// Payroll run deducting the fine
+	PayrollRunID bson.ObjectId `bson:"payroll_run_id,omitempty" json:"payroll_run_id"`
+
+	Created   time.Time     `json:"created"`
+	CreatedBy bson.ObjectId `bson:"created_by,omitempty" json:"created_by"`
+}
+
+// FineStatusChange is an entry in a fine's status history
+type FineStatusChange struct {
+	Status    string        `json:"status"`
+	Notes     string        `json:"notes"`
+	ChangedBy bson.ObjectId `bson:"changed_by" json:"changed_by"`
+	ChangedAt time.Time     `bson:"changed_at" json:"changed_at"`
+}
+
+var registrationSeparators = regexp.MustCompile(`[\s-]+`)
+
+// NormaliseRegistration uppercases a registration and strips spaces
+func NormaliseRegistration(registration string) string {
+	return strings.ToUpper(registrationSeparators.ReplaceAllString(registration, ""))
+}
+
+// FindBikeByRegistration matches registrations regardless of case and spacing, nil if none
+func FindBikeByRegistration(registration string) (*Bike, error) {
+	chars := strings.Split(NormaliseRegistration(registration), "")
+	if len(chars) == 0 {
+		return nil, nil
+	}
+
+	for i, char := range chars {
+		chars[i] = regexp.QuoteMeta(char)
+	}
+
+	var bike Bike
+	if err := Cols.Bikes.Find(M{"registration": bson.RegEx{
+		Pattern: `^\s*` + strings.Join(chars, `[\s-]*`) + `\s*$`,
+		Options: "i",
+	}}).One(&bike); err == mgo.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &bike, nil
+}
+
+// FindShiftAt returns the shift the bike was checked out on at the time, nil if none
+func FindShiftAt(bikeID bson.ObjectId, at time.Time) (*Shift, error) {
+	var shift Shift
+	if err := Cols.Shifts.Find(M{
+		"scooter_id": bikeID,
+		"check_in":   M{"$lte": at},
+		"$or": []M{
+			{"check_out": M{"$gte": at}},
+			{"status": "running"},
+		},
+	}).Sort("-check_in").One(&shift); err == mgo.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &shift, nil
+}
+
+// ResolveFine attributes the fine to the bike and the driver who had it at the offence time.
+// Returns false when either can't be found.
+func ResolveFine(fine *Fine) (bool, error) {
+	bike, err := FindBikeByRegistration(fine.Registration)
+	if err != nil || bike == nil {
+		return false, err
+	}
+
+	fine.BikeID = bike.ID
+
+	shift, err := FindShiftAt(bike.ID, fine.OffenceAt)
+	if err != nil || shift == nil {
+		return false, err
+	}
+
+	fine.ShiftID = shift.ID
+	fine.UserID = shift.UserID
+
+	return true, nil
+}
+
+// NotifyFineDriver emails the driver a fine has been attributed to. The fine is claimed (notified_at) so the
+// driver is emailed once, and released if the email fails so it can be sent again.
+func NotifyFineDriver(fine *Fine) error {
+	notifiedAt := time.Now()
+	if err := Cols.Fines.Update(M{
+		"_id":         fine.ID,
+		"notified_at": M{"$exists": false},
+	}, M{"$set": M{"notified_at": notifiedAt}}); err == mgo.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := sendFineEmail(fine); err != nil {
+		if err := Cols.Fines.UpdateId(fine.ID, M{"$unset": M{"notified_at": 1}}); err != nil {
+			return err
+		}
+
+		return err
+	}
+
+	fine.NotifiedAt = notifiedAt
+	return nil
+}
+
+// NotifyPendingFines emails drivers about fines attributed to them which changed in the last FineEmailRetry
+// and weren't emailed
+func NotifyPendingFines() error {
+	var fines []Fine
+	if err := Cols.Fines.Find(M{
+		"user_id":                   M{"$exists": true},
+		"status":                    M{"$in": []string{"assigned", "deducted"}},
+		"notified_at":               M{"$exists": false},
+		"status_history.changed_at": M{"$gte": time.Now().Add(-FineEmailRetry)},
+	}).All(&fines); err != nil {
+		return err
+	}
+
+	var failed error
+	for i := range fines {
+		if err := NotifyFineDriver(&fines[i]); err != nil {
+			failed = err
+		}
+	}
+
+	return failed
+}
+
+func sendFineEmail(fine *Fine) error {
+	var user User
+	if err := Cols.Users.FindId(fine.UserID).One(&user); err != nil {
+		return err
+	}
+
+	message, err := NewMail(user.Email, FineAssignedSubject, FineAssigned, map[string]interface{}{
+		"UserName":     user.GetName(),
+		"Kind":         strings.ToLower(FineKinds[fine.Kind]),
+		"Reference":    fine.Reference,
+		"Registration": fine.Registration,
+		"OffenceAt":    fine.OffenceAt.Format("02/01/2006 15:04"),
+		"Location":     fine.Location,
+		"Amount":       fmt.Sprintf("%.2f", float64(fine.Amount)/100),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, _, err = config.Mail.Send(message)
+	return err
+}
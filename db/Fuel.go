@@ -0,0 +1,102 @@
+package db
+
+import (
+	"math"
+	"time"
+
+	"github.com/maple-ai/fleet-api/config"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// FuelEvent is a refuel of a bike, optionally during a shift
+type FuelEvent struct {
+	ID      bson.ObjectId `bson:"_id,omitempty" json:"_id"`
+	BikeID  bson.ObjectId `bson:"bike_id" json:"bike_id"`
+	ShiftID bson.ObjectId `bson:"shift_id,omitempty" json:"shift_id"`
+	UserID  bson.ObjectId `bson:"user_id,omitempty" json:"user_id"`
+
+	Litres float64 `json:"litres"`
+	// Cost in pence
+	Cost      int64         `json:"cost"`
+	Odometer  int           `json:"odometer"`
+	ReceiptID bson.ObjectId `bson:"receipt_id,omitempty" json:"receipt_id"`
+
+	FilledAt   time.Time     `bson:"filled_at" json:"filled_at"`
+	RecordedBy bson.ObjectId `bson:"recorded_by" json:"recorded_by"`
+}
+
+// ComputeShiftFuel works out the fuel used on a shift from the tank levels at check-in and check-out
+// and refuels during the shift, flags use far above the bike's expected economy and charges the driver for fuel missing.
+// Does nothing until both levels are recorded.
+func ComputeShiftFuel(shift Shift) error {
+	var history BikeHistory
+	if err := Cols.BikeHistory.Find(M{"shift_id": shift.ID}).One(&history); err == mgo.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if history.FuelLevelStart == nil || history.FuelLevel == nil {
+		return nil
+	}
+
+	var bike Bike
+	if err := Cols.Bikes.FindId(history.BikeID).One(&bike); err != nil {
+		return err
+	}
+
+	if bike.TankCapacity <= 0 {
+		return nil
+	}
+
+	var refuels []FuelEvent
+	if err := Cols.Fuel.Find(M{"shift_id": shift.ID}).All(&refuels); err != nil {
+		return err
+	}
+
+	refuelled := 0.0
+	for _, refuel := range refuels {
+		refuelled += refuel.Litres
+	}
+
+	// litres missing from the tank when it came back
+	missing := float64(*history.FuelLevelStart-*history.FuelLevel) / 100 * bike.TankCapacity
+	used := missing + refuelled
+
+	set := M{
+		"fuel_used":    used,
+		"fuel_anomaly": false,
+	}
+
+	if bike.FuelEconomy > 0 && history.Distance > 0 {
+		expected := float64(history.Distance) / bike.FuelEconomy
+		// small amounts are within gauge error
+		set["fuel_anomaly"] = used > expected*(1+config.Config.Fuel.AnomalyTolerance)+1
+	}
+
+	if err := Cols.BikeHistory.UpdateId(history.ID, M{"$set": set}); err != nil {
+		return err
+	}
+
+	var charge int64
+	if missing > 0 && config.Config.Fuel.ChargePerLitre > 0 {
+		charge = int64(math.Ceil(missing * float64(config.Config.Fuel.ChargePerLitre)))
+	}
+
+	if err := Cols.Shifts.UpdateId(shift.ID, M{"$set": M{"fuel_charge": charge}}); err != nil {
+		return err
+	}
+
+	if err := SetTransaction(Transaction{
+		UserID:      shift.UserID,
+		Type:        "fuel",
+		Description: "Fuel charge",
+		ShiftID:     shift.ID,
+		Amount:      -charge,
+	}); err != nil && err != ErrTransactionSettled {
+		return err
+	}
+
+	return nil
+}
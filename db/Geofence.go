@@ -0,0 +1,299 @@
+package db
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/maple-ai/fleet-api/config"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Alert thresholds
+const (
+	// Bikes faster than this (knots) are moving
+	AlertMovingSpeed = 5.0
+	// Bikes further than this (miles) from their garage overnight are parked away
+	AlertGarageRadius = 0.5
+	// Overnight is from AlertNightStart to AlertNightEnd hours, local time
+	AlertNightStart = 1
+	AlertNightEnd   = 5
+	// Alert emails which failed are sent again for this long after the alert was raised
+	AlertEmailRetry = 24 * time.Hour
+)
+
+// AlertTypes maps event types raised from GPS positions to display names and levels
+var AlertTypes = map[string]struct{ Name, Level string }{
+	"geofence":    {"Left operating zone", "high"},
+	"after_hours": {"Moving outside shift hours", "high"},
+	"overnight":   {"Parked overnight away from garage", "medium"},
+}
+
+// Geofence is an operating zone for a garage's bikes, or every garage in a city
+type Geofence struct {
+	ID       bson.ObjectId `bson:"_id,omitempty" json:"_id"`
+	Name     string        `json:"name"`
+	GarageID bson.ObjectId `bson:"garage_id,omitempty" json:"garage_id"`
+	City     string        `json:"city"`
+
+	// [lat, lng] vertices
+	Polygon [][2]float64 `json:"polygon"`
+
+	Created   time.Time     `json:"created"`
+	CreatedBy bson.ObjectId `bson:"created_by,omitempty" json:"created_by"`
+}
+
+// Contains is true when the point is inside the polygon (ray casting)
+func (fence *Geofence) Contains(lat, lng float64) bool {
+	inside := false
+	for i, j := 0, len(fence.Polygon)-1; i < len(fence.Polygon); j, i = i, i+1 {
+		a, b := fence.Polygon[i], fence.Polygon[j]
+		if (a[0] > lat) != (b[0] > lat) && lng < (b[1]-a[1])*(lat-a[0])/(b[0]-a[0])+a[1] {
+			inside = !inside
+		}
+	}
+
+	return inside
+}
+
+// FindGarageGeofences returns zones for the garage and for its city
+func FindGarageGeofences(garage *Garage) ([]Geofence, error) {
+	if garage == nil {
+		return []Geofence{}, nil
+	}
+
+	or := []M{{"garage_id": garage.ID}}
+	if len(garage.City) > 0 {
+		or = append(or, M{
+			"city":      bson.RegEx{Pattern: "^" + regexp.QuoteMeta(garage.City) + "$", Options: "i"},
+			"garage_id": M{"$exists": false},
+		})
+	}
+
+	fences := []Geofence{}
+	err := Cols.Geofences.Find(M{"$or": or}).All(&fences)
+
+	return fences, err
+}
+
+// CheckPositions raises alerts for a bike's new positions: leaving its zones, moving without a shift,
+// or parked overnight away from its garage. Only one alert of each type is open per bike at a time,
+// returns the alerts raised.
+func CheckPositions(bike Bike, positions []Position) ([]Event, error) {
+	raised := []Event{}
+	if len(positions) == 0 {
+		return raised, nil
+	}
+
+	garage, err := FindGarageByID(bike.GarageID)
+	if err != nil {
+		return nil, err
+	}
+
+	fences, err := FindGarageGeofences(garage)
+	if err != nil {
+		return nil, err
+	}
+
+	first, last := positions[0].FixTime, positions[len(positions)-1].FixTime
+	var shifts []Shift
+	if err := Cols.Shifts.Find(M{
+		"scooter_id": bike.ID,
+		"check_in":   M{"$lte": last},
+		"$or": []M{
+			{"check_out": M{"$gte": first}},
+			{"status": "running"},
+		},
+	}).All(&shifts); err != nil {
+		return nil, err
+	}
+
+	onShift := func(at time.Time) *Shift {
+		for i, shift := range shifts {
+			if !shift.CheckIn.After(at) && (shift.Status == "running" || !shift.CheckOut.Before(at)) {
+				return &shifts[i]
+			}
+		}
+
+		return nil
+	}
+
+	checked := map[string]bool{}
+	for _, position := range positions {
+		shift := onShift(position.FixTime)
+
+		alerts := map[string]string{}
+		if len(fences) > 0 && !insideAny(fences, position) {
+			alerts["geofence"] = "Bike is outside its operating zone"
+		}
+
+		if shift == nil && position.Speed > AlertMovingSpeed {
+			alerts["after_hours"] = "Bike is moving with nobody checked out on it"
+		}
+
+		if hour := position.FixTime.Local().Hour(); garage != nil && shift == nil && position.Speed <= AlertMovingSpeed &&
+			hour >= AlertNightStart && hour < AlertNightEnd &&
+			DistanceMiles(position.Latitude, position.Longitude, garage.Location.Lat, garage.Location.Lng) > AlertGarageRadius {
+			alerts["overnight"] = "Bike is parked away from its garage overnight"
+		}
+
+		for alertType, description := range alerts {
+			if checked[alertType] {
+				continue
+			}
+			checked[alertType] = true
+
+			alert, err := raiseAlert(bike, shift, position, alertType, description)
+			if err != nil {
+				return nil, err
+			} else if alert != nil {
+				raised = append(raised, *alert)
+			}
+		}
+	}
+
+	return raised, nil
+}
+
+// raiseAlert opens an alert unless one of the type is already open for the bike, nil if not raised
+func raiseAlert(bike Bike, shift *Shift, position Position, alertType string, description string) (*Event, error) {
+	alert := Event{
+		ID:            bson.NewObjectId(),
+		BikeID:        bike.ID,
+		Type:          alertType,
+		Level:         AlertTypes[alertType].Level,
+		Description:   description,
+		Lat:           position.Latitude,
+		Lng:           position.Longitude,
+		OccurredAt:    position.FixTime,
+		Photos:        []bson.ObjectId{},
+		Status:        "open",
+		StatusHistory: []EventStatusChange{},
+		Created:       time.Now(),
+	}
+
+	if shift != nil {
+		alert.ShiftID = shift.ID
+		alert.UserID = shift.UserID
+	}
+
+	// upserting keeps instances from raising the same alert twice
+	info, err := Cols.Events.Upsert(M{
+		"bike_id": bike.ID,
+		"type":    alertType,
+		"status":  "open",
+	}, M{"$setOnInsert": alert})
+	if err != nil || info.UpsertedId == nil {
+		return nil, err
+	}
+
+	return &alert, nil
+}
+
+// NotifyAlerts emails the supervisors of each alert's garage, or admins if it has none, about newly raised alerts.
+// Alerts are claimed (notified_at) so each is emailed once, and released if the email fails to be sent again.
+func NotifyAlerts(alerts []Event) error {
+	garageIDs := []bson.ObjectId{}
+	items := map[bson.ObjectId][]map[string]interface{}{}
+	claimed := map[bson.ObjectId][]bson.ObjectId{}
+	for _, alert := range alerts {
+		var bike Bike
+		if err := Cols.Bikes.FindId(alert.BikeID).One(&bike); err != nil {
+			return err
+		}
+
+		if err := Cols.Events.Update(M{
+			"_id":         alert.ID,
+			"notified_at": M{"$exists": false},
+		}, M{"$set": M{"notified_at": time.Now()}}); err == mgo.ErrNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if _, ok := items[bike.GarageID]; !ok {
+			garageIDs = append(garageIDs, bike.GarageID)
+		}
+		claimed[bike.GarageID] = append(claimed[bike.GarageID], alert.ID)
+		items[bike.GarageID] = append(items[bike.GarageID], map[string]interface{}{
+			"Registration": bike.Registration,
+			"Alert":        AlertTypes[alert.Type].Name,
+			"Level":        alert.Level,
+			"Time":         alert.OccurredAt.Local().Format("02/01/2006 15:04"),
+			"Lat":          alert.Lat,
+			"Lng":          alert.Lng,
+		})
+	}
+
+	var failed error
+	for _, garageID := range garageIDs {
+		if err := sendAlertEmails(garageID, items[garageID]); err != nil {
+			failed = err
+			if _, err := Cols.Events.UpdateAll(M{
+				"_id": M{"$in": claimed[garageID]},
+			}, M{"$unset": M{"notified_at": 1}}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return failed
+}
+
+// NotifyPendingAlerts emails open alerts raised in the last AlertEmailRetry which weren't emailed
+func NotifyPendingAlerts() error {
+	types := []string{}
+	for alertType := range AlertTypes {
+		types = append(types, alertType)
+	}
+
+	var alerts []Event
+	if err := Cols.Events.Find(M{
+		"type":        M{"$in": types},
+		"status":      "open",
+		"notified_at": M{"$exists": false},
+		"created":     M{"$gte": time.Now().Add(-AlertEmailRetry)},
+	}).Sort("created").All(&alerts); err != nil {
+		return err
+	}
+
+	return NotifyAlerts(alerts)
+}
+
+func sendAlertEmails(garageID bson.ObjectId, items []map[string]interface{}) error {
+	emails, err := FindGarageEmails(garageID, "supervisor", "admin", "superadmin")
+	if err != nil {
+		return err
+	}
+
+	if len(emails) == 0 {
+		if emails, err = FindPrivilegedEmails("admin", "superadmin"); err != nil {
+			return err
+		}
+	}
+
+	for _, email := range emails {
+		message, err := NewMail(email, GeofenceAlertSubject, GeofenceAlert, map[string]interface{}{
+			"Alerts": items,
+		})
+		if err != nil {
+			return err
+		}
+
+		if _, _, err := config.Mail.Send(message); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func insideAny(fences []Geofence, position Position) bool {
+	for _, fence := range fences {
+		if fence.Contains(position.Latitude, position.Longitude) {
+			return true
+		}
+	}
+
+	return false
+}
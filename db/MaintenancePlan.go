@@ -0,0 +1,165 @@
+package db
+
+import (
+	"sort"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Plans are flagged as due this far ahead of the interval
+const (
+	MaintenanceDueDays  = 7
+	MaintenanceDueMiles = 200
+)
+
+// MaintenancePlan schedules recurring service work for one bike, or every bike of a model.
+// Work is due every IntervalMiles or IntervalDays, whichever comes first.
+type MaintenancePlan struct {
+	ID     bson.ObjectId `bson:"_id,omitempty" json:"_id"`
+	Name   string        `json:"name"`
+	BikeID bson.ObjectId `bson:"bike_id,omitempty" json:"bike_id"`
+	Model  string        `json:"model"`
+
+	IntervalMiles int `bson:"interval_miles" json:"interval_miles"`
+	IntervalDays  int `bson:"interval_days" json:"interval_days"`
+
+	// Bikes can't be booked while a critical plan is overdue
+	Critical bool `json:"critical"`
+
+	Created   time.Time     `json:"created"`
+	CreatedBy bson.ObjectId `json:"created_by" bson:"created_by,omitempty"`
+}
+
+// MaintenanceDue is the state of a plan for a single bike
+type MaintenanceDue struct {
+	Plan   MaintenancePlan `json:"plan"`
+	BikeID bson.ObjectId   `json:"bike_id"`
+
+	LastDone     time.Time `json:"last_done"`
+	LastOdometer int       `json:"last_odometer"`
+	DueDate      time.Time `json:"due_date"`
+	DueOdometer  int       `json:"due_odometer"`
+
+	// ok/due/overdue
+	Status string `json:"status"`
+}
+
+// FindMaintenancePlans returns plans for the bike itself and for its model
+func FindMaintenancePlans(bike Bike) ([]MaintenancePlan, error) {
+	or := []M{{"bike_id": bike.ID}}
+	if len(bike.Model) > 0 {
+		or = append(or, M{"model": bike.Model, "bike_id": M{"$exists": false}})
+	}
+
+	var plans []MaintenancePlan
+	err := Cols.ServicePlans.Find(M{"$or": or}).Sort("name").All(&plans)
+
+	return plans, err
+}
+
+// GetMaintenanceStatus computes due/overdue state of every plan for the bike.
+// Plans never carried out count days from when the plan first applied to the bike (the later of the plan and
+// the bike being added), and miles from its odometer then.
+func GetMaintenanceStatus(bike Bike) ([]MaintenanceDue, error) {
+	plans, err := FindMaintenancePlans(bike)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	status := make([]MaintenanceDue, len(plans))
+	for i, plan := range plans {
+		applied := plan.Created
+		if bike.Created.After(applied) {
+			applied = bike.Created
+		}
+
+		due := MaintenanceDue{
+			Plan:     plan,
+			BikeID:   bike.ID,
+			LastDone: applied,
+			Status:   "ok",
+		}
+
+		var last BikeMaintenance
+		if err := Cols.BikeMaintenance.Find(M{
+			"bike_id": bike.ID,
+			"plan_id": plan.ID,
+		}).Sort("-checked_at").One(&last); err != nil && err != mgo.ErrNotFound {
+			return nil, err
+		} else if err == nil {
+			due.LastDone = last.CheckedAt
+			due.LastOdometer = last.Odometer
+		} else if plan.IntervalMiles > 0 {
+			if due.LastOdometer, err = odometerAt(bike, applied); err != nil {
+				return nil, err
+			}
+		}
+
+		if plan.IntervalDays > 0 {
+			due.DueDate = due.LastDone.AddDate(0, 0, plan.IntervalDays)
+
+			switch {
+			case now.After(due.DueDate):
+				due.Status = "overdue"
+			case now.AddDate(0, 0, MaintenanceDueDays).After(due.DueDate):
+				due.Status = "due"
+			}
+		}
+
+		if plan.IntervalMiles > 0 {
+			due.DueOdometer = due.LastOdometer + plan.IntervalMiles
+
+			switch {
+			case bike.Odometer >= due.DueOdometer:
+				due.Status = "overdue"
+			case bike.Odometer+MaintenanceDueMiles >= due.DueOdometer && due.Status == "ok":
+				due.Status = "due"
+			}
+		}
+
+		status[i] = due
+	}
+
+	sort.SliceStable(status, func(i, j int) bool {
+		return status[i].Status == "overdue" && status[j].Status != "overdue"
+	})
+
+	return status, nil
+}
+
+// odometerAt is the bike's mileage at the time by its handover readings: the last reading by then, else the first after.
+// The bike's odometer if it has no readings.
+func odometerAt(bike Bike, at time.Time) (int, error) {
+	var reading OdometerReading
+	err := Cols.Mileage.Find(M{"bike_id": bike.ID, "recorded_at": M{"$lte": at}}).Sort("-recorded_at").One(&reading)
+	if err == mgo.ErrNotFound {
+		err = Cols.Mileage.Find(M{"bike_id": bike.ID, "recorded_at": M{"$gt": at}}).Sort("recorded_at").One(&reading)
+	}
+
+	if err == mgo.ErrNotFound {
+		return bike.Odometer, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return reading.Reading, nil
+}
+
+// HasOverdueCriticalMaintenance is true when a critical plan for the bike is overdue
+func HasOverdueCriticalMaintenance(bike Bike) (bool, error) {
+	status, err := GetMaintenanceStatus(bike)
+	if err != nil {
+		return false, err
+	}
+
+	for _, due := range status {
+		if due.Plan.Critical && due.Status == "overdue" {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,119 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Part is a stock line of parts or consumables held at a garage
+type Part struct {
+	ID          bson.ObjectId `bson:"_id,omitempty" json:"_id"`
+	GarageID    bson.ObjectId `bson:"garage_id" json:"garage_id"`
+	SKU         string        `bson:"sku" json:"sku"`
+	Description string        `json:"description"`
+
+	Quantity     int `json:"quantity"`
+	ReorderLevel int `bson:"reorder_level" json:"reorder_level"`
+	// UnitCost in pence
+	UnitCost int64 `bson:"unit_cost" json:"unit_cost"`
+
+	Created   time.Time     `json:"created"`
+	CreatedBy bson.ObjectId `bson:"created_by,omitempty" json:"created_by"`
+}
+
+// PartUsage is a quantity of a part consumed by maintenance work, with the cost at the time
+type PartUsage struct {
+	PartID      bson.ObjectId `bson:"part_id" json:"part_id"`
+	SKU         string        `bson:"sku" json:"sku"`
+	Description string        `json:"description"`
+	Quantity    int           `json:"quantity"`
+	UnitCost    int64         `bson:"unit_cost" json:"unit_cost"`
+}
+
+// ErrPartQuantity is returned when a part usage isn't a positive quantity
+var ErrPartQuantity = errors.New("Part quantities must be more than zero")
+
+// StockError is returned when a garage doesn't hold enough of a part
+type StockError struct {
+	PartID   bson.ObjectId
+	Quantity int
+}
+
+func (err StockError) Error() string {
+	return "Not enough stock of part " + err.PartID.Hex()
+}
+
+// LowStock is true when the part is at or below its reorder level
+func (part *Part) LowStock() bool {
+	return part.Quantity <= part.ReorderLevel
+}
+
+// TakeParts decrements stock at the garage for each usage, filling in SKU and cost.
+// Stock never goes negative: if any part is short, parts already taken are put back and a StockError returned.
+// The second value is the parts which dropped to their reorder level.
+func TakeParts(garageID bson.ObjectId, usage []PartUsage) ([]PartUsage, []Part, error) {
+	taken := []PartUsage{}
+	low := []Part{}
+
+	for _, use := range usage {
+		if use.Quantity <= 0 {
+			ReturnParts(taken)
+			return nil, nil, ErrPartQuantity
+		}
+
+		var part Part
+		if _, err := Cols.Parts.Find(M{
+			"_id":       use.PartID,
+			"garage_id": garageID,
+			"quantity":  M{"$gte": use.Quantity},
+		}).Apply(mgo.Change{
+			Update:    M{"$inc": M{"quantity": -use.Quantity}},
+			ReturnNew: true,
+		}, &part); err == mgo.ErrNotFound {
+			ReturnParts(taken)
+			return nil, nil, StockError{use.PartID, use.Quantity}
+		} else if err != nil {
+			ReturnParts(taken)
+			return nil, nil, err
+		}
+
+		taken = append(taken, PartUsage{
+			PartID:      part.ID,
+			SKU:         part.SKU,
+			Description: part.Description,
+			Quantity:    use.Quantity,
+			UnitCost:    part.UnitCost,
+		})
+
+		// only alert as the level is crossed
+		if part.LowStock() && part.Quantity+use.Quantity > part.ReorderLevel {
+			low = append(low, part)
+		}
+	}
+
+	return taken, low, nil
+}
+
+// ReturnParts puts used parts back into stock
+func ReturnParts(usage []PartUsage) error {
+	for _, use := range usage {
+		if err := Cols.Parts.UpdateId(use.PartID, M{"$inc": M{"quantity": use.Quantity}}); err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PartsCost totals the cost of parts used, in pence
+func PartsCost(usage []PartUsage) int64 {
+	var cost int64
+	for _, use := range usage {
+		cost += int64(use.Quantity) * use.UnitCost
+	}
+
+	return cost
+}
@@ -0,0 +1,184 @@
+package db
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrNoRateCard means no rate card covers the shift's garage and driver grade
+var ErrNoRateCard = errors.New("No rate card for this garage and grade")
+
+// RateCard sets pay for shifts at a garage (all garages when empty) for drivers of a grade (all grades when empty).
+// Amounts are in pence, multipliers of 0 or 1 pay the hourly rate.
+type RateCard struct {
+	ID       bson.ObjectId `bson:"_id,omitempty" json:"_id"`
+	Name     string        `bson:"name" json:"name"`
+	GarageID bson.ObjectId `bson:"garage_id,omitempty" json:"garage_id"`
+	Grade    string        `bson:"grade" json:"grade"`
+
+	HourlyRate int64 `bson:"hourly_rate" json:"hourly_rate"`
+
+	WeekendMultiplier float64 `bson:"weekend_multiplier" json:"weekend_multiplier"`
+	NightMultiplier   float64 `bson:"night_multiplier" json:"night_multiplier"`
+	// Night is from NightStart to NightEnd (hours, local time), wrapping past midnight
+	NightStart        int      `bson:"night_start" json:"night_start"`
+	NightEnd          int      `bson:"night_end" json:"night_end"`
+	HolidayMultiplier float64  `bson:"holiday_multiplier" json:"holiday_multiplier"`
+	Holidays          []string `bson:"holidays" json:"holidays"` // dd-mm-yyyy
+
+	// Shifts pay at least this much before deductions
+	MinimumPay int64 `bson:"minimum_pay" json:"minimum_pay"`
+	// Deducted per shift from drivers not using their own bike
+	BikeHire int64 `bson:"bike_hire" json:"bike_hire"`
+
+	Created   time.Time     `bson:"created" json:"created"`
+	CreatedBy bson.ObjectId `bson:"created_by" json:"created_by"`
+}
+
+// PayBreakdown is how a shift's pay was worked out, in pence.
+// Premiums are the extra over the hourly rate, only the highest multiplier applies to any minute.
+type PayBreakdown struct {
+	RateCardID bson.ObjectId `bson:"rate_card_id" json:"rate_card_id"`
+	HourlyRate int64         `bson:"hourly_rate" json:"hourly_rate"`
+	Hours      float64       `bson:"hours" json:"hours"`
+
+	Base           int64 `bson:"base" json:"base"`
+	WeekendPremium int64 `bson:"weekend_premium" json:"weekend_premium"`
+	NightPremium   int64 `bson:"night_premium" json:"night_premium"`
+	HolidayPremium int64 `bson:"holiday_premium" json:"holiday_premium"`
+	// Top-up to the card's minimum pay
+	MinimumTopUp int64 `bson:"minimum_top_up" json:"minimum_top_up"`
+	BikeHire     int64 `bson:"bike_hire" json:"bike_hire"`
+
+	// Never below zero
+	Total int64 `bson:"total" json:"total"`
+}
+
+// FindRateCard picks the most specific card for the garage and grade:
+// garage and grade, then garage, then grade, then the default card
+func FindRateCard(garageID bson.ObjectId, grade string) (RateCard, error) {
+	var cards []RateCard
+	if err := Cols.RateCards.Find(M{
+		"garage_id": M{"$in": []interface{}{garageID, nil}},
+		"grade":     M{"$in": []string{grade, ""}},
+	}).All(&cards); err != nil {
+		return RateCard{}, err
+	}
+
+	best, bestRank := RateCard{}, -1
+	for _, card := range cards {
+		rank := 0
+		if card.GarageID.Valid() {
+			rank += 2
+		}
+		if len(card.Grade) > 0 {
+			rank++
+		}
+
+		if rank > bestRank {
+			best, bestRank = card, rank
+		}
+	}
+
+	if bestRank < 0 {
+		return RateCard{}, ErrNoRateCard
+	}
+
+	return best, nil
+}
+
+// CalculatePay works out pay for a checked-out shift from the rate card for its garage and the driver's grade
+func CalculatePay(shift Shift, membership UserMembership) (PayBreakdown, error) {
+	if shift.CheckIn.IsZero() || shift.CheckOut.IsZero() || !shift.CheckOut.After(shift.CheckIn) {
+		return PayBreakdown{}, errors.New("Shift has no check-in and check-out")
+	}
+
+	card, err := FindRateCard(shift.GarageID, membership.Grade)
+	if err != nil {
+		return PayBreakdown{}, err
+	}
+
+	return card.Pay(shift.CheckIn, shift.CheckOut, membership.UseOwnBike), nil
+}
+
+// Pay applies the card to time worked between from and to
+func (card RateCard) Pay(from time.Time, to time.Time, ownBike bool) PayBreakdown {
+	breakdown := PayBreakdown{
+		RateCardID: card.ID,
+		HourlyRate: card.HourlyRate,
+		Hours:      to.Sub(from).Hours(),
+	}
+
+	holidays := map[string]bool{}
+	for _, day := range card.Holidays {
+		holidays[day] = true
+	}
+
+	perMinute := float64(card.HourlyRate) / 60
+	var base, weekend, night, holiday float64
+	for minute := from.Local(); minute.Before(to); minute = minute.Add(time.Minute) {
+		length := 1.0
+		if end := minute.Add(time.Minute); end.After(to) {
+			length = to.Sub(minute).Minutes()
+		}
+
+		base += perMinute * length
+
+		weekendRate, nightRate, holidayRate := 1.0, 1.0, 1.0
+		if day := minute.Weekday(); day == time.Saturday || day == time.Sunday {
+			weekendRate = card.WeekendMultiplier
+		}
+		if card.isNight(minute.Hour()) {
+			nightRate = card.NightMultiplier
+		}
+		if holidays[minute.Format("02-01-2006")] {
+			holidayRate = card.HolidayMultiplier
+		}
+
+		switch {
+		case holidayRate > 1 && holidayRate >= weekendRate && holidayRate >= nightRate:
+			holiday += perMinute * length * (holidayRate - 1)
+		case weekendRate > 1 && weekendRate >= nightRate:
+			weekend += perMinute * length * (weekendRate - 1)
+		case nightRate > 1:
+			night += perMinute * length * (nightRate - 1)
+		}
+	}
+
+	breakdown.Base = int64(math.Floor(base + 0.5))
+	breakdown.WeekendPremium = int64(math.Floor(weekend + 0.5))
+	breakdown.NightPremium = int64(math.Floor(night + 0.5))
+	breakdown.HolidayPremium = int64(math.Floor(holiday + 0.5))
+
+	gross := breakdown.Base + breakdown.WeekendPremium + breakdown.NightPremium + breakdown.HolidayPremium
+	if gross < card.MinimumPay {
+		breakdown.MinimumTopUp = card.MinimumPay - gross
+		gross = card.MinimumPay
+	}
+
+	if !ownBike {
+		breakdown.BikeHire = card.BikeHire
+	}
+
+	breakdown.Total = gross - breakdown.BikeHire
+	if breakdown.Total < 0 {
+		breakdown.Total = 0
+	}
+
+	return breakdown
+}
+
+func (card RateCard) isNight(hour int) bool {
+	if card.NightStart == card.NightEnd {
+		return false
+	}
+
+	if card.NightStart < card.NightEnd {
+		return hour >= card.NightStart && hour < card.NightEnd
+	}
+
+	return hour >= card.NightStart || hour < card.NightEnd
+}
@@ -0,0 +1,184 @@
+package db
+
+import (
+	"time"
+
+	"github.com/maple-ai/fleet-api/config"
+	stripe "github.com/stripe/stripe-go"
+	"github.com/stripe/stripe-go/charge"
+	"github.com/stripe/stripe-go/refund"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Stripe lets a hold lapse after 7 days, so deposits are held again after this long
+const DepositRenewal = 6 * 24 * time.Hour
+
+// Deposits in these statuses are still held, or kept, by us
+var activeDepositStatuses = []string{"pending", "held", "captured"}
+
+// HoldDeposit holds the configured deposit on the driver's card. Nothing is held when deposits
+// aren't enabled, the driver has no card or they already have a deposit.
+func HoldDeposit(user User, by bson.ObjectId) (*Transaction, error) {
+	if config.Config.Stripe.Deposit <= 0 || len(user.StripeUserID) == 0 {
+		return nil, nil
+	}
+
+	if n, err := Cols.Transactions.Find(M{
+		"user_id": user.ID,
+		"type":    "deposit",
+		"status":  M{"$in": activeDepositStatuses},
+	}).Count(); err != nil || n > 0 {
+		return nil, err
+	}
+
+	entry, err := ChargeCard(user, Transaction{
+		Type:        "deposit",
+		Amount:      config.Config.Stripe.Deposit,
+		Description: "Bike hire deposit",
+		CreatedBy:   by,
+	}, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+// RenewDeposit holds a held deposit again as a new entry, then releases the old hold. The old entry links to
+// the new one (renewed_by) so only one instance renews it. If the card is declined the old hold is left to lapse.
+func RenewDeposit(deposit Transaction) error {
+	var user User
+	if err := Cols.Users.FindId(deposit.UserID).One(&user); err == mgo.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if len(user.StripeUserID) == 0 {
+		return nil
+	}
+
+	renewalID := bson.NewObjectId()
+	if err := Cols.Transactions.Update(M{
+		"_id":        deposit.ID,
+		"status":     "held",
+		"renewed_by": M{"$exists": false},
+	}, M{"$set": M{"renewed_by": renewalID}}); err == mgo.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	renewal, err := ChargeCard(user, Transaction{
+		ID:          renewalID,
+		Type:        "deposit",
+		Amount:      deposit.Amount,
+		Description: deposit.Description,
+		CreatedBy:   deposit.CreatedBy,
+	}, false)
+	if err != nil {
+		if err := Cols.Transactions.UpdateId(deposit.ID, M{"$unset": M{"renewed_by": 1}}); err != nil {
+			return err
+		}
+
+		return err
+	}
+
+	if renewal.Status != "held" && renewal.Status != "pending" {
+		return nil
+	}
+
+	params := &stripe.RefundParams{Charge: stripe.String(deposit.StripeID)}
+	params.SetIdempotencyKey("release-" + deposit.ID.Hex())
+	if _, err := refund.New(params); err != nil {
+		return err
+	}
+
+	ch, err := charge.Get(deposit.StripeID, nil)
+	if err != nil {
+		return err
+	}
+
+	return RecordCharge(&deposit, ch, false)
+}
+
+// ChargeCard charges the driver's default card, or only holds the amount unless capture.
+// Card errors are recorded on the entry as failed.
+func ChargeCard(user User, entry Transaction, capture bool) (Transaction, error) {
+	entry.UserID = user.ID
+	entry.StripeUser = user.StripeUserID
+	entry.Status = "pending"
+
+	entry, err := AddTransaction(entry)
+	if err != nil {
+		return entry, err
+	}
+
+	params := &stripe.ChargeParams{
+		Amount:      stripe.Int64(entry.Amount),
+		Currency:    stripe.String(string(stripe.CurrencyGBP)),
+		Customer:    stripe.String(user.StripeUserID),
+		Capture:     stripe.Bool(capture),
+		Description: stripe.String(entry.Description),
+	}
+	params.AddMetadata("transaction_id", entry.ID.Hex())
+	params.AddMetadata("user_id", user.ID.Hex())
+	// a retried request won't charge twice
+	params.SetIdempotencyKey(entry.ID.Hex())
+
+	ch, err := charge.New(params)
+	if err != nil {
+		entry.Status, entry.Error = "failed", StripeErrorMessage(err)
+		return entry, Cols.Transactions.UpdateId(entry.ID, M{"$set": M{
+			"status": entry.Status,
+			"error":  entry.Error,
+		}})
+	}
+
+	return entry, RecordCharge(&entry, ch, false)
+}
+
+// RecordCharge updates a deposit or card charge from the Stripe charge
+func RecordCharge(entry *Transaction, ch *stripe.Charge, expired bool) error {
+	status := "succeeded"
+	switch {
+	case ch.Status == "failed":
+		status = "failed"
+	case ch.Status == "pending":
+		status = "pending"
+	case !ch.Captured && ch.Refunded && (expired || entry.Status == "expired"):
+		status = "expired"
+	case !ch.Captured && ch.Refunded:
+		status = "released"
+	case !ch.Captured:
+		status = "held"
+	case entry.Type == "deposit":
+		status = "captured"
+	}
+
+	entry.StripeID = ch.ID
+	entry.Status = status
+	entry.Refunded = ch.AmountRefunded
+	entry.Error = ch.FailureMessage
+	if ch.Source != nil {
+		entry.StripeCard = ch.Source.ID
+	}
+
+	return Cols.Transactions.UpdateId(entry.ID, M{"$set": M{
+		"stripe_id":   entry.StripeID,
+		"stripe_card": entry.StripeCard,
+		"status":      entry.Status,
+		"refunded":    entry.Refunded,
+		"error":       entry.Error,
+	}})
+}
+
+// StripeErrorMessage is the message to show for a Stripe error
+func StripeErrorMessage(err error) string {
+	if stripeErr, ok := err.(*stripe.Error); ok && len(stripeErr.Msg) > 0 {
+		return stripeErr.Msg
+	}
+
+	return err.Error()
+}
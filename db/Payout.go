@@ -0,0 +1,333 @@
+package db
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/maple-ai/fleet-api/config"
+	"github.com/maple-ai/fleet-api/payout"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Shown to drivers by the payout provider
+const payoutNote = "Maple Fleet pay"
+
+// Payout emails which failed are sent again for this long after the driver was paid
+const PayoutEmailRetry = 7 * 24 * time.Hour
+
+// ExecutePayrollRun pays a run claimed for execution. Drivers already paid are skipped, so a failed run can be
+// executed again. Without a provider, or with nothing to pay, lines are paid at once and the run is finished;
+// otherwise one payout batch is sent and the run is left paying until SettlePayrollRun sees every item settle.
+func ExecutePayrollRun(run *PayrollRun, provider payout.Provider, by bson.ObjectId) error {
+	items := []payout.Item{}
+	sent := []int{}
+	for i, line := range run.Lines {
+		if line.PayoutStatus == payout.StatusSuccess {
+			continue
+		}
+
+		if provider == nil || line.Total <= 0 {
+			if err := payPayrollLine(run, i, by, payout.ItemResult{}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		items = append(items, payout.Item{
+			SenderItemID: line.UserID.Hex(),
+			Receiver:     line.PaypalEmail,
+			Amount:       line.Total,
+			Currency:     "GBP",
+			Note:         payoutNote,
+		})
+		sent = append(sent, i)
+	}
+
+	if len(items) == 0 {
+		return finishPayrollRun(run.ID)
+	}
+
+	// the same ID is used again if the run fails before recording the batch, so it can't be sent twice
+	senderBatchID := run.ID.Hex() + "-" + strconv.Itoa(len(run.PayoutBatches)+1)
+	batchID, err := provider.CreateBatch(senderBatchID, payoutNote, items)
+	if err == payout.ErrDuplicateBatch {
+		return fmt.Errorf("Payout batch %s was already sent, check the payout provider and mark the drivers it paid as paid by hand", senderBatchID)
+	} else if err != nil {
+		return err
+	}
+
+	set := M{"status": "paying"}
+	for _, i := range sent {
+		prefix := "lines." + strconv.Itoa(i) + "."
+		set[prefix+"payout_status"] = payout.StatusPending
+		set[prefix+"payout_batch_id"] = batchID
+		set[prefix+"payout_error"] = ""
+	}
+
+	return Cols.PayrollRuns.UpdateId(run.ID, M{
+		"$set":  set,
+		"$push": M{"payout_batches": batchID},
+	})
+}
+
+// SettlePayrollRun checks a paying run's pending payouts, paying drivers whose payout succeeded
+func SettlePayrollRun(run *PayrollRun, provider payout.Provider) error {
+	batches := map[string][]int{}
+	for i, line := range run.Lines {
+		if line.PayoutStatus == payout.StatusPending {
+			batches[line.PayoutBatchID] = append(batches[line.PayoutBatchID], i)
+		}
+	}
+
+	for batchID, lines := range batches {
+		results, err := provider.BatchStatus(batchID)
+		if err != nil {
+			return err
+		}
+
+		bySender := map[string]payout.ItemResult{}
+		for _, result := range results {
+			bySender[result.SenderItemID] = result
+		}
+
+		for _, i := range lines {
+			result, ok := bySender[run.Lines[i].UserID.Hex()]
+			if !ok {
+				continue
+			}
+
+			switch result.Status {
+			case payout.StatusSuccess:
+				if err := payPayrollLine(run, i, run.ExecutedBy, result); err != nil {
+					return err
+				}
+			case payout.StatusFailed:
+				prefix := "lines." + strconv.Itoa(i) + "."
+				if err := Cols.PayrollRuns.UpdateId(run.ID, M{"$set": M{
+					prefix + "payout_status":  payout.StatusFailed,
+					prefix + "payout_item_id": result.ItemID,
+					prefix + "payout_error":   result.Error,
+				}}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return finishPayrollRun(run.ID)
+}
+
+// finishPayrollRun settles the run's status once no payouts are pending
+func finishPayrollRun(runID bson.ObjectId) error {
+	var run PayrollRun
+	if err := Cols.PayrollRuns.FindId(runID).One(&run); err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, line := range run.Lines {
+		switch line.PayoutStatus {
+		case payout.StatusPending:
+			return nil
+		case payout.StatusFailed:
+			failed++
+		}
+	}
+
+	set := M{"status": "executed"}
+	if failed > 0 {
+		set = M{
+			"status": "failed",
+			"error":  fmt.Sprintf("%d payouts failed", failed),
+		}
+	}
+
+	err := Cols.PayrollRuns.Update(M{
+		"_id":    runID,
+		"status": M{"$in": []string{"executing", "paying"}},
+	}, M{"$set": set})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+
+	return err
+}
+
+// PayPayrollLineByHand records a line of a failed run as paid outside the payout provider, e.g. when the provider
+// took a batch the run couldn't record. Reference is the provider's transaction or a note. The run is executed
+// once every line is paid.
+func PayPayrollLineByHand(run *PayrollRun, i int, reference string, by bson.ObjectId) error {
+	prefix := "lines." + strconv.Itoa(i) + "."
+	if err := Cols.PayrollRuns.Update(M{
+		"_id":                    run.ID,
+		prefix + "payout_status": M{"$ne": payout.StatusSuccess},
+	}, M{"$set": M{prefix + "paid_by_hand": true}}); err == mgo.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := payPayrollLine(run, i, by, payout.ItemResult{TransactionID: reference}); err != nil {
+		return err
+	}
+
+	if err := Cols.PayrollRuns.FindId(run.ID).One(run); err != nil {
+		return err
+	}
+
+	for _, line := range run.Lines {
+		if line.PayoutStatus != payout.StatusSuccess {
+			return nil
+		}
+	}
+
+	err := SetPayrollRunStatus(run.ID, []string{"failed"}, "executed", M{"error": ""})
+	if err == ErrPayrollRunStatus {
+		return nil
+	}
+
+	return err
+}
+
+// payPayrollLine records a driver as paid: their shifts, their payslip, the line, their ledger, then the payout email.
+// Only the instance which marks the line paid goes on past it.
+func payPayrollLine(run *PayrollRun, i int, by bson.ObjectId, result payout.ItemResult) error {
+	line := run.Lines[i]
+	prefix := "lines." + strconv.Itoa(i) + "."
+	now := time.Now()
+
+	for _, shift := range line.Shifts {
+		set := M{
+			"paid":    true,
+			"paid_by": by,
+			"paid_at": now,
+		}
+
+		if shift.Removed {
+			set["paid_amount"] = 0
+			set["deleted"] = true
+			set["deleted_reason"] = "Payroll"
+			set["deleted_date"] = now
+			set["deleted_by"] = by
+		} else {
+			set["paid_amount"] = float64(shift.Amount) / 100
+			if shift.Pay != nil {
+				set["pay"] = shift.Pay
+			}
+			if len(shift.OverrideReason) > 0 {
+				set["pay_override_reason"] = shift.OverrideReason
+			}
+		}
+
+		if err := Cols.Shifts.Update(M{
+			"_id":            shift.ShiftID,
+			"payroll_run_id": run.ID,
+			"paid":           false,
+		}, M{"$set": set}); err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+	}
+
+	// before the line is marked paid so a failure is retried, an existing payslip is kept
+	line.TransactionID = result.TransactionID
+	line.PaidAt = now
+	if _, _, err := CreatePayslip(run, line, now); err != nil {
+		return err
+	}
+
+	if err := Cols.PayrollRuns.Update(M{
+		"_id":                    run.ID,
+		prefix + "payout_status": M{"$ne": payout.StatusSuccess},
+	}, M{"$set": M{
+		prefix + "payout_status":  payout.StatusSuccess,
+		prefix + "payout_item_id": result.ItemID,
+		prefix + "transaction_id": result.TransactionID,
+		prefix + "payout_error":   "",
+		prefix + "paid_at":        now,
+	}}); err == mgo.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := settlePayrollLine(run, line, now, by); err != nil {
+		return err
+	}
+
+	// the line is paid, NotifyPayrollRun tries the email again
+	if err := notifyPayrollLine(run, i, line); err != nil {
+		fmt.Println("Payout email to", line.UserID.Hex(), "failed:", err)
+	}
+
+	return nil
+}
+
+// NotifyPayrollRun emails drivers paid in the last PayoutEmailRetry whose payout email wasn't sent
+func NotifyPayrollRun(run *PayrollRun) error {
+	var failed error
+	for i, line := range run.Lines {
+		if line.PayoutStatus != payout.StatusSuccess || !line.NotifiedAt.IsZero() || line.PaidAt.Before(time.Now().Add(-PayoutEmailRetry)) {
+			continue
+		}
+
+		if err := notifyPayrollLine(run, i, line); err != nil {
+			failed = err
+		}
+	}
+
+	return failed
+}
+
+// notifyPayrollLine emails a paid driver their payslip. The line is marked notified first so only one instance
+// sends it, and unmarked if the email fails so it is sent again.
+func notifyPayrollLine(run *PayrollRun, i int, line PayrollLine) error {
+	if line.Total <= 0 {
+		return nil
+	}
+
+	prefix := "lines." + strconv.Itoa(i) + "."
+	if err := Cols.PayrollRuns.Update(M{
+		"_id":                    run.ID,
+		prefix + "payout_status": payout.StatusSuccess,
+		prefix + "notified_at":   M{"$exists": false},
+	}, M{"$set": M{prefix + "notified_at": time.Now()}}); err == mgo.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := sendPayoutEmail(run, line); err != nil {
+		if err := Cols.PayrollRuns.UpdateId(run.ID, M{"$unset": M{prefix + "notified_at": 1}}); err != nil {
+			return err
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func sendPayoutEmail(run *PayrollRun, line PayrollLine) error {
+	payslip, pdf, err := CreatePayslip(run, line, line.PaidAt)
+	if err != nil {
+		return err
+	}
+
+	var user User
+	if err := Cols.Users.FindId(line.UserID).One(&user); err != nil {
+		return err
+	}
+
+	message, err := NewMail(user.Email, UserPayoutSubject, UserPayout, map[string]interface{}{
+		"UserName": user.GetName(),
+	})
+	if err != nil {
+		return err
+	}
+	message.AddBufferAttachment(payslip.Filename(), pdf)
+
+	_, _, err = config.Mail.Send(message)
+	return err
+}
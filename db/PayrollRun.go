@@ -0,0 +1,354 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// PayrollRunStatuses maps payroll run statuses to display names.
+// Runs go draft, approved, executing, paying (waiting for payouts to settle) then executed.
+// A failed run can be executed again, which only pays the drivers who weren't paid.
+var PayrollRunStatuses = map[string]string{
+	"draft":     "Draft",
+	"approved":  "Approved",
+	"executing": "Executing",
+	"paying":    "Paying",
+	"executed":  "Executed",
+	"failed":    "Failed",
+	"cancelled": "Cancelled",
+}
+
+// An executing run not finished after this long is assumed abandoned
+const payrollRunStuck = 15 * time.Minute
+
+// ErrPayrollRunStatus means the run was not in a status allowing the change, or changed concurrently
+var ErrPayrollRunStatus = errors.New("Payroll run is not in the right status")
+
+// PayrollRun pays drivers for completed shifts in a period. Shifts and fines are claimed by
+// the run (payroll_run_id) when drafted so they can't be paid twice, and released if it is cancelled.
+type PayrollRun struct {
+	ID     bson.ObjectId `bson:"_id,omitempty" json:"_id"`
+	From   time.Time     `bson:"from" json:"from"`
+	To     time.Time     `bson:"to" json:"to"`
+	Status string        `bson:"status" json:"status"`
+	Error  string        `bson:"error,omitempty" json:"error"`
+
+	Lines []PayrollLine `bson:"lines" json:"lines"`
+	// Pence
+	Total int64 `bson:"total" json:"total"`
+	// Provider batch IDs, one per execution that sent payouts
+	PayoutBatches []string `bson:"payout_batches" json:"payout_batches"`
+
+	Created     time.Time     `bson:"created" json:"created"`
+	CreatedBy   bson.ObjectId `bson:"created_by" json:"created_by"`
+	UpdatedAt   time.Time     `bson:"updated_at,omitempty" json:"updated_at"`
+	UpdatedBy   bson.ObjectId `bson:"updated_by,omitempty" json:"updated_by"`
+	ApprovedAt  time.Time     `bson:"approved_at,omitempty" json:"approved_at"`
+	ApprovedBy  bson.ObjectId `bson:"approved_by,omitempty" json:"approved_by"`
+	ExecutedAt  time.Time     `bson:"executed_at,omitempty" json:"executed_at"`
+	ExecutedBy  bson.ObjectId `bson:"executed_by,omitempty" json:"executed_by"`
+	CancelledAt time.Time     `bson:"cancelled_at,omitempty" json:"cancelled_at"`
+	CancelledBy bson.ObjectId `bson:"cancelled_by,omitempty" json:"cancelled_by"`
+}
+
+// PayrollLine is a driver's pay in a run, amounts in pence. Total is Gross less fuel charges and fines
+// plus adjustments from the driver's ledger, never below zero; Unrecovered is what couldn't be deducted.
+type PayrollLine struct {
+	UserID      bson.ObjectId `bson:"user_id" json:"user_id"`
+	Name        string        `bson:"name" json:"name"`
+	PaypalEmail string        `bson:"paypal_email" json:"paypal_email"`
+
+	Shifts      []PayrollShift      `bson:"shifts" json:"shifts"`
+	Fines       []PayrollFine       `bson:"fines" json:"fines"`
+	Adjustments []PayrollAdjustment `bson:"adjustments" json:"adjustments"`
+
+	Gross           int64 `bson:"gross" json:"gross"`
+	FuelCharges     int64 `bson:"fuel_charges" json:"fuel_charges"`
+	FineTotal       int64 `bson:"fine_total" json:"fine_total"`
+	AdjustmentTotal int64 `bson:"adjustment_total" json:"adjustment_total"`
+	Total           int64 `bson:"total" json:"total"`
+	Unrecovered     int64 `bson:"unrecovered" json:"unrecovered"`
+
+	// payout.Status*, empty until sent. Success once paid, by the provider or by hand.
+	PayoutStatus  string    `bson:"payout_status,omitempty" json:"payout_status"`
+	PayoutBatchID string    `bson:"payout_batch_id,omitempty" json:"payout_batch_id"`
+	PayoutItemID  string    `bson:"payout_item_id,omitempty" json:"payout_item_id"`
+	TransactionID string    `bson:"transaction_id,omitempty" json:"transaction_id"`
+	PayoutError   string    `bson:"payout_error,omitempty" json:"payout_error"`
+	PaidAt        time.Time `bson:"paid_at,omitempty" json:"paid_at"`
+	// Marked paid by an admin after the run failed, TransactionID is their reference
+	PaidByHand bool `bson:"paid_by_hand,omitempty" json:"paid_by_hand"`
+	// When the driver was emailed their payslip
+	NotifiedAt time.Time `bson:"notified_at,omitempty" json:"notified_at"`
+}
+
+// PayrollShift is a shift paid in a run. Amount is the calculated pay unless overridden with a reason.
+type PayrollShift struct {
+	ShiftID    bson.ObjectId `bson:"shift_id" json:"shift_id"`
+	Date       time.Time     `bson:"date" json:"date"`
+	FuelCharge int64         `bson:"fuel_charge" json:"fuel_charge"`
+
+	Pay      *PayBreakdown `bson:"pay,omitempty" json:"pay"`
+	PayError string        `bson:"pay_error,omitempty" json:"pay_error"`
+
+	Amount         int64  `bson:"amount" json:"amount"`
+	OverrideReason string `bson:"override_reason,omitempty" json:"override_reason"`
+	// Not paid, deleted when the run executes
+	Removed bool `bson:"removed" json:"removed"`
+}
+
+// PayrollFine is a fine marked deducted, taken from the driver's pay
+type PayrollFine struct {
+	FineID    bson.ObjectId `bson:"fine_id" json:"fine_id"`
+	Reference string        `bson:"reference" json:"reference"`
+	Amount    int64         `bson:"amount" json:"amount"`
+}
+
+// PayrollAdjustment is a damage charge, manual adjustment or earlier shortfall from the driver's ledger
+type PayrollAdjustment struct {
+	TransactionID bson.ObjectId `bson:"transaction_id" json:"transaction_id"`
+	Type          string        `bson:"type" json:"type"`
+	Description   string        `bson:"description" json:"description"`
+	Amount        int64         `bson:"amount" json:"amount"`
+}
+
+// NewPayrollRun drafts a run for the completed, unpaid shifts matching query which aren't in another run.
+// Fines and ledger adjustments are only taken for drivers with shifts in the run.
+func NewPayrollRun(query M, from time.Time, to time.Time, by bson.ObjectId) (*PayrollRun, error) {
+	run := &PayrollRun{
+		ID:        bson.NewObjectId(),
+		From:      from,
+		To:        to,
+		Status:    "draft",
+		Lines:     []PayrollLine{},
+		Created:   time.Now(),
+		CreatedBy: by,
+	}
+
+	if err := Cols.PayrollRuns.Insert(run); err != nil {
+		return nil, err
+	}
+
+	query["status"] = "complete"
+	query["paid"] = false
+	query["deleted"] = M{"$ne": true}
+	query["payroll_run_id"] = M{"$exists": false}
+
+	var shifts []Shift
+	if err := Cols.Shifts.Find(query).Sort("date").All(&shifts); err != nil {
+		return nil, err
+	}
+
+	lines := map[bson.ObjectId]*PayrollLine{}
+	order := []bson.ObjectId{}
+	for _, shift := range shifts {
+		// claim, another run may have got there first
+		if err := Cols.Shifts.Update(M{
+			"_id":            shift.ID,
+			"payroll_run_id": M{"$exists": false},
+		}, M{"$set": M{"payroll_run_id": run.ID}}); err == mgo.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		line, ok := lines[shift.UserID]
+		if !ok {
+			line = &PayrollLine{UserID: shift.UserID, Shifts: []PayrollShift{}, Fines: []PayrollFine{}, Adjustments: []PayrollAdjustment{}}
+			lines[shift.UserID] = line
+			order = append(order, shift.UserID)
+		}
+
+		line.Shifts = append(line.Shifts, PayrollShift{
+			ShiftID:    shift.ID,
+			Date:       shift.Date,
+			FuelCharge: shift.FuelCharge,
+		})
+	}
+
+	for _, userID := range order {
+		line := lines[userID]
+
+		var user User
+		if err := Cols.Users.FindId(userID).One(&user); err != nil && err != mgo.ErrNotFound {
+			return nil, err
+		}
+		line.Name = user.GetName()
+
+		var membership UserMembership
+		if err := Cols.Memberships.Find(M{"user_id": userID}).One(&membership); err != nil && err != mgo.ErrNotFound {
+			return nil, err
+		}
+		line.PaypalEmail = membership.PaypalEmail
+
+		for i := range line.Shifts {
+			var shift Shift
+			if err := Cols.Shifts.FindId(line.Shifts[i].ShiftID).One(&shift); err != nil {
+				return nil, err
+			}
+
+			pay, err := CalculatePay(shift, membership)
+			if err != nil {
+				line.Shifts[i].PayError = err.Error()
+				continue
+			}
+
+			line.Shifts[i].Pay = &pay
+			line.Shifts[i].Amount = pay.Total
+		}
+
+		var fines []Fine
+		if err := Cols.Fines.Find(M{
+			"user_id":        userID,
+			"status":         "deducted",
+			"payroll_run_id": M{"$exists": false},
+		}).All(&fines); err != nil {
+			return nil, err
+		}
+
+		for _, fine := range fines {
+			if err := Cols.Fines.Update(M{
+				"_id":            fine.ID,
+				"payroll_run_id": M{"$exists": false},
+			}, M{"$set": M{"payroll_run_id": run.ID}}); err == mgo.ErrNotFound {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+
+			line.Fines = append(line.Fines, PayrollFine{
+				FineID:    fine.ID,
+				Reference: fine.Reference,
+				Amount:    fine.Amount,
+			})
+		}
+
+		adjustments, err := claimPayrollAdjustments(run.ID, userID)
+		if err != nil {
+			return nil, err
+		}
+		line.Adjustments = adjustments
+
+		run.Lines = append(run.Lines, *line)
+	}
+
+	run.UpdateTotals()
+	if err := Cols.PayrollRuns.UpdateId(run.ID, M{"$set": M{
+		"lines": run.Lines,
+		"total": run.Total,
+	}}); err != nil {
+		return nil, err
+	}
+
+	return run, nil
+}
+
+// UpdateTotals works out line and run totals from the shifts and fines
+func (run *PayrollRun) UpdateTotals() {
+	run.Total = 0
+	for i := range run.Lines {
+		line := &run.Lines[i]
+		line.Gross, line.FuelCharges, line.FineTotal, line.AdjustmentTotal = 0, 0, 0, 0
+
+		for _, shift := range line.Shifts {
+			if shift.Removed {
+				continue
+			}
+
+			line.Gross += shift.Amount
+			line.FuelCharges += shift.FuelCharge
+		}
+
+		for _, fine := range line.Fines {
+			line.FineTotal += fine.Amount
+		}
+
+		for _, adjustment := range line.Adjustments {
+			line.AdjustmentTotal += adjustment.Amount
+		}
+
+		line.Total = line.Gross - line.FuelCharges - line.FineTotal + line.AdjustmentTotal
+		line.Unrecovered = 0
+		if line.Total < 0 {
+			line.Unrecovered = -line.Total
+			line.Total = 0
+		}
+
+		run.Total += line.Total
+	}
+}
+
+// Unresolved lists shifts whose pay couldn't be calculated and haven't been given an amount
+func (run *PayrollRun) Unresolved() []bson.ObjectId {
+	shifts := []bson.ObjectId{}
+	for _, line := range run.Lines {
+		for _, shift := range line.Shifts {
+			if len(shift.PayError) > 0 && len(shift.OverrideReason) == 0 && !shift.Removed {
+				shifts = append(shifts, shift.ShiftID)
+			}
+		}
+	}
+
+	return shifts
+}
+
+// SetPayrollRunStatus moves a run from one of the statuses to status, ErrPayrollRunStatus if it wasn't in any of them
+func SetPayrollRunStatus(runID bson.ObjectId, from []string, status string, set M) error {
+	if set == nil {
+		set = M{}
+	}
+	set["status"] = status
+
+	err := Cols.PayrollRuns.Update(M{
+		"_id":    runID,
+		"status": M{"$in": from},
+	}, M{"$set": set})
+	if err == mgo.ErrNotFound {
+		return ErrPayrollRunStatus
+	}
+
+	return err
+}
+
+// ClaimPayrollRunExecution moves an approved or failed run to executing. A run left executing
+// for longer than payrollRunStuck (the instance died) can be claimed again.
+func ClaimPayrollRunExecution(runID bson.ObjectId, by bson.ObjectId) error {
+	now := time.Now()
+	err := Cols.PayrollRuns.Update(M{
+		"_id": runID,
+		"$or": []M{
+			{"status": M{"$in": []string{"approved", "failed"}}},
+			{"status": "executing", "executed_at": M{"$lt": now.Add(-payrollRunStuck)}},
+		},
+	}, M{"$set": M{
+		"status":      "executing",
+		"executed_at": now,
+		"executed_by": by,
+		"error":       "",
+	}})
+	if err == mgo.ErrNotFound {
+		return ErrPayrollRunStatus
+	}
+
+	return err
+}
+
+// ReleasePayrollRun frees a cancelled run's shifts, fines and ledger adjustments for another run
+func ReleasePayrollRun(runID bson.ObjectId) error {
+	if _, err := Cols.Transactions.UpdateAll(M{"payroll_run_id": runID}, M{"$unset": M{"payroll_run_id": 1}}); err != nil {
+		return err
+	}
+
+	if _, err := Cols.Shifts.UpdateAll(M{
+		"payroll_run_id": runID,
+		"paid":           false,
+	}, M{"$unset": M{"payroll_run_id": 1}}); err != nil {
+		return err
+	}
+
+	_, err := Cols.Fines.UpdateAll(M{"payroll_run_id": runID}, M{"$unset": M{"payroll_run_id": 1}})
+	return err
+}
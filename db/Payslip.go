@@ -0,0 +1,247 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/jung-kurt/gofpdf"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// PayslipBucket is the GridFS bucket holding payslip PDFs
+const PayslipBucket = "payslips"
+
+// Payslip is a driver's pay from a payroll run, the PDF is in PayslipBucket. Amounts in pence.
+type Payslip struct {
+	ID     bson.ObjectId `bson:"_id,omitempty" json:"_id"`
+	RunID  bson.ObjectId `bson:"run_id" json:"run_id"`
+	UserID bson.ObjectId `bson:"user_id" json:"user_id"`
+
+	// Dates of the first and last shift paid
+	From   time.Time `bson:"from" json:"from"`
+	To     time.Time `bson:"to" json:"to"`
+	PaidAt time.Time `bson:"paid_at" json:"paid_at"`
+
+	Gross       int64 `bson:"gross" json:"gross"`
+	Deductions  int64 `bson:"deductions" json:"deductions"`
+	Adjustments int64 `bson:"adjustments" json:"adjustments"`
+	Total       int64 `bson:"total" json:"total"`
+
+	FileID  bson.ObjectId `bson:"file_id" json:"-"`
+	Created time.Time     `bson:"created" json:"created"`
+}
+
+// Filename is what the PDF is downloaded and attached as
+func (payslip Payslip) Filename() string {
+	return "payslip-" + payslip.PaidAt.Format("2006-01-02") + ".pdf"
+}
+
+// CreatePayslip renders and stores the payslip for a driver's line in a run,
+// or returns the one already stored. Returns the PDF too.
+func CreatePayslip(run *PayrollRun, line PayrollLine, paidAt time.Time) (*Payslip, []byte, error) {
+	var payslip Payslip
+	err := Cols.Payslips.Find(M{"run_id": run.ID, "user_id": line.UserID}).One(&payslip)
+	if err == nil {
+		pdf, err := ReadPayslip(payslip)
+		return &payslip, pdf, err
+	} else if err != mgo.ErrNotFound {
+		return nil, nil, err
+	}
+
+	payslip = Payslip{
+		ID:          bson.NewObjectId(),
+		RunID:       run.ID,
+		UserID:      line.UserID,
+		PaidAt:      paidAt,
+		Gross:       line.Gross,
+		Deductions:  line.FuelCharges + line.FineTotal - line.Unrecovered,
+		Adjustments: line.AdjustmentTotal,
+		Total:       line.Total,
+		Created:     time.Now(),
+	}
+
+	for _, shift := range line.Shifts {
+		if shift.Removed {
+			continue
+		}
+		if payslip.From.IsZero() || shift.Date.Before(payslip.From) {
+			payslip.From = shift.Date
+		}
+		if shift.Date.After(payslip.To) {
+			payslip.To = shift.Date
+		}
+	}
+
+	pdf, err := RenderPayslip(run, line, paidAt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := DB.GridFS(PayslipBucket).Create(payslip.ID.Hex() + ".pdf")
+	if err != nil {
+		return nil, nil, err
+	}
+	file.SetContentType("application/pdf")
+	// served as the download name
+	file.SetMeta(map[string]string{"name": payslip.Filename()})
+
+	if _, err := file.Write(pdf); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	if err := file.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	payslip.FileID = file.Id().(bson.ObjectId)
+	if err := Cols.Payslips.Insert(&payslip); err != nil {
+		return nil, nil, err
+	}
+
+	return &payslip, pdf, nil
+}
+
+// ReadPayslip loads a stored payslip PDF
+func ReadPayslip(payslip Payslip) ([]byte, error) {
+	file, err := DB.GridFS(PayslipBucket).OpenId(payslip.FileID)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ioutil.ReadAll(file)
+}
+
+// RenderPayslip draws a driver's payslip for a run as a PDF
+func RenderPayslip(run *PayrollRun, line PayrollLine, paidAt time.Time) ([]byte, error) {
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.SetTitle("Maple Fleet payslip", true)
+	pdf.AddPage()
+
+	// core fonts are cp1252, which has £
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	money := func(pence int64) string {
+		sign := ""
+		if pence < 0 {
+			sign, pence = "-", -pence
+		}
+		return tr(fmt.Sprintf("%s£%d.%02d", sign, pence/100, pence%100))
+	}
+
+	pdf.SetFont("Helvetica", "B", 16)
+	pdf.CellFormat(0, 10, "Maple Fleet payslip", "", 1, "L", false, 0, "")
+
+	pdf.SetFont("Helvetica", "", 10)
+	details := [][2]string{
+		{"Driver", line.Name},
+		{"Paid", paidAt.Format("02/01/2006")},
+		{"Payroll run", run.ID.Hex()},
+	}
+	if len(line.TransactionID) > 0 {
+		details = append(details, [2]string{"Payment reference", line.TransactionID})
+	}
+	for _, detail := range details {
+		pdf.CellFormat(40, 6, detail[0], "", 0, "L", false, 0, "")
+		pdf.CellFormat(0, 6, tr(detail[1]), "", 1, "L", false, 0, "")
+	}
+	pdf.Ln(4)
+
+	columns := []struct {
+		title string
+		width float64
+	}{
+		{"Date", 24}, {"Hours", 16}, {"Rate", 20}, {"Basic", 22}, {"Premiums", 22}, {"Top-up", 20}, {"Bike hire", 22}, {"Amount", 24},
+	}
+
+	pdf.SetFont("Helvetica", "B", 9)
+	pdf.SetFillColor(230, 230, 230)
+	for _, column := range columns {
+		pdf.CellFormat(column.width, 7, column.title, "B", 0, "L", true, 0, "")
+	}
+	pdf.Ln(-1)
+
+	pdf.SetFont("Helvetica", "", 9)
+	for _, shift := range line.Shifts {
+		if shift.Removed {
+			continue
+		}
+
+		cells := []string{shift.Date.Format("02/01/2006"), "", "", "", "", "", "", money(shift.Amount)}
+		if shift.Pay != nil {
+			cells[1] = fmt.Sprintf("%.2f", shift.Pay.Hours)
+			cells[2] = money(shift.Pay.HourlyRate)
+			cells[3] = money(shift.Pay.Base)
+			cells[4] = money(shift.Pay.WeekendPremium + shift.Pay.NightPremium + shift.Pay.HolidayPremium)
+			cells[5] = money(shift.Pay.MinimumTopUp)
+			cells[6] = money(-shift.Pay.BikeHire)
+		}
+
+		for i, column := range columns {
+			pdf.CellFormat(column.width, 6, cells[i], "", 0, "L", false, 0, "")
+		}
+		pdf.Ln(-1)
+
+		if shift.Pay == nil || shift.Amount != shift.Pay.Total {
+			pdf.SetFont("Helvetica", "I", 8)
+			pdf.MultiCell(0, 5, tr("Adjusted: "+shift.OverrideReason), "", "L", false)
+			pdf.SetFont("Helvetica", "", 9)
+		}
+	}
+	pdf.Ln(4)
+
+	row := func(label string, amount int64) {
+		pdf.CellFormat(146, 6, tr(label), "", 0, "L", false, 0, "")
+		pdf.CellFormat(24, 6, money(amount), "", 1, "L", false, 0, "")
+	}
+
+	if line.FuelCharges > 0 || len(line.Fines) > 0 || line.Unrecovered > 0 {
+		pdf.SetFont("Helvetica", "B", 10)
+		pdf.CellFormat(0, 7, "Deductions", "", 1, "L", false, 0, "")
+		pdf.SetFont("Helvetica", "", 9)
+
+		if line.FuelCharges > 0 {
+			row("Fuel charges", -line.FuelCharges)
+		}
+		for _, fine := range line.Fines {
+			row("Penalty notice "+fine.Reference, -fine.Amount)
+		}
+		if line.Unrecovered > 0 {
+			row("Not recovered this time", line.Unrecovered)
+		}
+		pdf.Ln(4)
+	}
+
+	if len(line.Adjustments) > 0 {
+		pdf.SetFont("Helvetica", "B", 10)
+		pdf.CellFormat(0, 7, "Adjustments", "", 1, "L", false, 0, "")
+		pdf.SetFont("Helvetica", "", 9)
+
+		for _, adjustment := range line.Adjustments {
+			row(adjustment.Description, adjustment.Amount)
+		}
+		pdf.Ln(4)
+	}
+
+	pdf.SetFont("Helvetica", "B", 10)
+	row("Gross pay", line.Gross)
+	if line.AdjustmentTotal != 0 {
+		row("Adjustments", line.AdjustmentTotal)
+	}
+	row("Deductions", -(line.FuelCharges + line.FineTotal - line.Unrecovered))
+	row("Total paid", line.Total)
+
+	pdf.Ln(6)
+	pdf.SetFont("Helvetica", "", 8)
+	pdf.MultiCell(0, 4, "You are paid as a self-employed contractor and no tax or National Insurance has been deducted. Keep your payslips for your tax return.", "", "L", false)
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -13,3 +13,64 @@ type Permission struct {
 		Type string        `json"type"`
 	} `json:"restrictions"`
 }
+
+// FindPrivilegedEmails returns email addresses of users holding any of the privilege types
+func FindPrivilegedEmails(types ...string) ([]string, error) {
+	return findPermissionEmails(M{
+		"type": M{"$in": types},
+	})
+}
+
+// FindGarageEmails returns email addresses of users holding any of the privilege types restricted to the garage
+func FindGarageEmails(garageID bson.ObjectId, types ...string) ([]string, error) {
+	return findPermissionEmails(M{
+		"type":         M{"$in": types},
+		"restrictions": M{"$elemMatch": M{"id": garageID, "type": "garage"}},
+	})
+}
+
+func findPermissionEmails(query M) ([]string, error) {
+	var userIDs []bson.ObjectId
+	if err := Cols.Privileges.Find(query).Distinct("user_id", &userIDs); err != nil {
+		return nil, err
+	}
+
+	var users []User
+	if err := Cols.Users.Find(M{
+		"_id":     M{"$in": userIDs},
+		"blocked": M{"$ne": true},
+	}).Select(M{"email": 1}).All(&users); err != nil {
+		return nil, err
+	}
+
+	emails := make([]string, len(users))
+	for i, user := range users {
+		emails[i] = user.Email
+	}
+
+	return emails, nil
+}
+
+// FindRestrictedGarages returns the garages a user's privileges are restricted to, nil when unrestricted.
+// Admins are never restricted.
+func FindRestrictedGarages(userID bson.ObjectId) ([]bson.ObjectId, error) {
+	var permissions []Permission
+	if err := Cols.Privileges.Find(M{"user_id": userID}).All(&permissions); err != nil {
+		return nil, err
+	}
+
+	var garages []bson.ObjectId
+	for _, permission := range permissions {
+		if permission.Type == "admin" || permission.Type == "superadmin" {
+			return nil, nil
+		}
+
+		for _, restriction := range permission.Restrictions {
+			if restriction.Type == "garage" {
+				garages = append(garages, restriction.ID)
+			}
+		}
+	}
+
+	return garages, nil
+}
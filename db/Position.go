@@ -0,0 +1,92 @@
+package db
+
+import (
+	"strconv"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Position is a GPS fix stored locally from a bike's tracker
+type Position struct {
+	ID     bson.ObjectId `bson:"_id,omitempty" json:"_id"`
+	BikeID bson.ObjectId `bson:"bike_id" json:"bike_id"`
+
+	// Tracker server device and its ID for the fix
+	TrackerID  int `bson:"tracker_id,omitempty" json:"tracker_id"`
+	PositionID int `bson:"position_id,omitempty" json:"position_id"`
+	// Bike.DeviceID for positions reported directly by the device
+	DeviceID string `bson:"device_id,omitempty" json:"device_id"`
+
+	// Identifies the fix from its source so repeats are skipped
+	Key string `bson:"key" json:"-"`
+
+	FixTime   time.Time `bson:"fix_time" json:"fix_time"`
+	Latitude  float64   `json:"latitude"`
+	Longitude float64   `json:"longitude"`
+	Speed     float64   `json:"speed"`
+	Course    float64   `json:"course"`
+	Battery   float64   `json:"battery,omitempty"`
+}
+
+// SetKey identifies the position by tracker server ID, or by device and time when reported directly
+func (position *Position) SetKey() {
+	if position.TrackerID > 0 && position.PositionID > 0 {
+		position.Key = "tracker:" + strconv.Itoa(position.TrackerID) + ":" + strconv.Itoa(position.PositionID)
+		return
+	}
+
+	position.Key = "device:" + position.DeviceID + ":" + strconv.FormatInt(position.FixTime.UnixNano(), 10)
+}
+
+// EnsurePositionIndexes creates indexes for reading positions by device or bike over time,
+// and for skipping positions already stored
+func EnsurePositionIndexes() error {
+	indexes := []mgo.Index{
+		{Key: []string{"tracker_id", "fix_time"}},
+		{Key: []string{"device_id", "fix_time"}},
+		{Key: []string{"bike_id", "fix_time"}},
+		{Key: []string{"key"}, Unique: true},
+	}
+
+	for _, index := range indexes {
+		if err := Cols.Positions.EnsureIndex(index); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// InsertPositions stores positions, skipping any already stored
+func InsertPositions(positions []Position) error {
+	if len(positions) == 0 {
+		return nil
+	}
+
+	bulk := Cols.Positions.Bulk()
+	bulk.Unordered()
+	for _, position := range positions {
+		position.SetKey()
+		bulk.Insert(position)
+	}
+
+	if _, err := bulk.Run(); err != nil && !mgo.IsDup(err) {
+		return err
+	}
+
+	return nil
+}
+
+// LastPositionTime is the newest stored fix for a tracker, zero if none
+func LastPositionTime(trackerID int) (time.Time, error) {
+	var position Position
+	if err := Cols.Positions.Find(M{"tracker_id": trackerID}).Sort("-fix_time").One(&position); err == mgo.ErrNotFound {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+
+	return position.FixTime, nil
+}
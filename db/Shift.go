@@ -23,10 +23,26 @@ type Shift struct {
 	CheckOut         time.Time     `json:"check_out" bson:"check_out,omitempty"`
 	ShiftNotes       string        `json:"shift_notes" bson:"shift_notes"`
 
+	// Bikes scanned at handover, HandoverMismatch is set when either differed from ScooterID
+	CheckInBikeID    bson.ObjectId `json:"check_in_bike_id" bson:"check_in_bike_id,omitempty"`
+	CheckOutBikeID   bson.ObjectId `json:"check_out_bike_id" bson:"check_out_bike_id,omitempty"`
+	HandoverMismatch bool          `json:"handover_mismatch" bson:"handover_mismatch"`
+
 	Paid       bool          `json:"paid"`
 	PaidAmount float64       `json:"paid_amount" bson:"paid_amount"`
 	PaidBy     bson.ObjectId `json:"paid_by" bson:"paid_by,omitempty"`
 	PaidAt     time.Time     `json:"paid_at" bson:"paid_at"`
+	// Calculated pay when paid, the override reason is set when PaidAmount differs from it
+	Pay               *PayBreakdown `json:"pay" bson:"pay,omitempty"`
+	PayOverrideReason string        `json:"pay_override_reason" bson:"pay_override_reason,omitempty"`
+	// Payroll run the shift is in, set when the run is drafted
+	PayrollRunID bson.ObjectId `json:"payroll_run_id" bson:"payroll_run_id,omitempty"`
+
+	// Fuel missing at check-out charged to the driver, in pence
+	FuelCharge int64 `json:"fuel_charge" bson:"fuel_charge"`
+
+	// Set by the driving analytics job once the shift is complete
+	Driving *DrivingSummary `json:"driving" bson:"driving,omitempty"`
 
 	Added         time.Time     `json:"added" bson:"added"`
 	AddedBy       bson.ObjectId `json:"added_by" bson:"added_by"`
@@ -36,15 +52,45 @@ type Shift struct {
 	DeletedBy     bson.ObjectId `json:"deleted_by" bson:"deleted_by,omitempty"`
 }
 
+// BikeSwap records a handover where the scanned bike differed from the booked one
+type BikeSwap struct {
+	ID            bson.ObjectId `json:"_id" bson:"_id,omitempty"`
+	ShiftID       bson.ObjectId `json:"shift_id" bson:"shift_id"`
+	BookedBikeID  bson.ObjectId `json:"booked_bike_id" bson:"booked_bike_id"`
+	ScannedBikeID bson.ObjectId `json:"scanned_bike_id" bson:"scanned_bike_id"`
+
+	// check-in/check-out
+	Stage string `json:"stage" bson:"stage"`
+	// pending/approved/rejected
+	Status string `json:"status" bson:"status"`
+
+	ReportedBy bson.ObjectId `json:"reported_by" bson:"reported_by"`
+	ReportedAt time.Time     `json:"reported_at" bson:"reported_at"`
+	ResolvedBy bson.ObjectId `json:"resolved_by" bson:"resolved_by,omitempty"`
+	ResolvedAt time.Time     `json:"resolved_at" bson:"resolved_at,omitempty"`
+}
+
 // GetAvailableScooters returns bikes which can be hired
 func GetAvailableScooters(garageID bson.ObjectId, date time.Time, maxCC int) []Bike {
 	var bikes []Bike
 	var availableBikes []Bike
 
+	// bikes which are no longer road legal
+	lapsed, err := FindLapsedBikeIDs()
+	if err != nil {
+		panic(err)
+	}
+
+	// bikes leaving the garage by then
+	transferring, err := FindTransferringBikeIDs(date)
+	if err != nil {
+		panic(err)
+	}
+
 	q := M{
+		"_id":       M{"$nin": append(lapsed, transferring...)},
 		"garage_id": garageID,
-		"available": true,
-		"archived":  false,
+		"status":    BikeStatusInService,
 	}
 
 	if maxCC > 0 {
@@ -75,7 +121,13 @@ func GetAvailableScooters(garageID bson.ObjectId, date time.Time, maxCC int) []B
 			panic(err)
 		}
 
-		if len(shifts) == 0 {
+		if len(shifts) > 0 {
+			continue
+		}
+
+		if overdue, err := HasOverdueCriticalMaintenance(bike); err != nil {
+			panic(err)
+		} else if !overdue {
 			availableBikes = append(availableBikes, bike)
 		}
 	}
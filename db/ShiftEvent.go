@@ -0,0 +1,35 @@
+package db
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ShiftEvent records a shift changing status, for the live fleet feed
+type ShiftEvent struct {
+	// Left to the server so IDs increase in insert order across API instances
+	ID bson.ObjectId `bson:"_id,omitempty" json:"_id"`
+
+	ShiftID  bson.ObjectId `bson:"shift_id" json:"shift_id"`
+	GarageID bson.ObjectId `bson:"garage_id" json:"garage_id"`
+	BikeID   bson.ObjectId `bson:"bike_id" json:"bike_id"`
+	UserID   bson.ObjectId `bson:"user_id" json:"user_id"`
+
+	Status    string        `json:"status"`
+	ChangedBy bson.ObjectId `bson:"changed_by,omitempty" json:"changed_by"`
+	ChangedAt time.Time     `bson:"changed_at" json:"changed_at"`
+}
+
+// RecordShiftEvent notes that the shift moved to status
+func RecordShiftEvent(shift Shift, status string, by bson.ObjectId) error {
+	return Cols.ShiftEvents.Insert(&ShiftEvent{
+		ShiftID:   shift.ID,
+		GarageID:  shift.GarageID,
+		BikeID:    shift.ScooterID,
+		UserID:    shift.UserID,
+		Status:    status,
+		ChangedBy: by,
+		ChangedAt: time.Now(),
+	})
+}
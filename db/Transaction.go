@@ -1,15 +1,347 @@
 package db
 
-import "gopkg.in/mgo.v2/bson"
+import (
+	"errors"
+	"time"
 
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// TransactionTypes maps driver ledger entry types to display names
+var TransactionTypes = map[string]string{
+	"shift_pay":       "Shift pay",
+	"bike_hire":       "Bike hire",
+	"fuel":            "Fuel",
+	"fine":            "Penalty notice",
+	"damage":          "Damage",
+	"adjustment":      "Adjustment",
+	"payout":          "Payout",
+	"carried_forward": "Carried forward",
+	"brought_forward": "Brought forward",
+	"deposit":         "Deposit",
+	"card_charge":     "Card charge",
+	"card_refund":     "Card refund",
+}
+
+// CardTransactionTypes record Stripe activity on the driver's card. They aren't part of the ledger balance.
+var CardTransactionTypes = []string{"deposit", "card_charge", "card_refund"}
+
+// CardTransactionStatuses maps the statuses of card entries to display names.
+// Deposits are held on the card until captured or released; holds lapse after 7 days so are renewed before then.
+var CardTransactionStatuses = map[string]string{
+	"pending":   "Pending",
+	"held":      "Held",
+	"captured":  "Captured",
+	"released":  "Released",
+	"expired":   "Expired",
+	"succeeded": "Succeeded",
+	"failed":    "Failed",
+}
+
+// ErrTransactionSettled means the entry is in a payroll run and can't be changed
+var ErrTransactionSettled = errors.New("Entry is already in a payroll run")
+
+// payrollAdjustmentTypes are settled by the next payroll run paying the driver, on top of their shifts and fines
+var payrollAdjustmentTypes = []string{"damage", "adjustment", "brought_forward"}
+
+// Transaction is an entry in a driver's ledger, in pence: positive credits the driver, negative debits them.
+// Entries link to their source (shift, incident or fine) and are settled by the payroll run paying them.
+// Card entries (CardTransactionTypes) instead hold the amount charged or refunded and the Stripe status.
 type Transaction struct {
-	ID bson.ObjectId `bson:"_id,omitempty" json:"_id"`
+	ID     bson.ObjectId `bson:"_id,omitempty" json:"_id"`
+	UserID bson.ObjectId `bson:"user_id,omitempty" json:"user_id"`
+
+	StripeID   string `bson:"stripe_id,omitempty" json:"stripe_id"`
+	StripeCard string `bson:"stripe_card,omitempty" json:"stripe_card"`
+	StripeUser string `bson:"stripe_user,omitempty" json:"stripe_user"`
+	Amount     int64  `bson:"amount" json:"amount"`
+
+	Type        string `bson:"type" json:"type"`
+	Status      string `bson:"status,omitempty" json:"status"`
+	Description string `bson:"description" json:"description"`
+
+	// Card entries: amount refunded or released so far, why Stripe failed, and the charge a refund is of
+	Refunded int64         `bson:"refunded,omitempty" json:"refunded"`
+	Error    string        `bson:"error,omitempty" json:"error"`
+	RefundOf bson.ObjectId `bson:"refund_of,omitempty" json:"refund_of"`
+	// Deposits: the deposit holding the amount again before this hold lapsed
+	RenewedBy bson.ObjectId `bson:"renewed_by,omitempty" json:"renewed_by"`
+
+	ShiftID    bson.ObjectId `bson:"shift_id,omitempty" json:"shift_id"`
+	IncidentID bson.ObjectId `bson:"incident_id,omitempty" json:"incident_id"`
+	FineID     bson.ObjectId `bson:"fine_id,omitempty" json:"fine_id"`
+	// Payroll run settling the entry, set for adjustments when the run is drafted
+	PayrollRunID bson.ObjectId `bson:"payroll_run_id,omitempty" json:"payroll_run_id"`
+
+	// Running balance after the entry, worked out when listing
+	Balance int64 `bson:"-" json:"balance"`
+
+	Created   time.Time     `bson:"created" json:"created"`
+	CreatedBy bson.ObjectId `bson:"created_by,omitempty" json:"created_by"`
+}
+
+// source matches the entry recorded for the same type and source, or the driver for entries without one
+func (entry Transaction) source() M {
+	query := M{"type": entry.Type}
+	switch {
+	case entry.FineID.Valid():
+		query["fine_id"] = entry.FineID
+	case entry.IncidentID.Valid():
+		query["incident_id"] = entry.IncidentID
+	case entry.ShiftID.Valid():
+		query["shift_id"] = entry.ShiftID
+	default:
+		query["user_id"] = entry.UserID
+	}
+
+	return query
+}
+
+// AddTransaction records a new entry, e.g. a manual adjustment
+func AddTransaction(entry Transaction) (Transaction, error) {
+	if !entry.ID.Valid() {
+		entry.ID = bson.NewObjectId()
+	}
+	if entry.Created.IsZero() {
+		entry.Created = time.Now()
+	}
+
+	return entry, Cols.Transactions.Insert(&entry)
+}
+
+// SetTransaction records the entry for its source, replacing the amount recorded before.
+// An amount of zero removes it. ErrTransactionSettled if it is already in a payroll run.
+func SetTransaction(entry Transaction) error {
+	settled := entry.source()
+	settled["payroll_run_id"] = M{"$exists": true}
+	if n, err := Cols.Transactions.Find(settled).Count(); err != nil {
+		return err
+	} else if n > 0 {
+		return ErrTransactionSettled
+	}
+
+	query := entry.source()
+	query["payroll_run_id"] = M{"$exists": false}
+	if entry.Amount == 0 {
+		_, err := Cols.Transactions.RemoveAll(query)
+		return err
+	}
+
+	_, err := Cols.Transactions.Upsert(query, M{
+		"$set": M{
+			"user_id":     entry.UserID,
+			"amount":      entry.Amount,
+			"description": entry.Description,
+		},
+		"$setOnInsert": M{
+			"created":    time.Now(),
+			"created_by": entry.CreatedBy,
+		},
+	})
+	return err
+}
+
+// SetFineTransaction debits the driver for a fine deducted from their pay, removing the debit if it no longer is
+func SetFineTransaction(fine Fine, by bson.ObjectId) error {
+	entry := Transaction{
+		UserID:      fine.UserID,
+		Type:        "fine",
+		Description: "Penalty notice " + fine.Reference,
+		FineID:      fine.ID,
+		CreatedBy:   by,
+	}
+	if fine.Status == "deducted" && fine.UserID.Valid() {
+		entry.Amount = -fine.Amount
+	}
+
+	if err := SetTransaction(entry); err != nil && err != ErrTransactionSettled {
+		return err
+	}
+
+	return nil
+}
+
+// CardCharged is true when a card charge matching the query (incident_id or fine_id) succeeded or is pending,
+// and hasn't been refunded in full
+func CardCharged(query M) (bool, error) {
+	query["type"] = "card_charge"
+	query["status"] = M{"$in": []string{"pending", "succeeded"}}
+
+	var charges []Transaction
+	if err := Cols.Transactions.Find(query).All(&charges); err != nil {
+		return false, err
+	}
+
+	for _, charge := range charges {
+		if charge.Refunded < charge.Amount {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// TransactionBalance totals the driver's ledger entries created before the time
+func TransactionBalance(userID bson.ObjectId, before time.Time) (int64, error) {
+	var result []struct {
+		Total int64 `bson:"total"`
+	}
+	if err := Cols.Transactions.Pipe([]M{
+		{"$match": M{"user_id": userID, "type": M{"$nin": CardTransactionTypes}, "created": M{"$lt": before}}},
+		{"$group": M{"_id": nil, "total": M{"$sum": "$amount"}}},
+	}).All(&result); err != nil {
+		return 0, err
+	}
+
+	if len(result) == 0 {
+		return 0, nil
+	}
+
+	return result[0].Total, nil
+}
+
+// FindTransactions lists the driver's ledger entries created from and before to, oldest first with running balances.
+// Returns the balance brought into the period.
+func FindTransactions(userID bson.ObjectId, from time.Time, to time.Time) ([]Transaction, int64, error) {
+	opening, err := TransactionBalance(userID, from)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	entries := []Transaction{}
+	if err := Cols.Transactions.Find(M{
+		"user_id": userID,
+		"type":    M{"$nin": CardTransactionTypes},
+		"created": M{"$gte": from, "$lt": to},
+	}).Sort("created", "_id").All(&entries); err != nil {
+		return nil, 0, err
+	}
+
+	balance := opening
+	for i := range entries {
+		balance += entries[i].Amount
+		entries[i].Balance = balance
+	}
+
+	return entries, opening, nil
+}
+
+// claimPayrollAdjustments claims the driver's adjustments for a draft run
+func claimPayrollAdjustments(runID bson.ObjectId, userID bson.ObjectId) ([]PayrollAdjustment, error) {
+	var entries []Transaction
+	if err := Cols.Transactions.Find(M{
+		"user_id":        userID,
+		"type":           M{"$in": payrollAdjustmentTypes},
+		"payroll_run_id": M{"$exists": false},
+	}).Sort("created").All(&entries); err != nil {
+		return nil, err
+	}
+
+	adjustments := []PayrollAdjustment{}
+	for _, entry := range entries {
+		if err := Cols.Transactions.Update(M{
+			"_id":            entry.ID,
+			"payroll_run_id": M{"$exists": false},
+		}, M{"$set": M{"payroll_run_id": runID}}); err == mgo.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		adjustments = append(adjustments, PayrollAdjustment{
+			TransactionID: entry.ID,
+			Type:          entry.Type,
+			Description:   entry.Description,
+			Amount:        entry.Amount,
+		})
+	}
+
+	return adjustments, nil
+}
+
+// settleTransaction records a source's final entry as settled by the run
+func settleTransaction(runID bson.ObjectId, entry Transaction) error {
+	query := entry.source()
+	query["payroll_run_id"] = M{"$in": []interface{}{nil, runID}}
+	if entry.Amount == 0 {
+		_, err := Cols.Transactions.RemoveAll(query)
+		return err
+	}
+
+	_, err := Cols.Transactions.Upsert(query, M{
+		"$set": M{
+			"user_id":        entry.UserID,
+			"amount":         entry.Amount,
+			"description":    entry.Description,
+			"payroll_run_id": runID,
+		},
+		"$setOnInsert": M{
+			"created":    entry.Created,
+			"created_by": entry.CreatedBy,
+		},
+	})
+	return err
+}
+
+// settlePayrollLine records a paid line in the driver's ledger: the final pay, bike hire and fuel for
+// each shift and the fines deducted, then the payout. A shortfall is carried forward to the next run.
+func settlePayrollLine(run *PayrollRun, line PayrollLine, paidAt time.Time, by bson.ObjectId) error {
+	entries := []Transaction{}
+	for _, shift := range line.Shifts {
+		// not paid, so nor is the fuel charged
+		if shift.Removed {
+			entries = append(entries, Transaction{Type: "fuel", ShiftID: shift.ShiftID})
+			continue
+		}
+
+		var hire int64
+		if shift.Pay != nil {
+			hire = shift.Pay.BikeHire
+		}
+
+		pay := Transaction{Type: "shift_pay", ShiftID: shift.ShiftID, Amount: shift.Amount + hire,
+			Description: "Shift on " + shift.Date.Format("02/01/2006")}
+		if len(shift.OverrideReason) > 0 {
+			pay.Description += ", adjusted: " + shift.OverrideReason
+		}
+
+		entries = append(entries, pay,
+			Transaction{Type: "bike_hire", ShiftID: shift.ShiftID, Amount: -hire, Description: "Bike hire"},
+			Transaction{Type: "fuel", ShiftID: shift.ShiftID, Amount: -shift.FuelCharge, Description: "Fuel charge"})
+	}
+
+	for _, fine := range line.Fines {
+		entries = append(entries, Transaction{Type: "fine", FineID: fine.FineID, Amount: -fine.Amount,
+			Description: "Penalty notice " + fine.Reference})
+	}
+
+	// adjustments were claimed when the run was drafted, which leaves the payout and any shortfall
+	entries = append(entries,
+		Transaction{Type: "payout", Amount: -line.Total, Description: "Paid by payroll run"},
+		Transaction{Type: "carried_forward", Amount: line.Unrecovered, Description: "Not recovered, carried forward"})
+
+	for _, entry := range entries {
+		entry.UserID = line.UserID
+		entry.Created = paidAt
+		entry.CreatedBy = by
+		if err := settleTransaction(run.ID, entry); err != nil {
+			return err
+		}
+	}
 
-	StripeID   string `json:"stripe_id"`
-	StripeCard string `json:"stripe_card"`
-	StripeUser string `json:"stripe_user"`
-	Amount     int64  `json:"amount"`
+	if line.Unrecovered <= 0 {
+		return nil
+	}
 
-	Type   string `json:"type"`
-	Status string `json:"status"`
+	// for the next run to recover
+	_, err := AddTransaction(Transaction{
+		UserID:      line.UserID,
+		Type:        "brought_forward",
+		Amount:      -line.Unrecovered,
+		Description: "Not recovered by the previous payroll run",
+		Created:     paidAt,
+		CreatedBy:   by,
+	})
+	return err
 }
@@ -72,6 +72,9 @@ type UserMembership struct {
 	UseOwnBike            bool      `json:"use_own_bike" bson:"use_own_bike"`
 	NextOfKin             string    `json:"next_of_kin" bson:"next_of_kin"`
 
+	// Picks the rate card, empty for the default
+	Grade string `json:"grade" bson:"grade"`
+
 	CheckCode         string `json:"check_code" bson:"check_code"`
 	UTR               string `json:"utr" bson:"utr"`
 	NationalInsurance string `json:"national_insurance" bson:"national_insurance"`
@@ -89,6 +92,12 @@ type UserMembership struct {
 
 	PrivateNotes string `json:"private_notes" bson:"private_notes"`
 	Rating       int    `json:"rating" bson:"rating"`
+
+	// Rating last given by staff, Rating includes the driving score when that is enabled
+	ManualRating *int `json:"manual_rating" bson:"manual_rating,omitempty"`
+	// Average driving score of recent shifts
+	DrivingScore  float64 `json:"driving_score" bson:"driving_score"`
+	DrivingShifts int     `json:"driving_shifts" bson:"driving_shifts"`
 }
 
 func FindUserByID(ID bson.ObjectId) (*User, error) {
@@ -21,6 +21,24 @@ type collectionsDeclaration struct {
 	Privileges      *mgo.Collection
 	Events          *mgo.Collection
 	Shifts          *mgo.Collection
+	BikeSwaps       *mgo.Collection
+	Checklists      *mgo.Collection
+	Inspections     *mgo.Collection
+	Mileage         *mgo.Collection
+	ServicePlans    *mgo.Collection
+	Compliance      *mgo.Collection
+	BikeStatus      *mgo.Collection
+	Transfers       *mgo.Collection
+	Fines           *mgo.Collection
+	Parts           *mgo.Collection
+	Fuel            *mgo.Collection
+	Positions       *mgo.Collection
+	Geofences       *mgo.Collection
+	ShiftEvents     *mgo.Collection
+	RateCards       *mgo.Collection
+	PayrollRuns     *mgo.Collection
+	Payslips        *mgo.Collection
+	Transactions    *mgo.Collection
 }
 
 var Cols collectionsDeclaration
@@ -38,5 +56,36 @@ func Setup() {
 		Privileges:      DB.C("privileges"),
 		Events:          DB.C("events"),
 		Shifts:          DB.C("shifts"),
+		BikeSwaps:       DB.C("bike_swaps"),
+		Checklists:      DB.C("checklists"),
+		Inspections:     DB.C("bikes_inspections"),
+		Mileage:         DB.C("bikes_mileage"),
+		ServicePlans:    DB.C("maintenance_plans"),
+		Compliance:      DB.C("bikes_compliance"),
+		BikeStatus:      DB.C("bikes_status"),
+		Transfers:       DB.C("bikes_transfers"),
+		Fines:           DB.C("fines"),
+		Parts:           DB.C("parts"),
+		Fuel:            DB.C("bikes_fuel"),
+		Positions:       DB.C("positions"),
+		Geofences:       DB.C("geofences"),
+		ShiftEvents:     DB.C("shift_events"),
+		RateCards:       DB.C("rate_cards"),
+		PayrollRuns:     DB.C("payroll_runs"),
+		Payslips:        DB.C("payslips"),
+		Transactions:    DB.C("transactions"),
 	}
 }
+
+// Migrate brings existing documents up to date with the models
+func Migrate() error {
+	if err := MigrateBikeStatus(); err != nil {
+		return err
+	}
+
+	if err := MigrateMaintenanceAttachments(); err != nil {
+		return err
+	}
+
+	return EnsurePositionIndexes()
+}
@@ -0,0 +1,17 @@
+package db
+
+import "math"
+
+const earthRadiusMiles = 3958.8
+
+// DistanceMiles returns the great-circle distance between two coordinates
+func DistanceMiles(lat1, lng1, lat2, lng2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLng := (lng2 - lng1) * rad
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLng/2)*math.Sin(dLng/2)
+
+	return 2 * earthRadiusMiles * math.Asin(math.Sqrt(a))
+}
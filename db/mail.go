@@ -103,7 +103,7 @@ Thank you for driving for us this week!
 
 We have now remitted your weekly wages to you nominated bank account by PayPal.
 
-If you wish to verify the amount you have received, please log into your Maple Fleet member profile and go to the Transactions tab.
+Your payslip is attached. You can download your payslips at any time from the Payslips section of your Maple Fleet member profile.
 
 If you have any queries, please contact us at info@maple.ai
 
@@ -171,6 +171,68 @@ Maple Fleet
 ![maple-fleet](https://maple.ai/front-page/sf-logo.png)
 `
 
+const ComplianceExpirySubject = `Maple Fleet Vehicle Documents Expiring`
+const ComplianceExpiry = `
+<style>* {font-size: 1rem;}</style>
+Hello,
+
+The following vehicle documents are expiring soon. Bikes cannot be booked once any document has lapsed.
+{{ range .Items }}
+- {{ .Registration }}: {{ .Type }} expires {{ .Expiry }}
+{{- end }}
+
+Please upload the renewed documents in the admin bike view.
+
+Maple Fleet
+`
+
+const FineAssignedSubject = `Maple Fleet Penalty Notice`
+const FineAssigned = `
+<style>* {font-size: 1rem;}</style>
+Dear {{ .UserName }},
+
+We have received a {{ .Kind }} penalty notice for a bike you were riding.
+
+- Reference: {{ .Reference }}
+- Registration: {{ .Registration }}
+- Date: {{ .OffenceAt }}
+- Location: {{ .Location }}
+- Amount: £{{ .Amount }}
+
+You can see the notice in the Fines tab of your Maple Fleet member profile. If you believe it is wrong, please contact us at info@maple.ai.
+
+Kind regards,<br/>
+Maple Fleet Team
+`
+
+const LowStockSubject = `Maple Fleet Parts Running Low`
+const LowStock = `
+<style>* {font-size: 1rem;}</style>
+Hello,
+
+The following parts at {{ .Garage }} have reached their reorder level:
+{{ range .Parts }}
+- {{ .SKU }} {{ .Description }}: {{ .Quantity }} left (reorder at {{ .ReorderLevel }})
+{{- end }}
+
+Maple Fleet
+`
+
+const GeofenceAlertSubject = `Maple Fleet Bike Alert`
+const GeofenceAlert = `
+<style>* {font-size: 1rem;}</style>
+Hello,
+
+The following bikes need attention:
+{{ range .Alerts }}
+- {{ .Registration }}: {{ .Alert }} ({{ .Level }}) at {{ .Time }}, [map](https://www.google.com/maps?q={{ .Lat }},{{ .Lng }})
+{{- end }}
+
+Please acknowledge the alerts in the admin alerts view once dealt with.
+
+Maple Fleet
+`
+
 const NewDriverAlert = `
 
 New user sign up alert
@@ -0,0 +1,99 @@
+package jobs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/maple-ai/fleet-api/config"
+	"github.com/maple-ai/fleet-api/db"
+	mgo "gopkg.in/mgo.v2"
+)
+
+// ComplianceReminders emails admins about vehicle documents expiring within the reminder window.
+// Each record is reminded once per expiry date; if the emails fail the records are reminded next run.
+func ComplianceReminders() (err error) {
+	days := config.Config.Compliance.ReminderDays
+	now := time.Now()
+
+	var records []db.BikeCompliance
+	if err := db.Cols.Compliance.Find(db.M{
+		"expiry": db.M{"$lte": now.AddDate(0, 0, days)},
+	}).Sort("expiry").All(&records); err != nil {
+		return err
+	}
+
+	claimed := []db.BikeCompliance{}
+	defer func() {
+		if err != nil {
+			releaseComplianceReminders(claimed)
+		}
+	}()
+
+	items := []map[string]string{}
+	for _, record := range records {
+		// claim the reminder so other instances skip it
+		if err := db.Cols.Compliance.Update(db.M{
+			"_id": record.ID,
+			"$or": []db.M{
+				{"reminded_at": db.M{"$exists": false}},
+				{"reminded_at": db.M{"$lt": record.Expiry.AddDate(0, 0, -days)}},
+			},
+		}, db.M{"$set": db.M{"reminded_at": now}}); err == mgo.ErrNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		claimed = append(claimed, record)
+
+		var bike db.Bike
+		if err := db.Cols.Bikes.FindId(record.BikeID).One(&bike); err != nil && err != mgo.ErrNotFound {
+			return err
+		} else if err == mgo.ErrNotFound || bike.Retired() {
+			continue
+		}
+
+		items = append(items, map[string]string{
+			"Registration": bike.Registration,
+			"Type":         db.ComplianceTypes[record.Type],
+			"Expiry":       record.Expiry.Format("02/01/2006"),
+		})
+	}
+
+	if len(items) == 0 {
+		return nil
+	}
+
+	emails, err := db.FindPrivilegedEmails("admin", "superadmin")
+	if err != nil {
+		return err
+	}
+
+	for _, email := range emails {
+		message, err := db.NewMail(email, db.ComplianceExpirySubject, db.ComplianceExpiry, map[string]interface{}{
+			"Items": items,
+		})
+		if err != nil {
+			return err
+		}
+
+		if _, _, err := config.Mail.Send(message); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// releaseComplianceReminders puts back when the records were last reminded
+func releaseComplianceReminders(records []db.BikeCompliance) {
+	for _, record := range records {
+		update := db.M{"$unset": db.M{"reminded_at": 1}}
+		if !record.RemindedAt.IsZero() {
+			update = db.M{"$set": db.M{"reminded_at": record.RemindedAt}}
+		}
+
+		if err := db.Cols.Compliance.UpdateId(record.ID, update); err != nil {
+			fmt.Println("Failed to release compliance reminder", record.ID.Hex(), err)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package jobs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/maple-ai/fleet-api/db"
+)
+
+// DepositRenewals holds deposits again before Stripe lets the hold lapse
+func DepositRenewals() error {
+	var deposits []db.Transaction
+	if err := db.Cols.Transactions.Find(db.M{
+		"type":       "deposit",
+		"status":     "held",
+		"renewed_by": db.M{"$exists": false},
+		"created":    db.M{"$lt": time.Now().Add(-db.DepositRenewal)},
+	}).All(&deposits); err != nil {
+		return err
+	}
+
+	for _, deposit := range deposits {
+		if err := db.RenewDeposit(deposit); err != nil {
+			fmt.Println("Deposit", deposit.ID.Hex(), "not renewed:", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,43 @@
+package jobs
+
+import (
+	"time"
+
+	"github.com/maple-ai/fleet-api/db"
+)
+
+// Positions reach storage up to a minute late, wait this long after check-out before analysing
+const drivingSettleTime = 10 * time.Minute
+
+// DrivingAnalytics summarises how recently completed shifts were ridden and updates the drivers' scores
+func DrivingAnalytics() error {
+	now := time.Now()
+
+	var shifts []db.Shift
+	if err := db.Cols.Shifts.Find(db.M{
+		"status":  "complete",
+		"driving": db.M{"$exists": false},
+		"check_out": db.M{
+			"$gte": now.AddDate(0, 0, -7),
+			"$lte": now.Add(-drivingSettleTime),
+		},
+	}).All(&shifts); err != nil {
+		return err
+	}
+
+	for _, shift := range shifts {
+		if shift.CheckIn.IsZero() {
+			continue
+		}
+
+		if _, err := db.ComputeShiftDriving(shift); err != nil {
+			return err
+		}
+
+		if err := db.UpdateDrivingScore(shift.UserID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,8 @@
+package jobs
+
+import "github.com/maple-ai/fleet-api/db"
+
+// FineEmails emails drivers about fines attributed to them which weren't emailed at the time
+func FineEmails() error {
+	return db.NotifyPendingFines()
+}
@@ -0,0 +1,33 @@
+/*
+Package jobs runs periodic background work alongside the API.
+
+Every API instance runs the jobs, so each job must be safe to run concurrently.
+*/
+package jobs
+
+import (
+	"fmt"
+	"time"
+)
+
+// Start launches all background jobs. Call after db.Setup.
+func Start() {
+	go every(24*time.Hour, "compliance reminders", ComplianceReminders)
+	go every(5*time.Minute, "bike transfers", BikeTransfers)
+	go every(time.Minute, "tracker positions", TrackerPositions)
+	go every(5*time.Minute, "alert emails", AlertEmails)
+	go every(10*time.Minute, "driving analytics", DrivingAnalytics)
+	go every(5*time.Minute, "payroll payouts", PayrollPayouts)
+	go every(time.Hour, "deposit renewals", DepositRenewals)
+	go every(10*time.Minute, "fine emails", FineEmails)
+}
+
+func every(interval time.Duration, name string, job func() error) {
+	for {
+		if err := job(); err != nil {
+			fmt.Println("Job '"+name+"' failed:", err)
+		}
+
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,47 @@
+package jobs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/maple-ai/fleet-api/config"
+	"github.com/maple-ai/fleet-api/db"
+	"github.com/maple-ai/fleet-api/payout"
+)
+
+// PayrollPayouts checks payroll runs waiting on payouts, paying and emailing drivers whose payout succeeded,
+// then sends payout emails which failed before
+func PayrollPayouts() error {
+	if config.Payouts != nil {
+		var runs []db.PayrollRun
+		if err := db.Cols.PayrollRuns.Find(db.M{"status": "paying"}).All(&runs); err != nil {
+			return err
+		}
+
+		for i := range runs {
+			if err := db.SettlePayrollRun(&runs[i], config.Payouts); err != nil {
+				fmt.Println("Payroll run", runs[i].ID.Hex(), "payouts unavailable:", err)
+			}
+		}
+	}
+
+	var runs []db.PayrollRun
+	if err := db.Cols.PayrollRuns.Find(db.M{
+		"lines": db.M{"$elemMatch": db.M{
+			"payout_status": payout.StatusSuccess,
+			"total":         db.M{"$gt": 0},
+			"notified_at":   db.M{"$exists": false},
+			"paid_at":       db.M{"$gte": time.Now().Add(-db.PayoutEmailRetry)},
+		}},
+	}).All(&runs); err != nil {
+		return err
+	}
+
+	for i := range runs {
+		if err := db.NotifyPayrollRun(&runs[i]); err != nil {
+			fmt.Println("Payroll run", runs[i].ID.Hex(), "payout emails failed:", err)
+		}
+	}
+
+	return nil
+}
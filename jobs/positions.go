@@ -0,0 +1,84 @@
+package jobs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/maple-ai/fleet-api/config"
+	"github.com/maple-ai/fleet-api/db"
+	"github.com/maple-ai/fleet-api/tracker"
+)
+
+// positionsBackfill is how far back positions are pulled for a tracker with none stored
+const positionsBackfill = 24 * time.Hour
+
+// TrackerPositions copies new positions for every tracked bike from the tracker server and raises alerts from them
+func TrackerPositions() error {
+	if len(config.Config.GPS.Endpoint) == 0 {
+		return nil
+	}
+
+	return syncPositions(tracker.New(config.Config.GPS.Endpoint, config.GetGPSAuthorization()), time.Now())
+}
+
+// AlertEmails emails alerts which weren't emailed when they were raised
+func AlertEmails() error {
+	return db.NotifyPendingAlerts()
+}
+
+func syncPositions(client *tracker.Client, now time.Time) error {
+	var bikes []db.Bike
+	if err := db.Cols.Bikes.Find(db.M{
+		"tracker_id": db.M{"$gt": 0},
+		"status":     db.M{"$nin": db.RetiredBikeStatuses},
+	}).All(&bikes); err != nil {
+		return err
+	}
+
+	for _, bike := range bikes {
+		from, err := db.LastPositionTime(bike.TrackerID)
+		if err != nil {
+			return err
+		}
+
+		if from.IsZero() {
+			from = now.Add(-positionsBackfill)
+		}
+
+		// one tracker being unavailable shouldn't stop the others
+		fixes, err := client.Positions(bike.TrackerID, from, now)
+		if err != nil {
+			fmt.Println("Positions for tracker", bike.TrackerID, "unavailable:", err)
+			continue
+		}
+
+		positions := make([]db.Position, len(fixes))
+		for i, fix := range fixes {
+			positions[i] = db.Position{
+				BikeID:     bike.ID,
+				TrackerID:  bike.TrackerID,
+				PositionID: fix.ID,
+				FixTime:    fix.FixTime,
+				Latitude:   fix.Latitude,
+				Longitude:  fix.Longitude,
+				Speed:      fix.Speed,
+				Course:     fix.Course,
+			}
+		}
+
+		if err := db.InsertPositions(positions); err != nil {
+			return err
+		}
+
+		alerts, err := db.CheckPositions(bike, positions)
+		if err != nil {
+			return err
+		}
+
+		if err := db.NotifyAlerts(alerts); err != nil {
+			fmt.Println("Failed to email alerts for bike", bike.ID.Hex(), err)
+		}
+	}
+
+	return nil
+}
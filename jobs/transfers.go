@@ -0,0 +1,28 @@
+package jobs
+
+import (
+	"time"
+
+	"github.com/maple-ai/fleet-api/db"
+	mgo "gopkg.in/mgo.v2"
+)
+
+// BikeTransfers completes scheduled garage transfers which have become effective
+func BikeTransfers() error {
+	var transfers []db.BikeTransfer
+	if err := db.Cols.Transfers.Find(db.M{
+		"status":    "scheduled",
+		"effective": db.M{"$lte": time.Now()},
+	}).All(&transfers); err != nil {
+		return err
+	}
+
+	for _, transfer := range transfers {
+		// another instance got there first
+		if err := db.CompleteBikeTransfer(transfer); err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/maple-ai/fleet-api/api"
 	"github.com/maple-ai/fleet-api/config"
 	"github.com/maple-ai/fleet-api/db"
+	"github.com/maple-ai/fleet-api/jobs"
 )
 
 func main() {
@@ -20,6 +21,12 @@ func main() {
 
 	db.Setup()
 
+	if err := db.Migrate(); err != nil {
+		panic(err)
+	}
+
+	jobs.Start()
+
 	http.Handle("/", api.Routes())
 
 	fmt.Println("Listening on port " + config.Config.Port)
@@ -0,0 +1,90 @@
+package payout
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+)
+
+// Fake is an in-memory Provider for tests and local development.
+// Items succeed on the first status check unless the receiver is in Fail, or Pending is set.
+type Fake struct {
+	// Receivers whose items fail, with the error
+	Fail map[string]string
+	// Leave items pending
+	Pending bool
+
+	mu      sync.Mutex
+	batches map[string][]Item
+	senders map[string]bool
+}
+
+// NewFake creates an empty fake provider
+func NewFake() *Fake {
+	return &Fake{
+		Fail:    map[string]string{},
+		batches: map[string][]Item{},
+		senders: map[string]bool{},
+	}
+}
+
+// CreateBatch records the items
+func (f *Fake) CreateBatch(senderBatchID string, subject string, items []Item) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.senders[senderBatchID] {
+		return "", ErrDuplicateBatch
+	}
+	f.senders[senderBatchID] = true
+
+	batchID := "FAKE-" + strconv.Itoa(len(f.batches)+1)
+	f.batches[batchID] = append([]Item{}, items...)
+	return batchID, nil
+}
+
+// BatchStatus reports every item as succeeded, failed or pending
+func (f *Fake) BatchStatus(batchID string) ([]ItemResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	items, ok := f.batches[batchID]
+	if !ok {
+		return nil, errors.New("unknown payout batch " + batchID)
+	}
+
+	results := []ItemResult{}
+	for i, item := range items {
+		result := ItemResult{
+			SenderItemID: item.SenderItemID,
+			ItemID:       batchID + "-" + strconv.Itoa(i+1),
+			Status:       StatusSuccess,
+		}
+
+		if reason, ok := f.Fail[item.Receiver]; ok {
+			result.Status = StatusFailed
+			result.Error = reason
+		} else if f.Pending {
+			result.Status = StatusPending
+		} else {
+			result.TransactionID = "FAKE-TX-" + result.ItemID
+		}
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// Batches returns the items sent in each batch, by batch ID
+func (f *Fake) Batches() map[string][]Item {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	batches := map[string][]Item{}
+	for id, items := range f.batches {
+		batches[id] = append([]Item{}, items...)
+	}
+
+	return batches
+}
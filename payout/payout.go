@@ -0,0 +1,53 @@
+/*
+Package payout sends money to drivers through a payout provider.
+
+Payouts are sent in batches and settle later, so callers create a batch and
+poll its status until every item has succeeded or failed.
+*/
+package payout
+
+import "errors"
+
+// Item statuses, as reported by BatchStatus
+const (
+	StatusPending = "pending"
+	StatusSuccess = "success"
+	StatusFailed  = "failed"
+)
+
+// ErrDuplicateBatch means a batch with the sender batch ID was already created.
+// The earlier attempt may have gone through, so check with the provider before sending again.
+var ErrDuplicateBatch = errors.New("payout batch already exists")
+
+// Item is a payment to one recipient
+type Item struct {
+	// Identifies the item in BatchStatus results, unique within the batch
+	SenderItemID string
+	// Email address of the recipient's account
+	Receiver string
+	// Amount in pence
+	Amount   int64
+	Currency string
+	Note     string
+}
+
+// ItemResult is the state of an item in a batch
+type ItemResult struct {
+	SenderItemID string
+	// Provider's IDs for the item and the money movement, once known
+	ItemID        string
+	TransactionID string
+	// StatusPending, StatusSuccess or StatusFailed
+	Status string
+	// Why the item failed
+	Error string
+}
+
+// Provider sends payout batches
+type Provider interface {
+	// CreateBatch sends the items, senderBatchID must be unique per batch and makes retries safe.
+	// Returns the provider's batch ID.
+	CreateBatch(senderBatchID string, subject string, items []Item) (string, error)
+	// BatchStatus reports every item in a batch
+	BatchStatus(batchID string) ([]ItemResult, error)
+}
@@ -0,0 +1,244 @@
+package payout
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PayPal API hosts
+const (
+	PayPalLive    = "https://api-m.paypal.com"
+	PayPalSandbox = "https://api-m.sandbox.paypal.com"
+)
+
+// Items fetched per page of a batch's status
+const paypalPageSize = 1000
+
+// PayPal sends payouts through the PayPal Payouts REST API
+type PayPal struct {
+	Endpoint string
+	ClientID string
+	Secret   string
+	HTTP     *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// NewPayPal creates a PayPal provider for the API at endpoint (PayPalLive or PayPalSandbox)
+func NewPayPal(endpoint string, clientID string, secret string) *PayPal {
+	return &PayPal{
+		Endpoint: endpoint,
+		ClientID: clientID,
+		Secret:   secret,
+		HTTP:     &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+type paypalError struct {
+	Name    string `json:"name"`
+	Message string `json:"message"`
+}
+
+func (e paypalError) Error() string {
+	return "paypal: " + e.Name + ": " + e.Message
+}
+
+// CreateBatch sends the items as one payout batch
+func (p *PayPal) CreateBatch(senderBatchID string, subject string, items []Item) (string, error) {
+	type amount struct {
+		Value    string `json:"value"`
+		Currency string `json:"currency"`
+	}
+	type item struct {
+		RecipientType string `json:"recipient_type"`
+		Amount        amount `json:"amount"`
+		Receiver      string `json:"receiver"`
+		Note          string `json:"note,omitempty"`
+		SenderItemID  string `json:"sender_item_id"`
+	}
+
+	body := struct {
+		Header struct {
+			SenderBatchID string `json:"sender_batch_id"`
+			EmailSubject  string `json:"email_subject"`
+		} `json:"sender_batch_header"`
+		Items []item `json:"items"`
+	}{}
+	body.Header.SenderBatchID = senderBatchID
+	body.Header.EmailSubject = subject
+
+	for _, i := range items {
+		body.Items = append(body.Items, item{
+			RecipientType: "EMAIL",
+			Amount: amount{
+				Value:    fmt.Sprintf("%d.%02d", i.Amount/100, i.Amount%100),
+				Currency: i.Currency,
+			},
+			Receiver:     i.Receiver,
+			Note:         i.Note,
+			SenderItemID: i.SenderItemID,
+		})
+	}
+
+	var result struct {
+		Header struct {
+			PayoutBatchID string `json:"payout_batch_id"`
+		} `json:"batch_header"`
+	}
+	if err := p.do("POST", "/v1/payments/payouts", body, &result); err != nil {
+		if e, ok := err.(paypalError); ok && (e.Name == "DUPLICATE_REQUEST_ID" || strings.Contains(e.Message, "already exists")) {
+			return "", ErrDuplicateBatch
+		}
+
+		return "", err
+	}
+
+	return result.Header.PayoutBatchID, nil
+}
+
+// BatchStatus pages through the batch's items
+func (p *PayPal) BatchStatus(batchID string) ([]ItemResult, error) {
+	results := []ItemResult{}
+
+	for page := 1; ; page++ {
+		var result struct {
+			Items []struct {
+				PayoutItemID      string `json:"payout_item_id"`
+				TransactionID     string `json:"transaction_id"`
+				TransactionStatus string `json:"transaction_status"`
+				PayoutItem        struct {
+					SenderItemID string `json:"sender_item_id"`
+				} `json:"payout_item"`
+				Errors paypalError `json:"errors"`
+			} `json:"items"`
+		}
+
+		path := "/v1/payments/payouts/" + url.PathEscape(batchID) +
+			"?page_size=" + strconv.Itoa(paypalPageSize) + "&page=" + strconv.Itoa(page)
+		if err := p.do("GET", path, nil, &result); err != nil {
+			return nil, err
+		}
+
+		for _, item := range result.Items {
+			status := paypalItemStatus(item.TransactionStatus)
+
+			itemResult := ItemResult{
+				SenderItemID:  item.PayoutItem.SenderItemID,
+				ItemID:        item.PayoutItemID,
+				TransactionID: item.TransactionID,
+				Status:        status,
+			}
+			if status == StatusFailed {
+				itemResult.Error = item.TransactionStatus
+				if len(item.Errors.Message) > 0 {
+					itemResult.Error += ": " + item.Errors.Message
+				}
+			}
+
+			results = append(results, itemResult)
+		}
+
+		if len(result.Items) < paypalPageSize {
+			return results, nil
+		}
+	}
+}
+
+// paypalItemStatus maps a transaction_status. Unclaimed items stay pending until claimed,
+// PayPal returns them after 30 days.
+func paypalItemStatus(status string) string {
+	switch status {
+	case "SUCCESS":
+		return StatusSuccess
+	case "FAILED", "RETURNED", "BLOCKED", "REFUNDED", "REVERSED", "DENIED":
+		return StatusFailed
+	default:
+		return StatusPending
+	}
+}
+
+func (p *PayPal) accessToken() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.token) > 0 && time.Now().Before(p.expires) {
+		return p.token, nil
+	}
+
+	req, err := http.NewRequest("POST", p.Endpoint+"/v1/oauth2/token", strings.NewReader("grant_type=client_credentials"))
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(p.ClientID, p.Secret)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := p.HTTP.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return "", fmt.Errorf("paypal: token request responded %d", resp.StatusCode)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+
+	p.token = token.AccessToken
+	// renew a minute early
+	p.expires = time.Now().Add(time.Duration(token.ExpiresIn-60) * time.Second)
+	return p.token, nil
+}
+
+func (p *PayPal) do(method string, path string, body interface{}, result interface{}) error {
+	token, err := p.accessToken()
+	if err != nil {
+		return err
+	}
+
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, p.Endpoint+path, &payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		var e paypalError
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || len(e.Name) == 0 {
+			return fmt.Errorf("paypal: %s %s responded %d", method, path, resp.StatusCode)
+		}
+
+		return e
+	}
+
+	return json.NewDecoder(resp.Body).Decode(result)
+}
@@ -0,0 +1,96 @@
+/*
+Package tracker is a client for the GPS tracker (Traccar) REST API.
+*/
+package tracker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// PageSize is how many positions are requested at once
+const PageSize = 500
+
+// TimeFormat is how the tracker API expects times
+const TimeFormat = "2006-01-02T15:04:05.000Z"
+
+// Position is a fix reported by a tracker
+type Position struct {
+	ID        int       `json:"id"`
+	DeviceID  int       `json:"deviceId"`
+	FixTime   time.Time `json:"fixTime"`
+	Latitude  float64   `json:"latitude"`
+	Longitude float64   `json:"longitude"`
+	Speed     float64   `json:"speed"`
+	Course    float64   `json:"course"`
+}
+
+// Client talks to one tracker server
+type Client struct {
+	Endpoint      string
+	Authorization string
+	HTTP          *http.Client
+}
+
+// New creates a client for the endpoint, authorization is sent as-is in the Authorization header
+func New(endpoint string, authorization string) *Client {
+	return &Client{
+		Endpoint:      endpoint,
+		Authorization: authorization,
+		HTTP:          &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Positions pages through all of a device's positions between from and to
+func (c *Client) Positions(deviceID int, from time.Time, to time.Time) ([]Position, error) {
+	positions := []Position{}
+
+	for page := 1; ; page++ {
+		result, err := c.positionsPage(deviceID, from, to, page)
+		if err != nil {
+			return nil, err
+		}
+
+		positions = append(positions, result...)
+		if len(result) < PageSize {
+			return positions, nil
+		}
+	}
+}
+
+func (c *Client) positionsPage(deviceID int, from time.Time, to time.Time, page int) ([]Position, error) {
+	q := url.Values{}
+	q.Set("deviceId", strconv.Itoa(deviceID))
+	q.Set("from", from.UTC().Format(TimeFormat))
+	q.Set("to", to.UTC().Format(TimeFormat))
+	q.Set("page", strconv.Itoa(page))
+	q.Set("start", strconv.Itoa((page-1)*PageSize))
+	q.Set("limit", strconv.Itoa(PageSize))
+
+	req, err := http.NewRequest("GET", c.Endpoint+"/positions?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", c.Authorization)
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("tracker responded %d", resp.StatusCode)
+	}
+
+	var result []Position
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
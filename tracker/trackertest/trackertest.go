@@ -0,0 +1,111 @@
+/*
+Package trackertest provides a stub tracker server for tests.
+*/
+package trackertest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/maple-ai/fleet-api/tracker"
+)
+
+// Server serves /positions like the tracker API from positions added with Add
+type Server struct {
+	*httptest.Server
+
+	// Authorization header requests must carry, unchecked if empty
+	Authorization string
+	// Fail makes every request respond 503, set it before making requests
+	Fail bool
+
+	mu        sync.Mutex
+	positions map[int][]tracker.Position
+	nextID    int
+}
+
+// NewServer starts a stub server, close it when done
+func NewServer() *Server {
+	s := &Server{positions: map[int][]tracker.Position{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+
+	return s
+}
+
+// Client returns a tracker client for the stub
+func (s *Server) Client() *tracker.Client {
+	return tracker.New(s.URL, s.Authorization)
+}
+
+// Add stores positions for a device, assigning IDs when missing
+func (s *Server) Add(deviceID int, positions ...tracker.Position) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, position := range positions {
+		s.nextID++
+		if position.ID == 0 {
+			position.ID = s.nextID
+		}
+		position.DeviceID = deviceID
+
+		s.positions[deviceID] = append(s.positions[deviceID], position)
+	}
+
+	sort.Slice(s.positions[deviceID], func(i, j int) bool {
+		return s.positions[deviceID][i].FixTime.Before(s.positions[deviceID][j].FixTime)
+	})
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	if s.Fail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	if len(s.Authorization) > 0 && r.Header.Get("Authorization") != s.Authorization {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if r.URL.Path != "/positions" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+	deviceID, _ := strconv.Atoi(q.Get("deviceId"))
+	start, _ := strconv.Atoi(q.Get("start"))
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	from, errFrom := time.Parse(tracker.TimeFormat, q.Get("from"))
+	to, errTo := time.Parse(tracker.TimeFormat, q.Get("to"))
+	if errFrom != nil || errTo != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	matched := []tracker.Position{}
+	for _, position := range s.positions[deviceID] {
+		if !position.FixTime.Before(from) && !position.FixTime.After(to) {
+			matched = append(matched, position)
+		}
+	}
+	s.mu.Unlock()
+
+	if start > len(matched) {
+		start = len(matched)
+	}
+	matched = matched[start:]
+	if limit > 0 && limit < len(matched) {
+		matched = matched[:limit]
+	}
+
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(matched)
+}